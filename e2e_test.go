@@ -6,11 +6,13 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
@@ -20,6 +22,7 @@ import (
 
 	"github.com/meln5674/go-tlstest"
 	"github.com/meln5674/oci-reg-docker/pkg/proxy"
+	ocidist "github.com/opencontainers/distribution-spec/specs-go/v1"
 
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
@@ -73,7 +76,10 @@ var _ = Describe("OCI Registry", func() {
 		Expect(err).ToNot(HaveOccurred())
 
 		reg = proxy.New(proxy.Config{
-			Docker: innerClient,
+			Backend:      &proxy.DockerBackend{Client: innerClient},
+			UploadDir:    filepath.Join(tmp, "uploads"),
+			AllowDelete:  true,
+			BlobCacheDir: filepath.Join(tmp, "blob-cache"),
 		})
 
 		srv = cert.NewHTTPSServer(reg.BuildHandler())
@@ -96,19 +102,66 @@ var _ = Describe("OCI Registry", func() {
 		resp, err := outerClient.ImagePull(ctx, toPull, image.PullOptions{})
 		Expect(err).ToNot(HaveOccurred())
 		defer resp.Close()
-		dec := json.NewDecoder(io.TeeReader(resp, GinkgoWriter))
-		var msg jsonmessage.JSONMessage
-		for {
-			err := dec.Decode(&msg)
-			if errors.Is(err, io.EOF) {
-				break
-			}
-			Expect(err).ToNot(HaveOccurred())
-			Expect(msg.Error).To(BeNil())
-		}
+		expectNoStreamErrors(resp)
+	})
+
+	It("should push an image into the inner docker", func(ctx context.Context) {
+		toPull := srvHost + "/" + testImage
+		GinkgoLogr.Info("pulling", "image", toPull)
+		resp, err := outerClient.ImagePull(ctx, toPull, image.PullOptions{})
+		Expect(err).ToNot(HaveOccurred())
+		defer resp.Close()
+		expectNoStreamErrors(resp)
+
+		toPush := srvHost + "/pushed/alpine:e2e"
+		Expect(outerClient.ImageTag(ctx, toPull, toPush)).To(Succeed())
+		GinkgoLogr.Info("pushing", "image", toPush)
+		// The daemon rejects pushes without any credentials, even if the registry does not require them
+		pushResp, err := outerClient.ImagePush(ctx, toPush, image.PushOptions{RegistryAuth: "e30="})
+		Expect(err).ToNot(HaveOccurred())
+		defer pushResp.Close()
+		expectNoStreamErrors(pushResp)
+
+		_, err = innerClient.ImageInspect(ctx, "pushed/alpine:e2e")
+		Expect(err).ToNot(HaveOccurred())
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodDelete, srv.URL+"/v2/pushed/alpine/manifests/e2e", nil)
+		Expect(err).ToNot(HaveOccurred())
+		delResp, err := srv.Client().Do(req)
+		Expect(err).ToNot(HaveOccurred())
+		defer delResp.Body.Close()
+		Expect(delResp.StatusCode).To(Equal(http.StatusAccepted))
+
+		_, err = innerClient.ImageInspect(ctx, "pushed/alpine:e2e")
+		Expect(docker.IsErrNotFound(err)).To(BeTrue())
+	})
+
+	It("should list the repository of an image in the inner docker", func(ctx context.Context) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/v2/_catalog", nil)
+		Expect(err).ToNot(HaveOccurred())
+		resp, err := srv.Client().Do(req)
+		Expect(err).ToNot(HaveOccurred())
+		defer resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		var catalog ocidist.RepositoryList
+		Expect(json.NewDecoder(resp.Body).Decode(&catalog)).To(Succeed())
+		Expect(catalog.Repositories).To(ContainElement(testImage[:strings.LastIndex(testImage, ":")]))
 	})
 })
 
+func expectNoStreamErrors(resp io.Reader) {
+	dec := json.NewDecoder(io.TeeReader(resp, GinkgoWriter))
+	var msg jsonmessage.JSONMessage
+	for {
+		err := dec.Decode(&msg)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		Expect(err).ToNot(HaveOccurred())
+		Expect(msg.Error).To(BeNil())
+	}
+}
+
 func startPodman(ctx context.Context, tmp string, inner bool) (podmanSocket *url.URL) {
 	podmanSocket = &url.URL{Scheme: "unix", Path: filepath.Join(tmp, "podman.sock")}
 
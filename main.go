@@ -7,18 +7,39 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
 	docker "github.com/docker/docker/client"
+	units "github.com/docker/go-units"
 
 	"github.com/meln5674/oci-reg-docker/pkg/proxy"
 )
 
 var (
-	listenAddr  = os.Getenv("REGISTRY_LISTEN_ADDR")
-	tlsCertPath = os.Getenv("REGISTRY_CERT_PATH")
-	tlsKeyPath  = os.Getenv("REGISTRY_KEY_PATH")
-	prefixesStr = os.Getenv("REGISTRY_PREFIXES")
+	listenAddr       = os.Getenv("REGISTRY_LISTEN_ADDR")
+	tlsCertPath      = os.Getenv("REGISTRY_CERT_PATH")
+	tlsKeyPath       = os.Getenv("REGISTRY_KEY_PATH")
+	prefixesStr      = os.Getenv("REGISTRY_PREFIXES")
+	uploadDir        = os.Getenv("REGISTRY_UPLOAD_DIR")
+	uploadTTLStr     = os.Getenv("REGISTRY_UPLOAD_TTL")
+	pullThrough      = os.Getenv("REGISTRY_PULL_THROUGH") == "true"
+	allowDelete      = os.Getenv("REGISTRY_ALLOW_DELETE") == "true"
+	blobCacheDir     = os.Getenv("REGISTRY_BLOB_CACHE_DIR")
+	blobCacheSizeStr = os.Getenv("REGISTRY_BLOB_CACHE_SIZE")
+	maxExportsStr    = os.Getenv("REGISTRY_MAX_CONCURRENT_EXPORTS")
+	exportDir        = os.Getenv("REGISTRY_EXPORT_DIR")
+	backendKind      = os.Getenv("REGISTRY_BACKEND")
+	layoutDir        = os.Getenv("REGISTRY_OCI_LAYOUT_DIR")
+	layoutRepository = os.Getenv("REGISTRY_OCI_LAYOUT_REPOSITORY")
+	tarballDir       = os.Getenv("REGISTRY_TARBALL_DIR")
+	containerdAddr   = os.Getenv("REGISTRY_CONTAINERD_ADDRESS")
+	containerdNS     = os.Getenv("REGISTRY_CONTAINERD_NAMESPACE")
+	podmanAddr       = os.Getenv("REGISTRY_PODMAN_ADDRESS")
+	dockerHostsStr   = os.Getenv("REGISTRY_DOCKER_HOSTS")
+	htpasswdPath     = os.Getenv("REGISTRY_HTPASSWD_PATH")
 )
 
 func main() {
@@ -40,18 +61,65 @@ func mainInner() error {
 			prefixes[prefix] = struct{}{}
 		}
 	}
-	client, err := docker.NewClientWithOpts(docker.FromEnv)
-	if err != nil {
-		return err
+	var blobCacheSize int64
+	if blobCacheSizeStr != "" {
+		var err error
+		blobCacheSize, err = units.RAMInBytes(blobCacheSizeStr)
+		if err != nil {
+			return fmt.Errorf("invalid REGISTRY_BLOB_CACHE_SIZE: %w", err)
+		}
+	}
+	var uploadTTL time.Duration
+	if uploadTTLStr != "" {
+		var err error
+		uploadTTL, err = time.ParseDuration(uploadTTLStr)
+		if err != nil {
+			return fmt.Errorf("invalid REGISTRY_UPLOAD_TTL: %w", err)
+		}
+	}
+	var maxExports int
+	if maxExportsStr != "" {
+		var err error
+		maxExports, err = strconv.Atoi(maxExportsStr)
+		if err != nil {
+			return fmt.Errorf("invalid REGISTRY_MAX_CONCURRENT_EXPORTS: %w", err)
+		}
 	}
 	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
 	defer cancel()
+	backend, err := newBackend(ctx)
+	if err != nil {
+		return err
+	}
 
-	reg := proxy.New(proxy.Config{Docker: client, Prefixes: prefixes})
+	reg := proxy.New(proxy.Config{
+		Backend:              backend,
+		Prefixes:             prefixes,
+		UploadDir:            uploadDir,
+		UploadTTL:            uploadTTL,
+		PullThrough:          pullThrough,
+		AllowDelete:          allowDelete,
+		BlobCacheDir:         blobCacheDir,
+		BlobCacheSize:        blobCacheSize,
+		MaxConcurrentExports: maxExports,
+		ExportDir:            exportDir,
+		HtpasswdPath:         htpasswdPath,
+	})
+	err = reg.LoadHtpasswd()
+	if err != nil {
+		return err
+	}
 	err = reg.BuildIndex(ctx)
 	if err != nil {
 		return err
 	}
+	go func() {
+		err := reg.WatchEvents(ctx)
+		if err != nil && ctx.Err() == nil {
+			slog.Error("stopped watching daemon events", "error", err)
+		}
+	}()
+	go reg.ExpireUploads(ctx)
 
 	srv := http.Server{
 		Addr:    listenAddr,
@@ -70,3 +138,99 @@ func mainInner() error {
 
 	return srv.ListenAndServeTLS(tlsCertPath, tlsKeyPath)
 }
+
+// newBackend creates the backend for each kind in REGISTRY_BACKEND, federating them in order if there is more
+// than one
+func newBackend(ctx context.Context) (proxy.Backend, error) {
+	kinds := strings.Fields(backendKind)
+	if len(kinds) == 0 {
+		kinds = []string{"docker"}
+	}
+	var backends []proxy.Backend
+	for _, kind := range kinds {
+		kindBackends, err := newBackendsOfKind(ctx, kind)
+		if err != nil {
+			return nil, err
+		}
+		backends = append(backends, kindBackends...)
+	}
+	if len(backends) == 1 {
+		return backends[0], nil
+	}
+	return proxy.NewFederatedBackend(backends...), nil
+}
+
+func newBackendsOfKind(ctx context.Context, kind string) ([]proxy.Backend, error) {
+	switch kind {
+	case "docker":
+		hosts := strings.Fields(dockerHostsStr)
+		if len(hosts) == 0 {
+			client, err := docker.NewClientWithOpts(docker.FromEnv)
+			if err != nil {
+				return nil, err
+			}
+			return []proxy.Backend{&proxy.DockerBackend{Client: client}}, nil
+		}
+		backends := make([]proxy.Backend, 0, len(hosts))
+		for _, host := range hosts {
+			client, err := docker.NewClientWithOpts(docker.FromEnv, docker.WithHost(host))
+			if err != nil {
+				return nil, fmt.Errorf("invalid docker host %s: %w", host, err)
+			}
+			backends = append(backends, &proxy.DockerBackend{Client: client})
+		}
+		return backends, nil
+	case "oci-layout":
+		if layoutDir == "" {
+			return nil, fmt.Errorf("REGISTRY_OCI_LAYOUT_DIR is required for the oci-layout backend")
+		}
+		layout, err := proxy.NewLayoutBackend(layoutDir, layoutRepository)
+		if err != nil {
+			return nil, err
+		}
+		return []proxy.Backend{layout}, nil
+	case "tarballs":
+		if tarballDir == "" {
+			return nil, fmt.Errorf("REGISTRY_TARBALL_DIR is required for the tarballs backend")
+		}
+		tarballs, err := proxy.NewTarballBackend(ctx, tarballDir)
+		if err != nil {
+			return nil, err
+		}
+		return []proxy.Backend{tarballs}, nil
+	case "containerd":
+		if containerdAddr == "" {
+			containerdAddr = "/run/containerd/containerd.sock"
+		}
+		if containerdNS == "" {
+			containerdNS = "default"
+		}
+		ctrd, err := proxy.NewContainerdBackend(containerdAddr, containerdNS)
+		if err != nil {
+			return nil, err
+		}
+		return []proxy.Backend{ctrd}, nil
+	case "podman":
+		if podmanAddr == "" {
+			podmanAddr = defaultPodmanAddress()
+		}
+		podman, err := proxy.NewPodmanBackend(podmanAddr)
+		if err != nil {
+			return nil, err
+		}
+		return []proxy.Backend{podman}, nil
+	default:
+		return nil, fmt.Errorf("invalid REGISTRY_BACKEND: %s", kind)
+	}
+}
+
+// defaultPodmanAddress returns the address of the podman socket the podman CLI would use for the current user
+func defaultPodmanAddress() string {
+	if host := os.Getenv("CONTAINER_HOST"); host != "" {
+		return host
+	}
+	if runtimeDir := os.Getenv("XDG_RUNTIME_DIR"); runtimeDir != "" && os.Getuid() != 0 {
+		return "unix://" + filepath.Join(runtimeDir, "podman", "podman.sock")
+	}
+	return "unix:///run/podman/podman.sock"
+}
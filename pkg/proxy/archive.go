@@ -0,0 +1,203 @@
+package proxy
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	godigest "github.com/opencontainers/go-digest"
+	ociimage "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// archiveBlob is a blob to be written to an OCI image layout tarball
+type archiveBlob struct {
+	Digest godigest.Digest
+	Size   int64
+	// Open returns the content of the blob
+	Open func() (io.ReadCloser, error)
+}
+
+// dockerArchiveManifest is an entry in the manifest.json file of a tarball produced by docker save.
+// Daemons without the containerd image store only load tarballs which include this file.
+type dockerArchiveManifest struct {
+	// Config is the path within the tarball of the image config
+	Config string
+	// RepoTags are the tags to apply to the image when loaded
+	RepoTags []string
+	// Layers are the paths within the tarball of the image layers, in order
+	Layers []string
+}
+
+// dockerArchiveManifestFile is the name of the file in a docker save tarball listing its images
+const dockerArchiveManifestFile = "manifest.json"
+
+// archiveBlobPath returns the path within an OCI image layout of the blob with the given digest
+func archiveBlobPath(dgst godigest.Digest) string {
+	return path.Join(ociimage.ImageBlobsDir, dgst.Algorithm().String(), dgst.Encoded())
+}
+
+// writeOCIArchive writes an OCI image layout tarball containing the given index and blobs,
+// suitable for loading into a daemon.
+// If dockerManifests is not empty, a docker save manifest.json is written as well so that the tarball can be
+// loaded by daemons without the containerd image store.
+func writeOCIArchive(w io.Writer, index ociimage.Index, dockerManifests []dockerArchiveManifest, blobs []archiveBlob) error {
+	tw := tar.NewWriter(w)
+
+	layoutJSON, err := json.Marshal(ociimage.ImageLayout{Version: ociimage.ImageLayoutVersion})
+	if err != nil {
+		return err
+	}
+	err = writeArchiveFile(tw, ociimage.ImageLayoutFile, layoutJSON)
+	if err != nil {
+		return err
+	}
+
+	if index.MediaType == "" {
+		index.MediaType = ociimage.MediaTypeImageIndex
+	}
+	index.SchemaVersion = 2
+	indexJSON, err := json.Marshal(&index)
+	if err != nil {
+		return err
+	}
+	err = writeArchiveFile(tw, ociimage.ImageIndexFile, indexJSON)
+	if err != nil {
+		return err
+	}
+
+	if len(dockerManifests) != 0 {
+		dockerManifestsJSON, err := json.Marshal(dockerManifests)
+		if err != nil {
+			return err
+		}
+		err = writeArchiveFile(tw, dockerArchiveManifestFile, dockerManifestsJSON)
+		if err != nil {
+			return err
+		}
+	}
+
+	written := make(map[godigest.Digest]struct{}, len(blobs))
+	for _, blob := range blobs {
+		if _, ok := written[blob.Digest]; ok {
+			continue
+		}
+		written[blob.Digest] = struct{}{}
+		err = writeArchiveBlob(tw, blob)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tw.Close()
+}
+
+func writeArchiveFile(tw *tar.Writer, name string, content []byte) error {
+	err := tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     int64(len(content)),
+		Mode:     0o444,
+	})
+	if err != nil {
+		return fmt.Errorf("writing %s to archive: %w", name, err)
+	}
+	_, err = tw.Write(content)
+	if err != nil {
+		return fmt.Errorf("writing %s to archive: %w", name, err)
+	}
+	return nil
+}
+
+func writeArchiveBlob(tw *tar.Writer, blob archiveBlob) error {
+	name := archiveBlobPath(blob.Digest)
+	content, err := blob.Open()
+	if err != nil {
+		return fmt.Errorf("opening blob %s: %w", blob.Digest, err)
+	}
+	defer content.Close()
+	err = tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     blob.Size,
+		Mode:     0o444,
+	})
+	if err != nil {
+		return fmt.Errorf("writing blob %s to archive: %w", blob.Digest, err)
+	}
+	_, err = io.Copy(tw, content)
+	if err != nil {
+		return fmt.Errorf("writing blob %s to archive: %w", blob.Digest, err)
+	}
+	return nil
+}
+
+// readOCIArchive reads an OCI image layout tarball, passing each blob to putBlob and returning the index and,
+// if present, the docker save manifest.json.
+// The content passed to putBlob returns an error instead of io.EOF if it does not match its digest, so putBlob
+// must read it completely before keeping it.
+func readOCIArchive(archive io.Reader, putBlob func(dgst godigest.Digest, content io.Reader) error) (index ociimage.Index, dockerManifests []dockerArchiveManifest, err error) {
+	tr := tar.NewReader(archive)
+	var hasIndex bool
+	for {
+		h, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return index, nil, fmt.Errorf("reading archive: %w", err)
+		}
+		if h.Typeflag != tar.TypeReg {
+			continue
+		}
+		switch h.Name {
+		case ociimage.ImageIndexFile:
+			err = json.NewDecoder(tr).Decode(&index)
+			if err != nil {
+				return index, nil, fmt.Errorf("archive contained invalid index: %w", err)
+			}
+			hasIndex = true
+		case dockerArchiveManifestFile:
+			err = json.NewDecoder(tr).Decode(&dockerManifests)
+			if err != nil {
+				return index, nil, fmt.Errorf("archive contained invalid %s: %w", dockerArchiveManifestFile, err)
+			}
+		default:
+			encoded, ok := strings.CutPrefix(h.Name, ociimage.ImageBlobsDir+"/")
+			if !ok {
+				continue
+			}
+			dgst := godigest.Digest(strings.Replace(encoded, "/", ":", 1))
+			if dgst.Validate() != nil {
+				continue
+			}
+			err = putBlob(dgst, &verifyingReader{reader: tr, digest: dgst, verifier: dgst.Verifier()})
+			if err != nil {
+				return index, nil, fmt.Errorf("storing blob %s: %w", dgst, err)
+			}
+		}
+	}
+	if !hasIndex {
+		return index, nil, fmt.Errorf("archive is not an OCI image layout, it has no %s", ociimage.ImageIndexFile)
+	}
+	return index, dockerManifests, nil
+}
+
+// verifyingReader returns an error at the end of its content if it does not match the expected digest
+type verifyingReader struct {
+	reader   io.Reader
+	digest   godigest.Digest
+	verifier godigest.Verifier
+}
+
+func (v *verifyingReader) Read(b []byte) (int, error) {
+	n, err := v.reader.Read(b)
+	v.verifier.Write(b[:n])
+	if errors.Is(err, io.EOF) && !v.verifier.Verified() {
+		return n, fmt.Errorf("content does not match digest %s", v.digest)
+	}
+	return n, err
+}
@@ -0,0 +1,206 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/meln5674/minimux"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// authRealm is the realm of the basic auth challenge
+const authRealm = "oci-reg-docker"
+
+// htpasswdCheckInterval is the shortest time between checks for changes to the htpasswd file
+const htpasswdCheckInterval = time.Second
+
+// errUnauthenticated is returned for any request without valid credentials when authentication is enabled
+var errUnauthenticated = &registryError{Status: http.StatusUnauthorized, Code: codeUnauthorized, Message: "authentication required"}
+
+// htpasswdFile is an htpasswd file of bcrypt hashed passwords, which is read again whenever it changes
+type htpasswdFile struct {
+	path string
+
+	// lock must be held when using checked, modTime, size, users, dummyHash, and verified
+	lock sync.Mutex
+	// checked is when the file was last checked for changes
+	checked time.Time
+	modTime time.Time
+	size    int64
+	// users is a map from user name to password hash, or nil if the file has never been read successfully
+	users map[string][]byte
+	// dummyHash is a hash with the highest cost of those in the file, which passwords of unknown users are compared
+	// against so that they take as long to reject as those of known users
+	dummyHash []byte
+	// verified is a map from user name to the digest of the password last verified for them, as bcrypt is
+	// deliberately too slow to repeat for every request
+	verified map[string][sha256.Size]byte
+}
+
+func newHtpasswdFile(path string) *htpasswdFile {
+	return &htpasswdFile{path: path}
+}
+
+// reload reads the file again if it has changed since it was last read, checking at most once per
+// htpasswdCheckInterval.
+// If it cannot be read, the users it last contained are kept.
+// lock must be held.
+func (h *htpasswdFile) reload() error {
+	if !h.checked.IsZero() && time.Since(h.checked) < htpasswdCheckInterval {
+		return nil
+	}
+	h.checked = time.Now()
+	info, err := os.Stat(h.path)
+	if err != nil {
+		return err
+	}
+	if h.users != nil && info.ModTime().Equal(h.modTime) && info.Size() == h.size {
+		return nil
+	}
+	content, err := os.ReadFile(h.path)
+	if err != nil {
+		return err
+	}
+	users, err := parseHtpasswd(content)
+	if err != nil {
+		return err
+	}
+	dummyHash, err := dummyHashFor(users, h.dummyHash)
+	if err != nil {
+		return err
+	}
+	slog.Info("read htpasswd file", "path", h.path, "users", len(users))
+	h.users = users
+	h.dummyHash = dummyHash
+	h.verified = make(map[string][sha256.Size]byte)
+	h.modTime = info.ModTime()
+	h.size = info.Size()
+	return nil
+}
+
+// dummyHashFor returns a hash of a random password with the highest cost of the hashes of users, reusing
+// previous if it has that cost
+func dummyHashFor(users map[string][]byte, previous []byte) ([]byte, error) {
+	cost := bcrypt.MinCost
+	for _, hash := range users {
+		// Every hash was checked when parsing the file
+		hashCost, _ := bcrypt.Cost(hash)
+		cost = max(cost, hashCost)
+	}
+	if previousCost, err := bcrypt.Cost(previous); err == nil && previousCost == cost {
+		return previous, nil
+	}
+	password := make([]byte, 16)
+	_, err := rand.Read(password)
+	if err != nil {
+		return nil, err
+	}
+	return bcrypt.GenerateFromPassword(password, cost)
+}
+
+// parseHtpasswd parses the user:hash lines of an htpasswd file, ignoring blank lines and comments.
+// Only bcrypt hashes are supported, as the other formats htpasswd can produce are insecure.
+func parseHtpasswd(content []byte) (map[string][]byte, error) {
+	users := make(map[string][]byte)
+	lines := bufio.NewScanner(bytes.NewReader(content))
+	for lineNum := 1; lines.Scan(); lineNum++ {
+		line := strings.TrimSpace(lines.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok || user == "" {
+			return nil, fmt.Errorf("line %d is not user:hash", lineNum)
+		}
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("line %d: password of %s is not a bcrypt hash: %w", lineNum, user, err)
+		}
+		users[user] = []byte(hash)
+	}
+	return users, lines.Err()
+}
+
+// authenticate returns true if the password is correct for the user
+func (h *htpasswdFile) authenticate(user, password string) bool {
+	passwordDigest := sha256.Sum256([]byte(password))
+	h.lock.Lock()
+	err := h.reload()
+	if err != nil {
+		slog.Error("failed to read htpasswd file", "path", h.path, "error", err)
+	}
+	hash, ok := h.users[user]
+	verified, wasVerified := h.verified[user]
+	dummyHash := h.dummyHash
+	h.lock.Unlock()
+	if !ok {
+		if dummyHash != nil {
+			bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		}
+		return false
+	}
+	if wasVerified && verified == passwordDigest {
+		return true
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil {
+		return false
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	// The file may have changed while the hash was being compared
+	if current, ok := h.users[user]; ok && bytes.Equal(current, hash) {
+		h.verified[user] = passwordDigest
+	}
+	return true
+}
+
+// LoadHtpasswd reads the htpasswd file at HtpasswdPath, returning an error if it is missing or malformed, so that
+// a mistake is found when the registry starts rather than by every request failing to authenticate.
+// The file is otherwise read when the first request is authenticated.
+// Does nothing if authentication is disabled.
+func (r *Registry) LoadHtpasswd() error {
+	if r.htpasswd == nil {
+		return nil
+	}
+	r.htpasswd.lock.Lock()
+	defer r.htpasswd.lock.Unlock()
+	err := r.htpasswd.reload()
+	if err != nil {
+		return fmt.Errorf("reading htpasswd file %s: %w", r.htpasswd.path, err)
+	}
+	return nil
+}
+
+// authUserKey is the context key of the name of the user a request was authenticated as
+type authUserKey struct{}
+
+// authenticate is a PreProcessor which checks the basic auth credentials of a request, recording the user in the
+// context of the request if they are valid
+func (r *Registry) authenticate(ctx context.Context, rq *http.Request) (context.Context, func()) {
+	user, password, ok := rq.BasicAuth()
+	if !ok || !r.htpasswd.authenticate(user, password) {
+		return ctx, nil
+	}
+	return context.WithValue(ctx, authUserKey{}, user), nil
+}
+
+// requireAuth wraps a handler to reject requests which the authenticate PreProcessor did not authenticate with a
+// basic auth challenge
+func requireAuth(handler minimux.Handler) minimux.Handler {
+	return minimux.HandlerFunc(func(ctx context.Context, w http.ResponseWriter, rq *http.Request, pathVars map[string]string, formErr error) error {
+		if _, ok := ctx.Value(authUserKey{}).(string); !ok {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", authRealm))
+			return writeError(w, errUnauthenticated, codeUnauthorized)
+		}
+		return handler.ServeHTTP(ctx, w, rq, pathVars, formErr)
+	})
+}
@@ -0,0 +1,112 @@
+package proxy_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/meln5674/oci-reg-docker/pkg/proxy"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// writeHtpasswd writes an htpasswd file with a bcrypt hash of the password of each user
+func writeHtpasswd(path string, users ...string) {
+	var content []byte
+	for i := 0; i+1 < len(users); i += 2 {
+		hash, err := bcrypt.GenerateFromPassword([]byte(users[i+1]), bcrypt.MinCost)
+		Expect(err).ToNot(HaveOccurred())
+		content = append(content, users[i]+":"+string(hash)+"\n"...)
+	}
+	Expect(os.WriteFile(path, content, 0o600)).To(Succeed())
+}
+
+// basicAuth returns the headers for a request with basic auth credentials
+func basicAuth(user, password string) []string {
+	rq, err := http.NewRequest(http.MethodGet, "/", nil)
+	Expect(err).ToNot(HaveOccurred())
+	rq.SetBasicAuth(user, password)
+	return []string{"Authorization", rq.Header.Get("Authorization")}
+}
+
+var _ = Describe("Basic auth", func() {
+	var htpasswdPath string
+	var client registryClient
+
+	BeforeEach(func(ctx context.Context) {
+		htpasswdPath = filepath.Join(GinkgoT().TempDir(), "htpasswd")
+		writeHtpasswd(htpasswdPath, "alice", "correct horse")
+		reg := proxy.New(proxy.Config{
+			Backend:      proxy.NewMemoryBackend(),
+			HtpasswdPath: htpasswdPath,
+		})
+		Expect(reg.LoadHtpasswd()).To(Succeed())
+		Expect(reg.BuildIndex(ctx)).To(Succeed())
+		srv := httptest.NewServer(reg.BuildHandler())
+		DeferCleanup(srv.Close)
+		client = registryClient{srv: srv}
+	})
+
+	It("should challenge requests without credentials", func(ctx context.Context) {
+		resp := client.do(ctx, http.MethodGet, "/v2/", nil)
+		Expect(resp.Header.Get("WWW-Authenticate")).To(Equal(`Basic realm="oci-reg-docker"`))
+		expectErrorCode(resp, http.StatusUnauthorized, "UNAUTHORIZED")
+
+		resp = client.do(ctx, http.MethodGet, "/v2/_catalog", nil)
+		expectErrorCode(resp, http.StatusUnauthorized, "UNAUTHORIZED")
+	})
+
+	It("should reject incorrect credentials", func(ctx context.Context) {
+		resp := client.do(ctx, http.MethodGet, "/v2/", nil, basicAuth("alice", "wrong")...)
+		expectErrorCode(resp, http.StatusUnauthorized, "UNAUTHORIZED")
+
+		resp = client.do(ctx, http.MethodGet, "/v2/", nil, basicAuth("mallory", "correct horse")...)
+		expectErrorCode(resp, http.StatusUnauthorized, "UNAUTHORIZED")
+	})
+
+	It("should accept correct credentials", func(ctx context.Context) {
+		for range 2 {
+			resp := client.do(ctx, http.MethodGet, "/v2/", nil, basicAuth("alice", "correct horse")...)
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		}
+		resp := client.do(ctx, http.MethodGet, "/v2/_catalog", nil, basicAuth("alice", "correct horse")...)
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+	})
+
+	It("should read the file again when it changes", func(ctx context.Context) {
+		resp := client.do(ctx, http.MethodGet, "/v2/", nil, basicAuth("alice", "correct horse")...)
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+		writeHtpasswd(htpasswdPath, "bob", "battery staple")
+
+		// The file is only checked for changes once a second
+		resp = client.do(ctx, http.MethodGet, "/v2/", nil, basicAuth("alice", "correct horse")...)
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		Eventually(func(ctx context.Context) int {
+			return client.do(ctx, http.MethodGet, "/v2/", nil, basicAuth("bob", "battery staple")...).StatusCode
+		}).WithContext(ctx).WithTimeout(5 * time.Second).Should(Equal(http.StatusOK))
+		resp = client.do(ctx, http.MethodGet, "/v2/", nil, basicAuth("alice", "correct horse")...)
+		expectErrorCode(resp, http.StatusUnauthorized, "UNAUTHORIZED")
+	})
+
+	It("should fail to load a missing or malformed file", func() {
+		reg := proxy.New(proxy.Config{
+			Backend:      proxy.NewMemoryBackend(),
+			HtpasswdPath: filepath.Join(GinkgoT().TempDir(), "missing"),
+		})
+		Expect(reg.LoadHtpasswd()).ToNot(Succeed())
+
+		Expect(os.WriteFile(htpasswdPath, []byte("alice:correct horse\n"), 0o600)).To(Succeed())
+		reg = proxy.New(proxy.Config{
+			Backend:      proxy.NewMemoryBackend(),
+			HtpasswdPath: htpasswdPath,
+		})
+		Expect(reg.LoadHtpasswd()).ToNot(Succeed())
+	})
+})
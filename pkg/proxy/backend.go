@@ -0,0 +1,110 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"slices"
+	"time"
+
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/image"
+
+	godigest "github.com/opencontainers/go-digest"
+	ociimage "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Backend is a store of images that the registry serves.
+// Images are described using the types of the Docker Engine API, as that is what the registry was first built
+// against, and errors should be classifiable with the errdefs package, such as errdefs.NotFound when an image
+// does not exist.
+type Backend interface {
+	// ImageList returns a summary of every image in the store
+	ImageList(ctx context.Context) ([]image.Summary, error)
+	// ImageInspect returns the metadata of an image by ID or reference
+	ImageInspect(ctx context.Context, ref string) (image.InspectResponse, error)
+	// ImageSave exports an image as a tarball in the format produced by docker save,
+	// preferably an OCI image layout
+	ImageSave(ctx context.Context, imgID string) (io.ReadCloser, error)
+	// ImageLoad imports a tarball in the format produced by docker save
+	ImageLoad(ctx context.Context, archive io.Reader) error
+	// ImageRemove removes a tag or digest reference to an image.
+	// The image itself is removed once it has no references left.
+	ImageRemove(ctx context.Context, ref string) error
+}
+
+// PullingBackend is a Backend which can pull images from their upstream registry, allowing pull-through
+type PullingBackend interface {
+	Backend
+	// ImagePull pulls an image by reference, returning once it is present in the store
+	ImagePull(ctx context.Context, ref string) error
+}
+
+// WatchingBackend is a Backend which reports changes to its images, allowing the index to be kept up to date
+type WatchingBackend interface {
+	Backend
+	// ImageEvents streams image events which occurred after since, or from now on if it is zero,
+	// until ctx is cancelled or an error is sent.
+	// Events should be reported with the actions and actor IDs used by the Docker Engine API.
+	ImageEvents(ctx context.Context, since time.Time) (<-chan events.Message, <-chan error)
+}
+
+// BlobBackend is a Backend which can read blobs directly, so that serving a blob does not require exporting the
+// whole image it belongs to
+type BlobBackend interface {
+	Backend
+	// BlobOpen returns the content of a blob and its size, or an errdefs.NotFound error if it is not present.
+	// The content should implement io.Seeker if it can, so that ranges can be served without reading up to them.
+	// A backend which can only read some blobs directly should return an errdefs.NotImplemented error for the
+	// rest, so that the image they belong to is exported instead.
+	BlobOpen(ctx context.Context, dgst godigest.Digest) (io.ReadCloser, int64, error)
+}
+
+// BlobStoringBackend is a BlobBackend which stores blobs as files, so that pushed blobs are written into it
+// directly, and pushed manifests are added to it without loading them as a tarball
+type BlobStoringBackend interface {
+	BlobBackend
+	// BlobDir returns the directory blobs are stored in, as files named by their algorithm and encoded digest,
+	// as in the blobs directory of an OCI image layout.
+	// Only blobs which have been verified against their digest may be moved into it.
+	BlobDir() string
+	// ImagePut adds an image whose manifest and blobs are already in BlobDir, with the tags given by the
+	// annotations of its descriptor, as for an image loaded with ImageLoad
+	ImagePut(ctx context.Context, desc ociimage.Descriptor) error
+}
+
+// imageChangeEvents returns the events describing the differences between two listings of the same images.
+// New images and images which gained tags are reported as tagged, images which only lost tags as untagged, and
+// images which are gone as deleted.
+func imageChangeEvents(before, after []image.Summary) []events.Message {
+	now := time.Now()
+	event := func(action events.Action, id string) events.Message {
+		return events.Message{
+			Type:     events.ImageEventType,
+			Action:   action,
+			Actor:    events.Actor{ID: id},
+			Time:     now.Unix(),
+			TimeNano: now.UnixNano(),
+		}
+	}
+	beforeTags := make(map[string][]string, len(before))
+	for _, img := range before {
+		beforeTags[img.ID] = img.RepoTags
+	}
+	var msgs []events.Message
+	for _, img := range after {
+		tags, existed := beforeTags[img.ID]
+		delete(beforeTags, img.ID)
+		switch {
+		case !existed || slices.ContainsFunc(img.RepoTags, func(tag string) bool { return !slices.Contains(tags, tag) }):
+			msgs = append(msgs, event(events.ActionTag, img.ID))
+		case len(tags) != len(img.RepoTags):
+			msgs = append(msgs, event(events.ActionUnTag, img.ID))
+		}
+	}
+	for _, img := range before {
+		if _, removed := beforeTags[img.ID]; removed {
+			msgs = append(msgs, event(events.ActionDelete, img.ID))
+		}
+	}
+	return msgs
+}
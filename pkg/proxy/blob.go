@@ -0,0 +1,260 @@
+package proxy
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/errdefs"
+
+	godigest "github.com/opencontainers/go-digest"
+)
+
+var (
+	// errBlobNotIndexed is returned when a blob is not part of any indexed image
+	errBlobNotIndexed = &registryError{Status: http.StatusNotFound, Code: codeBlobUnknown, Message: "digest not in blob index"}
+	// errBlobNotInRepo is returned when a blob is indexed, but not as part of an image in the requested repository
+	errBlobNotInRepo = &registryError{Status: http.StatusNotFound, Code: codeBlobUnknown, Message: "digest was not indexed as belonging to this repo"}
+)
+
+// findImageForBlob returns an indexed image in the given repository that contains the given blob
+func (r *Registry) findImageForBlob(name, digest string) (*image.InspectResponse, error) {
+	r.indexLock.RLock()
+	defer r.indexLock.RUnlock()
+	imgs, ok := r.blobIndex[digest]
+	if !ok {
+		return nil, errBlobNotIndexed
+	}
+
+	for _, img := range imgs {
+		if inRepo(img, name) {
+			return img, nil
+		}
+	}
+	return nil, errBlobNotInRepo
+}
+
+// openImageBlob returns a reader for one of the blobs of an image along with its size, reading it directly from
+// the backend if it can, or otherwise exporting the image from the daemon if the blob is not in the blob cache.
+// The returned reader must be closed to release the export.
+func (r *Registry) openImageBlob(ctx context.Context, img *image.InspectResponse, digest string) (io.ReadCloser, int64, error) {
+	if f, size, ok := r.blobCache.Open(godigest.Digest(digest)); ok {
+		return f, size, nil
+	}
+	// Blobs are not necessarily stored by digest in the exported tarball, so the manifest must be known
+	// to find them
+	manifest, err := r.getAndCacheManifest(ctx, img)
+	if err != nil {
+		return nil, 0, err
+	}
+	if _, ok := manifest.blobSize(godigest.Digest(digest)); !ok {
+		return nil, 0, r.blobNotInManifest(img, digest)
+	}
+	if blobs, ok := r.Backend.(BlobBackend); ok {
+		content, size, err := blobs.BlobOpen(ctx, godigest.Digest(digest))
+		if !errdefs.IsNotImplemented(err) {
+			return content, size, err
+		}
+	}
+	// Exporting the image to find the manifest will have cached every blob if the cache is enabled
+	if f, size, ok := r.blobCache.Open(godigest.Digest(digest)); ok {
+		return f, size, nil
+	}
+	return r.openSavedBlob(ctx, img.ID, manifest.blobPath(godigest.Digest(digest)), godigest.Digest(digest))
+}
+
+// blobSize returns the size of one of the blobs of an image without exporting it, or false if it is not known.
+// The size is known if the blob is cached, the manifest that refers to it is, it is the manifest of the image, or
+// the backend can read blobs directly.
+func (r *Registry) blobSize(ctx context.Context, img *image.InspectResponse, dgst godigest.Digest) (int64, bool, error) {
+	if size, ok := r.blobCache.Stat(dgst); ok {
+		return size, true, nil
+	}
+	if manifest, ok := r.getCachedManifest(img.ID); ok {
+		size, ok := manifest.blobSize(dgst)
+		if !ok {
+			return 0, false, r.blobNotInManifest(img, string(dgst))
+		}
+		return size, true, nil
+	}
+	if img.Descriptor != nil && img.Descriptor.Digest == dgst {
+		return img.Descriptor.Size, true, nil
+	}
+	if blobs, ok := r.Backend.(BlobBackend); ok {
+		content, size, err := blobs.BlobOpen(ctx, dgst)
+		if err == nil {
+			content.Close()
+			return size, true, nil
+		}
+		if !errdefs.IsNotImplemented(err) {
+			return 0, false, err
+		}
+	}
+	return 0, false, nil
+}
+
+// blobNotInManifest explains why a blob indexed as belonging to an image is not referenced by its manifest.
+// This happens when a layer is requested by its diffID, but is stored compressed.
+func (r *Registry) blobNotInManifest(img *image.InspectResponse, digest string) error {
+	if layer, ok := r.layerForDiffID(digest); ok && layer != digest {
+		return fmt.Errorf("%w: %s is the diffID of layer %s, which is stored compressed", errBlobNotIndexed, digest, layer)
+	}
+	return fmt.Errorf("%w: %s is not referenced by the manifest of image %s", errBlobNotIndexed, digest, img.ID)
+}
+
+// savedBlob is a single blob being read out of an image tarball exported by the daemon.
+// If the blob cache is enabled, the blob is added to it once it has been read completely.
+type savedBlob struct {
+	reader io.Reader
+	closer io.Closer
+	cache  *blobCacheWriter
+	// remaining is the number of bytes of the blob that have not been read yet
+	remaining int64
+}
+
+func (s *savedBlob) Read(b []byte) (int, error) {
+	n, err := s.reader.Read(b)
+	s.remaining -= int64(n)
+	return n, err
+}
+
+func (s *savedBlob) Close() error {
+	if s.remaining == 0 {
+		_, err := s.cache.Commit()
+		if err != nil {
+			slog.Warn("failed to cache blob", "error", err)
+		}
+	} else {
+		s.cache.Discard()
+	}
+	return s.closer.Close()
+}
+
+// openSavedBlob exports an image from the daemon and returns a reader for the blob at the given path within
+// the tarball, along with its size.
+// The returned reader must be closed to release the export.
+func (r *Registry) openSavedBlob(ctx context.Context, imgID, blobPath string, digest godigest.Digest) (io.ReadCloser, int64, error) {
+	imgTar, err := r.exportImage(ctx, imgID)
+	if err != nil {
+		return nil, 0, err
+	}
+	imgTarR := tar.NewReader(imgTar)
+	for {
+		h, err := imgTarR.Next()
+		if errors.Is(err, io.EOF) {
+			imgTar.Close()
+			return nil, 0, fmt.Errorf("saved image tarball did not contain expected blob")
+		}
+		if err != nil {
+			imgTar.Close()
+			return nil, 0, fmt.Errorf("reading upstream tarball: %w", err)
+		}
+		if h.Name != blobPath {
+			continue
+		}
+		cache, err := r.blobCache.NewWriter(digest)
+		if err != nil {
+			slog.Warn("failed to cache blob", "digest", digest, "error", err)
+			cache = nil
+		}
+		blob := &savedBlob{reader: imgTarR, closer: imgTar, cache: cache, remaining: h.Size}
+		if cache != nil {
+			blob.reader = io.TeeReader(imgTarR, cache)
+		}
+		return blob, h.Size, nil
+	}
+}
+
+// serveBlob writes a blob to a response, honoring Range and If-Range headers.
+// Blobs that are files on disk can be seeked to the requested range, while others are read and discarded up to
+// the start of it.
+// The headers set by setContentHeaders must already be set.
+func serveBlob(w http.ResponseWriter, rq *http.Request, digest string, blob io.Reader, size int64) error {
+	if seeker, ok := blob.(io.ReadSeeker); ok {
+		// Blobs never change, so there is no meaningful modification time
+		http.ServeContent(w, rq, "", time.Time{}, seeker)
+		return nil
+	}
+
+	w.Header().Set("Accept-Ranges", "bytes")
+	start, end, ok, err := parseRange(rq, digest, size)
+	if err != nil {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+		return err
+	}
+	if !ok {
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", size))
+		_, err = io.Copy(w, blob)
+		return err
+	}
+	_, err = io.CopyN(io.Discard, blob, start)
+	if err != nil {
+		return writeError(w, fmt.Errorf("skipping to start of range: %w", err), codeBlobUnknown)
+	}
+	w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, size))
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", end-start+1))
+	w.WriteHeader(http.StatusPartialContent)
+	_, err = io.CopyN(w, blob, end-start+1)
+	return err
+}
+
+// errRangeNotSatisfiable is returned when a requested range does not overlap a blob
+var errRangeNotSatisfiable = errors.New("requested range not satisfiable")
+
+// parseRange returns the inclusive range of bytes of a blob requested by the Range header, or false if the whole
+// blob should be served, either because no range was requested, If-Range does not match the blob, or multiple
+// ranges were requested, which is not supported.
+func parseRange(rq *http.Request, digest string, size int64) (start, end int64, ok bool, err error) {
+	rangeHeader := rq.Header.Get("Range")
+	if rangeHeader == "" {
+		return 0, 0, false, nil
+	}
+	// Blobs can only be identified by their digest, as there is no meaningful modification time
+	if ifRange := rq.Header.Get("If-Range"); ifRange != "" && ifRange != `"`+digest+`"` {
+		return 0, 0, false, nil
+	}
+	spec, ok := strings.CutPrefix(rangeHeader, "bytes=")
+	if !ok || strings.Contains(spec, ",") {
+		return 0, 0, false, nil
+	}
+	startStr, endStr, ok := strings.Cut(strings.TrimSpace(spec), "-")
+	if !ok {
+		return 0, 0, false, nil
+	}
+	if startStr == "" {
+		// A suffix range of the last N bytes
+		n, parseErr := strconv.ParseInt(endStr, 10, 64)
+		if parseErr != nil || n < 0 {
+			return 0, 0, false, nil
+		}
+		if n == 0 || size == 0 {
+			return 0, 0, false, errRangeNotSatisfiable
+		}
+		return max(size-n, 0), size - 1, true, nil
+	}
+	start, parseErr := strconv.ParseInt(startStr, 10, 64)
+	if parseErr != nil || start < 0 {
+		return 0, 0, false, nil
+	}
+	end = size - 1
+	if endStr != "" {
+		end, parseErr = strconv.ParseInt(endStr, 10, 64)
+		if parseErr != nil || end < start {
+			return 0, 0, false, nil
+		}
+		end = min(end, size-1)
+	}
+	if start >= size {
+		return 0, 0, false, errRangeNotSatisfiable
+	}
+	return start, end, true, nil
+}
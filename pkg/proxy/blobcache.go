@@ -0,0 +1,303 @@
+package proxy
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	godigest "github.com/opencontainers/go-digest"
+)
+
+// blobCache is a content-addressed on-disk store of blobs exported from the daemon, so that they do not have to be
+// exported again for every request.
+// When the total size of the cache exceeds its limit, the least recently used blobs are evicted.
+// All methods are safe to call on a nil *blobCache, which behaves as an always-empty cache.
+type blobCache struct {
+	dir     string
+	maxSize int64
+
+	// lock must be held when using the fields below
+	lock sync.Mutex
+	// entries is a map from digest to the element of lru for that blob
+	entries map[godigest.Digest]*list.Element
+	// lru holds a *blobCacheEntry for each blob, from most to least recently used
+	lru *list.List
+	// size is the total size of all blobs in the cache
+	size int64
+}
+
+type blobCacheEntry struct {
+	digest godigest.Digest
+	size   int64
+}
+
+// newBlobCache creates a blob cache in the given directory, which may contain blobs from a previous run.
+// If maxSize is not positive, the cache is unbounded.
+func newBlobCache(dir string, maxSize int64) *blobCache {
+	c := &blobCache{
+		dir:     dir,
+		maxSize: maxSize,
+		entries: make(map[godigest.Digest]*list.Element),
+		lru:     list.New(),
+	}
+	// Any temporary files are from writes that were interrupted
+	os.RemoveAll(c.tmpDir())
+	c.load()
+	return c
+}
+
+func (c *blobCache) tmpDir() string {
+	return filepath.Join(c.dir, "tmp")
+}
+
+func (c *blobCache) path(dgst godigest.Digest) string {
+	return filepath.Join(c.dir, dgst.Algorithm().String(), dgst.Encoded())
+}
+
+// load adds blobs left over from a previous run to the cache, treating those modified least recently as
+// least recently used.
+func (c *blobCache) load() {
+	type found struct {
+		blobCacheEntry
+		modTime int64
+	}
+	var blobs []found
+	algDirs, err := os.ReadDir(c.dir)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		slog.Warn("failed to read blob cache", "dir", c.dir, "error", err)
+		return
+	}
+	for _, algDir := range algDirs {
+		alg := godigest.Algorithm(algDir.Name())
+		if !algDir.IsDir() || !alg.Available() {
+			continue
+		}
+		files, err := os.ReadDir(filepath.Join(c.dir, algDir.Name()))
+		if err != nil {
+			slog.Warn("failed to read blob cache", "dir", c.dir, "error", err)
+			continue
+		}
+		for _, file := range files {
+			dgst := godigest.NewDigestFromEncoded(alg, file.Name())
+			info, err := file.Info()
+			if err != nil || dgst.Validate() != nil {
+				continue
+			}
+			blobs = append(blobs, found{blobCacheEntry: blobCacheEntry{digest: dgst, size: info.Size()}, modTime: info.ModTime().UnixNano()})
+		}
+	}
+	sort.Slice(blobs, func(i, j int) bool { return blobs[i].modTime > blobs[j].modTime })
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, blob := range blobs {
+		entry := blob.blobCacheEntry
+		c.entries[entry.digest] = c.lru.PushBack(&entry)
+		c.size += entry.size
+	}
+	c.evict()
+	slog.Info("loaded blob cache", "dir", c.dir, "blobs", len(c.entries), "size", c.size)
+}
+
+// Has returns true if a blob is in the cache
+func (c *blobCache) Has(dgst godigest.Digest) bool {
+	_, ok := c.Stat(dgst)
+	return ok
+}
+
+// Stat returns the size of a blob if it is in the cache
+func (c *blobCache) Stat(dgst godigest.Digest) (int64, bool) {
+	if c == nil {
+		return 0, false
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	elem, ok := c.entries[dgst]
+	if !ok {
+		return 0, false
+	}
+	return elem.Value.(*blobCacheEntry).size, true
+}
+
+// Open returns the content of a blob and its size if it is in the cache, and marks it as recently used
+func (c *blobCache) Open(dgst godigest.Digest) (*os.File, int64, bool) {
+	if c == nil {
+		return nil, 0, false
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	elem, ok := c.entries[dgst]
+	if !ok {
+		return nil, 0, false
+	}
+	f, err := os.Open(c.path(dgst))
+	if err != nil {
+		// Removed from under us, forget about it
+		slog.Warn("cached blob is missing", "digest", dgst, "error", err)
+		c.remove(elem)
+		return nil, 0, false
+	}
+	c.lru.MoveToFront(elem)
+	return f, elem.Value.(*blobCacheEntry).size, true
+}
+
+// Put adds a blob to the cache, verifying it against its expected digest
+func (c *blobCache) Put(dgst godigest.Digest, content io.Reader) error {
+	if c == nil || c.Has(dgst) {
+		return nil
+	}
+	w, err := c.NewWriter(dgst)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, content)
+	if err != nil {
+		w.Discard()
+		return fmt.Errorf("caching blob %s: %w", dgst, err)
+	}
+	_, err = w.Commit()
+	return err
+}
+
+// NewWriter returns a writer which adds a blob to the cache when committed.
+// If expected is not empty, the content is verified against it, otherwise, it is stored under its computed digest.
+// Returns nil if c is nil, which is safe to use as a writer that discards its input.
+func (c *blobCache) NewWriter(expected godigest.Digest) (*blobCacheWriter, error) {
+	if c == nil {
+		return nil, nil
+	}
+	err := os.MkdirAll(c.tmpDir(), 0o700)
+	if err != nil {
+		return nil, fmt.Errorf("creating blob cache directory: %w", err)
+	}
+	alg := godigest.Canonical
+	if expected != "" {
+		err = expected.Validate()
+		if err != nil {
+			return nil, fmt.Errorf("caching blob: %w", err)
+		}
+		alg = expected.Algorithm()
+	}
+	f, err := os.CreateTemp(c.tmpDir(), "blob-")
+	if err != nil {
+		return nil, fmt.Errorf("creating blob cache file: %w", err)
+	}
+	return &blobCacheWriter{
+		cache:    c,
+		f:        f,
+		expected: expected,
+		digester: alg.Digester(),
+	}, nil
+}
+
+// blobCacheWriter writes a single blob to a temporary file, which is moved into the cache if it is committed.
+// Failing to write the file does not fail Write, as the blob is being read for some other purpose which should not
+// be interrupted by the cache, such as serving it to a client. The failure is returned by Commit instead.
+type blobCacheWriter struct {
+	cache    *blobCache
+	f        *os.File
+	expected godigest.Digest
+	digester godigest.Digester
+	size     int64
+	// err is the error writing the file failed with, after which the blob is discarded
+	err error
+}
+
+func (w *blobCacheWriter) Write(b []byte) (int, error) {
+	if w == nil || w.err != nil {
+		return len(b), nil
+	}
+	n, err := w.f.Write(b)
+	w.digester.Hash().Write(b[:n])
+	w.size += int64(n)
+	if err != nil {
+		w.err = fmt.Errorf("writing blob cache file: %w", err)
+		w.Discard()
+	}
+	return len(b), nil
+}
+
+// Discard abandons the blob
+func (w *blobCacheWriter) Discard() {
+	if w == nil {
+		return
+	}
+	w.f.Close()
+	os.Remove(w.f.Name())
+}
+
+// Commit verifies the blob and adds it to the cache, returning its digest
+func (w *blobCacheWriter) Commit() (godigest.Digest, error) {
+	if w == nil {
+		return "", nil
+	}
+	if w.err != nil {
+		return "", w.err
+	}
+	dgst := w.digester.Digest()
+	err := w.f.Close()
+	if err != nil {
+		os.Remove(w.f.Name())
+		return "", fmt.Errorf("writing blob cache file: %w", err)
+	}
+	if w.expected != "" && w.expected != dgst {
+		os.Remove(w.f.Name())
+		return "", fmt.Errorf("blob expected to have digest %s actually has digest %s", w.expected, dgst)
+	}
+
+	c := w.cache
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if _, ok := c.entries[dgst]; ok {
+		os.Remove(w.f.Name())
+		return dgst, nil
+	}
+	err = os.MkdirAll(filepath.Dir(c.path(dgst)), 0o700)
+	if err != nil {
+		os.Remove(w.f.Name())
+		return "", fmt.Errorf("creating blob cache directory: %w", err)
+	}
+	err = os.Rename(w.f.Name(), c.path(dgst))
+	if err != nil {
+		os.Remove(w.f.Name())
+		return "", fmt.Errorf("moving blob into cache: %w", err)
+	}
+	c.entries[dgst] = c.lru.PushFront(&blobCacheEntry{digest: dgst, size: w.size})
+	c.size += w.size
+	slog.Info("cached blob", "digest", dgst, "size", w.size)
+	c.evict()
+	return dgst, nil
+}
+
+// evict removes the least recently used blobs until the cache is within its size limit.
+// The most recently used blob is never evicted, even if it alone exceeds the limit.
+// lock must be held.
+func (c *blobCache) evict() {
+	if c.maxSize <= 0 {
+		return
+	}
+	for c.size > c.maxSize && c.lru.Len() > 1 {
+		elem := c.lru.Back()
+		slog.Info("evicting cached blob", "digest", elem.Value.(*blobCacheEntry).digest)
+		c.remove(elem)
+	}
+}
+
+// remove deletes a blob from the cache.
+// Readers which already opened it can continue to read it.
+// lock must be held.
+func (c *blobCache) remove(elem *list.Element) {
+	entry := elem.Value.(*blobCacheEntry)
+	c.lru.Remove(elem)
+	delete(c.entries, entry.digest)
+	c.size -= entry.size
+	err := os.Remove(c.path(entry.digest))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		slog.Warn("failed to remove cached blob", "digest", entry.digest, "error", err)
+	}
+}
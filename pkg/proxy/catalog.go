@@ -0,0 +1,31 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"slices"
+)
+
+// listRepositories returns the names of all repositories in the daemon with an allowed prefix
+func (r *Registry) listRepositories(ctx context.Context) ([]string, error) {
+	imgSums, err := r.Backend.ImageList(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("listing images: %w", err)
+	}
+	repoSet := make(map[string]struct{})
+	var repos []string
+	for _, imgSum := range imgSums {
+		for _, ref := range slices.Concat(imgSum.RepoTags, imgSum.RepoDigests) {
+			repo, ok := normalizeRepoName(ref)
+			if !ok || !r.HasAllowedPrefix(repo) {
+				continue
+			}
+			if _, ok := repoSet[repo]; ok {
+				continue
+			}
+			repoSet[repo] = struct{}{}
+			repos = append(repos, repo)
+		}
+	}
+	return repos, nil
+}
@@ -0,0 +1,347 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	containerd "github.com/containerd/containerd/v2/client"
+	"github.com/containerd/containerd/v2/core/content"
+	ctrdimages "github.com/containerd/containerd/v2/core/images"
+	cerrdefs "github.com/containerd/errdefs"
+	"github.com/distribution/reference"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/errdefs"
+
+	godigest "github.com/opencontainers/go-digest"
+	ociimage "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// containerdDanglingPrefix is the prefix of the names given to images pushed without a tag, so that containerd
+// does not garbage collect them.
+// This is the same convention the Docker daemon uses with the containerd image store.
+const containerdDanglingPrefix = "moby-dangling@"
+
+// containerdListInterval is how long the images in a namespace are listed for before they are listed again, unless
+// their events are being watched
+const containerdListInterval = 5 * time.Second
+
+// ContainerdBackend serves images from a containerd namespace, such as the containerd image store of a Docker
+// daemon, or the node of a KinD cluster.
+// Images are listed from the image service, and blobs are read directly from the content store, so serving a blob
+// never requires exporting the rest of its image.
+// As with the containerd image store of the Docker daemon, images are identified by the digest of their manifest or
+// index, and each of their names is a tag.
+// The images are listed again whenever containerd reports that they have changed while ImageEvents is being
+// watched, or otherwise once the listing is older than containerdListInterval.
+type ContainerdBackend struct {
+	client    ContainerdClient
+	namespace string
+	// images are the images in the namespace as of the last time they were listed
+	images *imageStore
+
+	// lock must be held when using listed and watching
+	lock sync.Mutex
+	// listed is when images were last listed, or zero if they have changed since
+	listed time.Time
+	// watching is the number of ImageEvents streams which are keeping images up to date
+	watching int
+}
+
+var _ WatchingBackend = &ContainerdBackend{}
+var _ BlobBackend = &ContainerdBackend{}
+
+// ContainerdClient is the part of the containerd client used by ContainerdBackend
+type ContainerdClient interface {
+	ImageService() ctrdimages.Store
+	ContentStore() content.Store
+	EventService() containerd.EventService
+	Import(ctx context.Context, reader io.Reader, opts ...containerd.ImportOpt) ([]ctrdimages.Image, error)
+	Close() error
+}
+
+var _ ContainerdClient = &containerd.Client{}
+
+// NewContainerdBackend connects to the containerd socket at address, and returns a backend serving the images in
+// namespace
+func NewContainerdBackend(address, namespace string) (*ContainerdBackend, error) {
+	client, err := containerd.New(address, containerd.WithDefaultNamespace(namespace))
+	if err != nil {
+		return nil, fmt.Errorf("connecting to containerd: %w", err)
+	}
+	return NewContainerdBackendWithClient(client, namespace), nil
+}
+
+// NewContainerdBackendWithClient returns a backend serving the images in namespace with an existing client, whose
+// default namespace must be namespace
+func NewContainerdBackendWithClient(client ContainerdClient, namespace string) *ContainerdBackend {
+	c := &ContainerdBackend{client: client, namespace: namespace}
+	c.images = newImageStore(c)
+	return c
+}
+
+// Close closes the connection to containerd
+func (c *ContainerdBackend) Close() error {
+	return c.client.Close()
+}
+
+// fromContainerdError converts an error from containerd to the equivalent errdefs error
+func fromContainerdError(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case cerrdefs.IsNotFound(err):
+		return errdefs.NotFound(err)
+	case cerrdefs.IsInvalidArgument(err):
+		return errdefs.InvalidParameter(err)
+	case cerrdefs.IsAlreadyExists(err), cerrdefs.IsConflict(err):
+		return errdefs.Conflict(err)
+	case cerrdefs.IsPermissionDenied(err):
+		return errdefs.Forbidden(err)
+	case cerrdefs.IsUnauthorized(err):
+		return errdefs.Unauthorized(err)
+	case cerrdefs.IsNotImplemented(err):
+		return errdefs.NotImplemented(err)
+	case cerrdefs.IsUnavailable(err):
+		return errdefs.Unavailable(err)
+	}
+	return err
+}
+
+// current returns the images in the namespace, listing them again if they may have changed since they were last
+// listed
+func (c *ContainerdBackend) current(ctx context.Context) (*imageStore, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if !c.listed.IsZero() && (c.watching != 0 || time.Since(c.listed) < containerdListInterval) {
+		return c.images, nil
+	}
+	imgs, err := c.client.ImageService().List(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("listing containerd images: %w", fromContainerdError(err))
+	}
+	stored := make([]archiveImage, 0, len(imgs))
+	for _, img := range imgs {
+		stored = append(stored, archiveImage{Descriptor: img.Target, Tags: containerdTags(img.Name)})
+	}
+	c.images.reset(stored)
+	c.listed = time.Now()
+	return c.images, nil
+}
+
+// changed causes the images to be listed again the next time they are used
+func (c *ContainerdBackend) changed() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.listed = time.Time{}
+}
+
+// containerdTags returns the tags given to an image by one of its names.
+// Names which are digest references, such as those of dangling images, are not tags.
+func containerdTags(name string) []string {
+	if strings.HasPrefix(name, containerdDanglingPrefix) {
+		return nil
+	}
+	named, err := reference.ParseNormalizedNamed(name)
+	if err != nil {
+		return nil
+	}
+	if _, ok := named.(reference.Tagged); !ok {
+		return nil
+	}
+	return []string{named.String()}
+}
+
+func (c *ContainerdBackend) openBlob(dgst godigest.Digest) (io.ReadCloser, int64, error) {
+	return c.BlobOpen(context.Background(), dgst)
+}
+
+// BlobOpen reads a blob from the content store
+func (c *ContainerdBackend) BlobOpen(ctx context.Context, dgst godigest.Digest) (io.ReadCloser, int64, error) {
+	ra, err := c.client.ContentStore().ReaderAt(ctx, ociimage.Descriptor{Digest: dgst})
+	if err != nil {
+		return nil, 0, fromContainerdError(err)
+	}
+	return &sectionReadCloser{SectionReader: io.NewSectionReader(ra, 0, ra.Size()), closer: ra}, ra.Size(), nil
+}
+
+func (c *ContainerdBackend) ImageList(ctx context.Context) ([]image.Summary, error) {
+	images, err := c.current(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return images.list(), nil
+}
+
+func (c *ContainerdBackend) ImageInspect(ctx context.Context, ref string) (image.InspectResponse, error) {
+	images, err := c.current(ctx)
+	if err != nil {
+		return image.InspectResponse{}, err
+	}
+	return images.inspect(ref)
+}
+
+func (c *ContainerdBackend) ImageSave(ctx context.Context, imgID string) (io.ReadCloser, error) {
+	images, err := c.current(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return images.save(imgID)
+}
+
+// ImageLoad imports an OCI image layout tarball into the namespace.
+// Images are named by their io.containerd.image.name annotation, normalized to a fully qualified reference as
+// other containerd clients expect, and images without one are named as dangling images.
+func (c *ContainerdBackend) ImageLoad(ctx context.Context, archive io.Reader) error {
+	defer c.changed()
+	imgs, err := c.client.Import(ctx, archive,
+		containerd.WithAllPlatforms(true),
+		containerd.WithSkipMissing(),
+		containerd.WithDigestRef(func(dgst godigest.Digest) string { return containerdDanglingPrefix + dgst.String() }),
+		containerd.WithSkipDigestRef(func(name string) bool { return name != "" }),
+	)
+	if err != nil {
+		return fmt.Errorf("importing image into containerd: %w", fromContainerdError(err))
+	}
+	is := c.client.ImageService()
+	for _, img := range imgs {
+		if strings.HasPrefix(img.Name, containerdDanglingPrefix) {
+			continue
+		}
+		err = c.normalizeName(ctx, img)
+		if err != nil {
+			return err
+		}
+		// The image is no longer dangling once it has a name
+		err = is.Delete(ctx, containerdDanglingPrefix+img.Target.Digest.String())
+		if err != nil && !cerrdefs.IsNotFound(err) {
+			return fmt.Errorf("removing dangling image %s: %w", img.Target.Digest, fromContainerdError(err))
+		}
+	}
+	return nil
+}
+
+// normalizeName renames an image named by a familiar reference to its fully qualified reference
+func (c *ContainerdBackend) normalizeName(ctx context.Context, img ctrdimages.Image) error {
+	named, err := reference.ParseNormalizedNamed(img.Name)
+	if err != nil || named.String() == img.Name {
+		return nil
+	}
+	is := c.client.ImageService()
+	renamed := ctrdimages.Image{Name: named.String(), Target: img.Target, Labels: img.Labels}
+	_, err = is.Update(ctx, renamed, "target")
+	if cerrdefs.IsNotFound(err) {
+		_, err = is.Create(ctx, renamed)
+	}
+	if err != nil {
+		return fmt.Errorf("naming image %s: %w", renamed.Name, fromContainerdError(err))
+	}
+	err = is.Delete(ctx, img.Name)
+	if err != nil && !cerrdefs.IsNotFound(err) {
+		return fmt.Errorf("removing image %s: %w", img.Name, fromContainerdError(err))
+	}
+	return nil
+}
+
+// ImageRemove removes a name of an image, or every name of an image if referred to by ID or digest.
+// containerd garbage collects the content of the image once it has no names left.
+func (c *ContainerdBackend) ImageRemove(ctx context.Context, ref string) error {
+	images, err := c.current(ctx)
+	if err != nil {
+		return err
+	}
+	img, err := images.inspect(ref)
+	if err != nil {
+		return err
+	}
+	defer c.changed()
+	is := c.client.ImageService()
+	var names []string
+	if named, err := reference.ParseNormalizedNamed(ref); err == nil && ref != img.ID {
+		if _, isDigest := named.(reference.Canonical); !isDigest {
+			names = append(names, reference.TagNameOnly(named).String())
+		}
+	}
+	if len(names) == 0 {
+		imgs, err := is.List(ctx, "target.digest=="+img.ID)
+		if err != nil {
+			return fmt.Errorf("listing containerd images: %w", fromContainerdError(err))
+		}
+		for _, ctrdImg := range imgs {
+			names = append(names, ctrdImg.Name)
+		}
+	}
+	for _, name := range names {
+		err := is.Delete(ctx, name)
+		if err != nil && !cerrdefs.IsNotFound(err) {
+			return fmt.Errorf("removing image %s: %w", name, fromContainerdError(err))
+		}
+	}
+	return nil
+}
+
+// ImageEvents reports changes to the images in the namespace by listing them again whenever containerd reports an
+// image event, which also keeps the listing used by the other methods up to date while it is being watched.
+// containerd does not replay events, so since is ignored, and only changes after it is called are reported.
+func (c *ContainerdBackend) ImageEvents(ctx context.Context, _ time.Time) (<-chan events.Message, <-chan error) {
+	msgs := make(chan events.Message)
+	errs := make(chan error, 1)
+	envelopes, envelopeErrs := c.client.EventService().Subscribe(ctx, fmt.Sprintf(`namespace==%q,topic~="^/images/"`, c.namespace))
+	// Changes made before subscribing were not reported, so the listing must start fresh
+	c.lock.Lock()
+	c.watching++
+	c.listed = time.Time{}
+	c.lock.Unlock()
+	stopWatching := func() {
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		c.watching--
+	}
+	images, err := c.current(ctx)
+	if err != nil {
+		stopWatching()
+		errs <- err
+		return msgs, errs
+	}
+	seen := images.list()
+	go func() {
+		defer stopWatching()
+		for {
+			select {
+			case err := <-envelopeErrs:
+				if err == nil {
+					err = errors.New("containerd event stream closed")
+				}
+				errs <- fromContainerdError(err)
+				return
+			case _, ok := <-envelopes:
+				if !ok {
+					errs <- errors.New("containerd event stream closed")
+					return
+				}
+			}
+			c.changed()
+			images, err := c.current(ctx)
+			if err != nil {
+				errs <- err
+				return
+			}
+			latest := images.list()
+			for _, msg := range imageChangeEvents(seen, latest) {
+				select {
+				case msgs <- msg:
+				case <-ctx.Done():
+					errs <- ctx.Err()
+					return
+				}
+			}
+			seen = latest
+		}
+	}()
+	return msgs, errs
+}
@@ -0,0 +1,322 @@
+package proxy_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	containerd "github.com/containerd/containerd/v2/client"
+	"github.com/containerd/containerd/v2/core/content"
+	ctrdevents "github.com/containerd/containerd/v2/core/events"
+	ctrdimages "github.com/containerd/containerd/v2/core/images"
+	"github.com/containerd/containerd/v2/core/images/archive"
+	"github.com/containerd/containerd/v2/plugins/content/local"
+	cerrdefs "github.com/containerd/errdefs"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/errdefs"
+	ociimage "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/meln5674/oci-reg-docker/pkg/proxy"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// fakeContainerd is a containerd client with a content store on disk and an image service in memory.
+// Images are imported as containerd does with the options the backend uses, and changes to them are published to
+// subscribers of the event service.
+type fakeContainerd struct {
+	content content.Store
+
+	// lock must be held when using images and subscribers
+	lock        sync.Mutex
+	images      map[string]ctrdimages.Image
+	subscribers []chan *ctrdevents.Envelope
+	// lists is the number of times the images have been listed
+	lists atomic.Int32
+}
+
+var _ proxy.ContainerdClient = &fakeContainerd{}
+
+func newFakeContainerd() *fakeContainerd {
+	store, err := local.NewStore(GinkgoT().TempDir())
+	Expect(err).ToNot(HaveOccurred())
+	return &fakeContainerd{content: store, images: make(map[string]ctrdimages.Image)}
+}
+
+func (f *fakeContainerd) ImageService() ctrdimages.Store { return fakeContainerdImages{f} }
+
+func (f *fakeContainerd) ContentStore() content.Store { return f.content }
+
+func (f *fakeContainerd) EventService() containerd.EventService { return fakeContainerdEvents{fake: f} }
+
+func (f *fakeContainerd) Close() error { return nil }
+
+func (f *fakeContainerd) Import(ctx context.Context, reader io.Reader, _ ...containerd.ImportOpt) ([]ctrdimages.Image, error) {
+	indexDesc, err := archive.ImportIndex(ctx, f.content, reader)
+	if err != nil {
+		return nil, err
+	}
+	indexJSON, err := content.ReadBlob(ctx, f.content, indexDesc)
+	if err != nil {
+		return nil, err
+	}
+	var index ociimage.Index
+	err = json.Unmarshal(indexJSON, &index)
+	if err != nil {
+		return nil, err
+	}
+	imgs := make([]ctrdimages.Image, 0, len(index.Manifests))
+	for _, desc := range index.Manifests {
+		// The backend asks for images without a name to be named as dangling images
+		name := desc.Annotations[ctrdimages.AnnotationImageName]
+		if name == "" {
+			name = "moby-dangling@" + desc.Digest.String()
+		}
+		img := ctrdimages.Image{Name: name, Target: desc}
+		f.put(img)
+		imgs = append(imgs, img)
+	}
+	return imgs, nil
+}
+
+// put creates or replaces an image, as with ctr images tag --force
+func (f *fakeContainerd) put(img ctrdimages.Image) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.images[img.Name] = img
+	f.publish("/images/update")
+}
+
+// names returns the names of every image
+func (f *fakeContainerd) names() []string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	names := make([]string, 0, len(f.images))
+	for name := range f.images {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// subscribed returns the number of subscribers to events
+func (f *fakeContainerd) subscribed() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return len(f.subscribers)
+}
+
+// publish sends an image event to every subscriber.
+// lock must be held.
+func (f *fakeContainerd) publish(topic string) {
+	for _, subscriber := range f.subscribers {
+		select {
+		case subscriber <- &ctrdevents.Envelope{Timestamp: time.Now(), Namespace: "default", Topic: topic}:
+		default:
+		}
+	}
+}
+
+// fakeContainerdImages is the image service of a fakeContainerd
+type fakeContainerdImages struct {
+	fake *fakeContainerd
+}
+
+func (i fakeContainerdImages) Get(_ context.Context, name string) (ctrdimages.Image, error) {
+	i.fake.lock.Lock()
+	defer i.fake.lock.Unlock()
+	img, ok := i.fake.images[name]
+	if !ok {
+		return ctrdimages.Image{}, fmt.Errorf("image %q: %w", name, cerrdefs.ErrNotFound)
+	}
+	return img, nil
+}
+
+// List supports the target.digest filter used by the backend, and no others
+func (i fakeContainerdImages) List(_ context.Context, filters ...string) ([]ctrdimages.Image, error) {
+	i.fake.lists.Add(1)
+	i.fake.lock.Lock()
+	defer i.fake.lock.Unlock()
+	var imgs []ctrdimages.Image
+	for _, img := range i.fake.images {
+		matches := true
+		for _, filter := range filters {
+			digest, ok := strings.CutPrefix(filter, "target.digest==")
+			if !ok {
+				return nil, fmt.Errorf("filter %q: %w", filter, cerrdefs.ErrNotImplemented)
+			}
+			matches = matches && img.Target.Digest.String() == digest
+		}
+		if matches {
+			imgs = append(imgs, img)
+		}
+	}
+	return imgs, nil
+}
+
+func (i fakeContainerdImages) Create(_ context.Context, img ctrdimages.Image) (ctrdimages.Image, error) {
+	i.fake.lock.Lock()
+	defer i.fake.lock.Unlock()
+	if _, ok := i.fake.images[img.Name]; ok {
+		return ctrdimages.Image{}, fmt.Errorf("image %q: %w", img.Name, cerrdefs.ErrAlreadyExists)
+	}
+	i.fake.images[img.Name] = img
+	i.fake.publish("/images/create")
+	return img, nil
+}
+
+// Update replaces the whole image, as the backend only updates the target
+func (i fakeContainerdImages) Update(_ context.Context, img ctrdimages.Image, _ ...string) (ctrdimages.Image, error) {
+	i.fake.lock.Lock()
+	defer i.fake.lock.Unlock()
+	if _, ok := i.fake.images[img.Name]; !ok {
+		return ctrdimages.Image{}, fmt.Errorf("image %q: %w", img.Name, cerrdefs.ErrNotFound)
+	}
+	i.fake.images[img.Name] = img
+	i.fake.publish("/images/update")
+	return img, nil
+}
+
+func (i fakeContainerdImages) Delete(_ context.Context, name string, _ ...ctrdimages.DeleteOpt) error {
+	i.fake.lock.Lock()
+	defer i.fake.lock.Unlock()
+	if _, ok := i.fake.images[name]; !ok {
+		return fmt.Errorf("image %q: %w", name, cerrdefs.ErrNotFound)
+	}
+	delete(i.fake.images, name)
+	i.fake.publish("/images/delete")
+	return nil
+}
+
+// fakeContainerdEvents is the event service of a fakeContainerd, which only supports subscribing
+type fakeContainerdEvents struct {
+	containerd.EventService
+	fake *fakeContainerd
+}
+
+func (e fakeContainerdEvents) Subscribe(ctx context.Context, _ ...string) (<-chan *ctrdevents.Envelope, <-chan error) {
+	envelopes := make(chan *ctrdevents.Envelope, 16)
+	errs := make(chan error, 1)
+	e.fake.lock.Lock()
+	defer e.fake.lock.Unlock()
+	e.fake.subscribers = append(e.fake.subscribers, envelopes)
+	go func() {
+		<-ctx.Done()
+		errs <- ctx.Err()
+	}()
+	return envelopes, errs
+}
+
+var _ = Describe("ContainerdBackend", func() {
+	itServesPushedImages(func() proxy.Backend {
+		return proxy.NewContainerdBackendWithClient(newFakeContainerd(), "default")
+	})
+
+	When("images are pushed to it", func() {
+		var fake *fakeContainerd
+		var backend *proxy.ContainerdBackend
+		var client registryClient
+		var img testImage
+
+		BeforeEach(func(ctx context.Context) {
+			fake = newFakeContainerd()
+			backend = proxy.NewContainerdBackendWithClient(fake, "default")
+			client = startRegistry(ctx, backend)
+			img = newTestImage("containerd layer")
+		})
+
+		It("should name pushed images by their fully qualified reference", func(ctx context.Context) {
+			client.push(ctx, "test/app", "v1", img)
+			Expect(fake.names()).To(Equal([]string{"docker.io/test/app:v1"}))
+
+			resp := client.do(ctx, http.MethodGet, "/v2/test/app/manifests/v1", nil)
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			Expect(readBody(resp)).To(Equal(img.Manifest))
+		})
+
+		It("should name images pushed by digest as dangling until they are tagged", func(ctx context.Context) {
+			client.push(ctx, "test/app", img.Digest.String(), img)
+			Expect(fake.names()).To(Equal([]string{"moby-dangling@" + img.Digest.String()}))
+
+			client.push(ctx, "test/app", "v1", img)
+			Expect(fake.names()).To(Equal([]string{"docker.io/test/app:v1"}))
+		})
+
+		It("should remove one name of an image by tag, and every name by ID", func(ctx context.Context) {
+			client.push(ctx, "test/app", "v1", img)
+			client.push(ctx, "test/app", "v2", img)
+
+			Expect(backend.ImageRemove(ctx, "test/app:v1")).To(Succeed())
+			Expect(fake.names()).To(Equal([]string{"docker.io/test/app:v2"}))
+			_, err := backend.ImageInspect(ctx, "test/app:v1")
+			Expect(errdefs.IsNotFound(err)).To(BeTrue())
+
+			client.push(ctx, "test/app", "v1", img)
+			Expect(backend.ImageRemove(ctx, img.Digest.String())).To(Succeed())
+			Expect(fake.names()).To(BeEmpty())
+			Expect(backend.ImageList(ctx)).To(BeEmpty())
+		})
+
+		It("should reuse its listing of images until they change", func(ctx context.Context) {
+			client.push(ctx, "test/app", "v1", img)
+			_, err := backend.ImageList(ctx)
+			Expect(err).ToNot(HaveOccurred())
+			lists := fake.lists.Load()
+			for range 3 {
+				_, err := backend.ImageInspect(ctx, "test/app:v1")
+				Expect(err).ToNot(HaveOccurred())
+			}
+			Expect(fake.lists.Load()).To(Equal(lists))
+		})
+
+		It("should report images changed by other clients", func(ctx context.Context) {
+			client.push(ctx, "test/app", "v1", img)
+			watchCtx, cancel := context.WithCancel(ctx)
+			defer cancel()
+			msgs, errs := backend.ImageEvents(watchCtx, time.Time{})
+
+			tagged, err := fake.ImageService().Get(ctx, "docker.io/test/app:v1")
+			Expect(err).ToNot(HaveOccurred())
+			fake.put(ctrdimages.Image{Name: "docker.io/test/app:v2", Target: tagged.Target})
+
+			var msg events.Message
+			Eventually(msgs).Should(Receive(&msg))
+			Expect(msg.Action).To(Equal(events.ActionTag))
+			Expect(msg.Actor.ID).To(Equal(img.Digest.String()))
+			Consistently(errs).ShouldNot(Receive())
+
+			inspect, err := backend.ImageInspect(ctx, "test/app:v2")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(inspect.ID).To(Equal(img.Digest.String()))
+		})
+
+		It("should serve compressed layers of images added by other clients without their manifest", func(ctx context.Context) {
+			reg := proxy.New(proxy.Config{Backend: backend})
+			Expect(reg.BuildIndex(ctx)).To(Succeed())
+			watchCtx, cancel := context.WithCancel(ctx)
+			DeferCleanup(cancel)
+			subscribers := fake.subscribed()
+			go reg.WatchEvents(watchCtx)
+			Eventually(fake.subscribed).Should(BeNumerically(">", subscribers))
+			srv := httptest.NewServer(reg.BuildHandler())
+			DeferCleanup(srv.Close)
+			watching := registryClient{srv: srv}
+
+			compressed := newCompressedTestImage("compressed containerd layer")
+			client.push(ctx, "test/app", "v1", compressed)
+
+			Eventually(func() int {
+				return watching.do(ctx, http.MethodGet, "/v2/test/app/blobs/"+compressed.LayerDigest.String(), nil).StatusCode
+			}).Should(Equal(http.StatusOK))
+		})
+	})
+})
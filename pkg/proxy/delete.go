@@ -0,0 +1,93 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/docker/docker/errdefs"
+
+	godigest "github.com/opencontainers/go-digest"
+)
+
+// errNoTagsInRepo is returned when deleting a manifest by digest whose image has no tags in the requested repository
+var errNoTagsInRepo = &registryError{Status: http.StatusNotFound, Code: codeManifestUnknown, Message: "image has no tags in this repository"}
+
+// deleteManifest untags an image in the daemon.
+// If reference is a tag, only that tag is removed. If it is a digest, every tag in the repository pointing
+// at that image is removed.
+// The daemon removes the image itself once its last tag is removed, unless it is in use.
+func (r *Registry) deleteManifest(ctx context.Context, name, reference string) error {
+	if _, err := godigest.Parse(reference); err == nil {
+		return r.deleteManifestByDigest(ctx, name, reference)
+	}
+
+	imgRef := name + ":" + reference
+	img, err := r.Backend.ImageInspect(ctx, imgRef)
+	if err != nil {
+		return err
+	}
+	return r.removeTags(ctx, img.ID, []string{imgRef})
+}
+
+// deleteManifestByDigest removes every tag in the given repository of the image with a manifest with the given
+// digest.
+// The daemon can only find images by the digests they were pulled by, so the digest is resolved the same way as
+// when fetching the manifest, such as for images pushed through the registry.
+func (r *Registry) deleteManifestByDigest(ctx context.Context, name, digest string) error {
+	imgID, err := r.findImageIDByDigest(ctx, name, digest)
+	if err != nil {
+		return err
+	}
+	// The image may have been tagged or untagged since it was cached
+	img, err := r.Backend.ImageInspect(ctx, imgID)
+	if err != nil {
+		return err
+	}
+	tags := repoTagsIn(&img, name)
+	if len(tags) == 0 {
+		return errNoTagsInRepo
+	}
+	return r.removeTags(ctx, img.ID, tags)
+}
+
+// removeTags removes the given tags of an image from the daemon, then refreshes the image
+func (r *Registry) removeTags(ctx context.Context, imgID string, tags []string) error {
+	for _, tag := range tags {
+		err := r.Backend.ImageRemove(ctx, tag)
+		if err != nil {
+			return fmt.Errorf("removing tag %s: %w", tag, err)
+		}
+		slog.Info("removed tag", "tag", tag, "imageID", imgID)
+	}
+
+	return r.refreshImage(ctx, imgID)
+}
+
+// refreshImage re-inspects an image after it has changed in the daemon, dropping it from the
+// index and cache if it no longer exists, or replacing its metadata if it does.
+func (r *Registry) refreshImage(ctx context.Context, imgID string) error {
+	img, err := r.Backend.ImageInspect(ctx, imgID)
+	if err != nil && !errdefs.IsNotFound(err) {
+		return fmt.Errorf("inspecting image %s: %w", imgID, err)
+	}
+
+	r.cacheLock.Lock()
+	defer r.cacheLock.Unlock()
+	r.indexLock.Lock()
+	defer r.indexLock.Unlock()
+	if err != nil {
+		r.forgetImage(imgID)
+		return nil
+	}
+	manifest, ok := r.manifestCache[imgID]
+	r.forgetImage(imgID)
+	if !ok {
+		r.addImageToIndex(&img, nil)
+		return nil
+	}
+	r.addManifestToCache(&img, manifest)
+	r.addImageToIndex(&img, &manifest)
+	return nil
+}
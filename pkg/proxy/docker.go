@@ -0,0 +1,111 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/image"
+	docker "github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/jsonmessage"
+)
+
+// watchedImageActions are the image events which change what the index and cache should contain
+var watchedImageActions = []events.Action{
+	events.ActionPull,
+	events.ActionTag,
+	events.ActionUnTag,
+	events.ActionLoad,
+	events.ActionImport,
+	events.ActionDelete,
+}
+
+// DockerBackend serves images from a Docker daemon, or any daemon implementing the Docker Engine API
+type DockerBackend struct {
+	// Client is the client connected to the docker daemon
+	Client *docker.Client
+}
+
+var _ WatchingBackend = &DockerBackend{}
+var _ PullingBackend = &DockerBackend{}
+
+func (d *DockerBackend) ImageList(ctx context.Context) ([]image.Summary, error) {
+	return d.Client.ImageList(ctx, image.ListOptions{})
+}
+
+func (d *DockerBackend) ImageInspect(ctx context.Context, ref string) (image.InspectResponse, error) {
+	return d.Client.ImageInspect(ctx, ref)
+}
+
+func (d *DockerBackend) ImageSave(ctx context.Context, imgID string) (io.ReadCloser, error) {
+	return d.Client.ImageSave(ctx, []string{imgID})
+}
+
+func (d *DockerBackend) ImageLoad(ctx context.Context, archive io.Reader) error {
+	resp, err := d.Client.ImageLoad(ctx, archive, docker.ImageLoadWithQuiet(true))
+	if err != nil {
+		return fmt.Errorf("loading image into daemon: %w", err)
+	}
+	defer resp.Body.Close()
+	if !resp.JSON {
+		_, err = io.Copy(io.Discard, resp.Body)
+		return err
+	}
+	err = drainJSONMessages(resp.Body)
+	if err != nil {
+		return fmt.Errorf("loading image into daemon: %w", err)
+	}
+	return nil
+}
+
+func (d *DockerBackend) ImageRemove(ctx context.Context, ref string) error {
+	// Without force, this only untags the image unless it was the last tag
+	_, err := d.Client.ImageRemove(ctx, ref, image.RemoveOptions{})
+	return err
+}
+
+func (d *DockerBackend) ImagePull(ctx context.Context, ref string) error {
+	resp, err := d.Client.ImagePull(ctx, ref, image.PullOptions{})
+	if err != nil {
+		return err
+	}
+	defer resp.Close()
+	return drainJSONMessages(resp)
+}
+
+func (d *DockerBackend) ImageEvents(ctx context.Context, since time.Time) (<-chan events.Message, <-chan error) {
+	args := filters.NewArgs(filters.Arg("type", string(events.ImageEventType)))
+	for _, action := range watchedImageActions {
+		args.Add("event", string(action))
+	}
+	opts := events.ListOptions{Filters: args}
+	if !since.IsZero() {
+		// The API expects seconds with optional fractional nanoseconds
+		opts.Since = fmt.Sprintf("%d.%09d", since.Unix(), since.Nanosecond())
+	}
+	return d.Client.Events(ctx, opts)
+}
+
+// drainJSONMessages reads a stream of progress messages from the daemon until it ends, returning the first
+// error reported in it
+func drainJSONMessages(stream io.Reader) error {
+	dec := json.NewDecoder(stream)
+	for {
+		var msg jsonmessage.JSONMessage
+		err := dec.Decode(&msg)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("reading daemon response: %w", err)
+		}
+		if msg.Error != nil {
+			return msg.Error
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package proxy_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+
+	"github.com/docker/docker/api/types/image"
+	docker "github.com/docker/docker/client"
+	"github.com/docker/docker/errdefs"
+	"github.com/meln5674/oci-reg-docker/pkg/proxy"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// dockerAPIVersionPrefix matches the API version the docker client prefixes each endpoint with
+var dockerAPIVersionPrefix = regexp.MustCompile(`^/v[0-9.]+`)
+
+// fakeDocker serves the Docker Engine API endpoints used by the docker backend from another backend
+func fakeDocker(backend proxy.Backend) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer GinkgoRecover()
+		endpoint := dockerAPIVersionPrefix.ReplaceAllString(r.URL.Path, "")
+		writeErr := func(err error) {
+			status := http.StatusInternalServerError
+			if errdefs.IsNotFound(err) {
+				status = http.StatusNotFound
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(status)
+			Expect(json.NewEncoder(w).Encode(map[string]string{"message": err.Error()})).To(Succeed())
+		}
+		switch {
+		case r.Method == http.MethodGet && endpoint == "/images/json":
+			imgSums, err := backend.ImageList(r.Context())
+			if err != nil {
+				writeErr(err)
+				return
+			}
+			Expect(json.NewEncoder(w).Encode(imgSums)).To(Succeed())
+		case r.Method == http.MethodGet && endpoint == "/images/get":
+			archive, err := backend.ImageSave(r.Context(), r.URL.Query().Get("names"))
+			if err != nil {
+				writeErr(err)
+				return
+			}
+			defer archive.Close()
+			_, err = io.Copy(w, archive)
+			Expect(err).ToNot(HaveOccurred())
+		case r.Method == http.MethodPost && endpoint == "/images/load":
+			err := backend.ImageLoad(r.Context(), r.Body)
+			if err != nil {
+				writeErr(err)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			Expect(json.NewEncoder(w).Encode(map[string]string{"stream": "Loaded image\n"})).To(Succeed())
+		case r.Method == http.MethodGet && strings.HasPrefix(endpoint, "/images/") && strings.HasSuffix(endpoint, "/json"):
+			img, err := backend.ImageInspect(r.Context(), strings.TrimSuffix(strings.TrimPrefix(endpoint, "/images/"), "/json"))
+			if err != nil {
+				writeErr(err)
+				return
+			}
+			Expect(json.NewEncoder(w).Encode(img)).To(Succeed())
+		case r.Method == http.MethodDelete && strings.HasPrefix(endpoint, "/images/"):
+			ref := strings.TrimPrefix(endpoint, "/images/")
+			err := backend.ImageRemove(r.Context(), ref)
+			if err != nil {
+				writeErr(err)
+				return
+			}
+			Expect(json.NewEncoder(w).Encode([]image.DeleteResponse{{Untagged: ref}})).To(Succeed())
+		default:
+			http.NotFound(w, r)
+		}
+	})
+}
+
+var _ = Describe("DockerBackend", func() {
+	var backend *proxy.DockerBackend
+
+	BeforeEach(func() {
+		// A daemon using the classic image store cannot find pushed images by the digest of their manifest
+		srv := httptest.NewServer(fakeDocker(classicStoreBackend{exportOnlyBackend{proxy.NewMemoryBackend()}}))
+		DeferCleanup(srv.Close)
+		client, err := docker.NewClientWithOpts(docker.WithHost("tcp://" + srv.Listener.Addr().String()))
+		Expect(err).ToNot(HaveOccurred())
+		DeferCleanup(client.Close)
+		backend = &proxy.DockerBackend{Client: client}
+	})
+
+	itServesPushedImages(func() proxy.Backend {
+		return backend
+	})
+
+	It("should delete a pushed manifest by the digest returned by the push", func(ctx context.Context) {
+		client := startRegistry(ctx, backend)
+		img := newTestImage("deleted layer")
+		client.push(ctx, "test/app", "v1", img)
+
+		resp := client.do(ctx, http.MethodDelete, "/v2/test/app/manifests/"+img.Digest.String(), nil)
+		Expect(resp.StatusCode).To(Equal(http.StatusAccepted), string(readBody(resp)))
+
+		resp = client.do(ctx, http.MethodGet, "/v2/test/app/manifests/v1", nil)
+		expectErrorCode(resp, http.StatusNotFound, "MANIFEST_UNKNOWN")
+	})
+
+	It("should delete a pushed manifest by digest after a restart", func(ctx context.Context) {
+		img := newTestImage("restarted deleted layer")
+		startRegistry(ctx, backend).push(ctx, "test/app", "v1", img)
+
+		client := startRegistry(ctx, backend)
+		resp := client.do(ctx, http.MethodDelete, "/v2/test/app/manifests/"+img.Digest.String(), nil)
+		Expect(resp.StatusCode).To(Equal(http.StatusAccepted), string(readBody(resp)))
+
+		resp = client.do(ctx, http.MethodGet, "/v2/test/app/manifests/v1", nil)
+		expectErrorCode(resp, http.StatusNotFound, "MANIFEST_UNKNOWN")
+	})
+})
@@ -1,19 +1,22 @@
 package proxy
 
 import (
-	"archive/tar"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"os"
 	"strings"
 
-	"github.com/docker/docker/api/types/filters"
 	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/errdefs"
 
 	ocidist "github.com/opencontainers/distribution-spec/specs-go/v1"
+	godigest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go"
+	ociimage "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
 func (r *Registry) end_1(_ context.Context, w http.ResponseWriter, rq *http.Request, pathVars map[string]string, formErr error) error {
@@ -25,189 +28,478 @@ func (r *Registry) end_2(ctx context.Context, w http.ResponseWriter, rq *http.Re
 	name := pathVars["name"]
 	digest := pathVars["digest"]
 
-	if !r.HasAllowedPrefix(name) {
-		w.WriteHeader(http.StatusNotFound)
-		return fmt.Errorf("does not have allowed prefix")
+	if err := r.checkName(name); err != nil {
+		return writeError(w, err, codeNameUnknown)
 	}
 
-	r.indexLock.RLock()
-	defer r.indexLock.RUnlock()
-	imgs, ok := r.blobIndex[digest]
-	if !ok {
-		w.WriteHeader(http.StatusNotFound)
-		return fmt.Errorf("digest not in blob index")
+	dgst, err := godigest.Parse(digest)
+	if err != nil {
+		return writeError(w, fmt.Errorf("%w: %w", errDigestInvalid, err), codeDigestInvalid)
 	}
 
-	var imgID string
-imgs:
-	for id, img := range imgs {
-		for _, tag := range img.RepoTags {
-			switch strings.Count(tag, "/") {
-			case 0:
-				tag = "docker.io/library/" + tag
-			case 1:
-				tag = "docker.io/" + tag
-			}
-			if strings.HasPrefix(tag, name+":") {
-				imgID = id
-				break imgs
-			}
-		}
+	// Staged blobs are kept after the images they were pushed for are loaded, so they are only served until an
+	// image containing them is indexed, after which blobs are only served in the repositories of their images
+	var stagedSize int64
+	img, err := r.findImageForBlob(name, digest)
+	staged := false
+	if errors.Is(err, errBlobNotIndexed) {
+		stagedSize, staged = r.statStagedBlob(dgst)
 	}
-	if imgID == "" {
-		w.WriteHeader(http.StatusNotFound)
-		return fmt.Errorf("digest was not indexed as belonging to this repo")
+	if err != nil && !staged {
+		return writeError(w, err, codeBlobUnknown)
 	}
 
-	imgTar, err := r.Docker.ImageSave(ctx, []string{imgID})
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(err.Error()))
-		return err
+	setContentHeaders(w, dgst, "application/octet-stream")
+	if notModified(w, rq, dgst) {
+		return nil
 	}
-	defer imgTar.Close()
-	imgTarR := tar.NewReader(imgTar)
-	for {
-		h, err := imgTarR.Next()
-		if errors.Is(err, io.EOF) {
-			w.WriteHeader(http.StatusInternalServerError)
-			err := fmt.Errorf("saved image tarball did not contain expected blob")
-			w.Write([]byte(err.Error()))
-			return err
+
+	if rq.Method == http.MethodHead {
+		// Clients check for blobs they already have with HEAD, so the image is never exported to answer it, and the
+		// size is left out if it cannot be found otherwise
+		size, sizeKnown := stagedSize, staged
+		if !staged {
+			size, sizeKnown, err = r.blobSize(ctx, img, dgst)
+			if err != nil {
+				return writeError(w, err, codeBlobUnknown)
+			}
 		}
-		if h.Name != "blobs/"+strings.ReplaceAll(digest, ":", "/") {
-			continue
+		w.Header().Set("Accept-Ranges", "bytes")
+		if sizeKnown {
+			w.Header().Set("Content-Length", fmt.Sprintf("%d", size))
 		}
-		w.Header().Add("Content-Length", fmt.Sprintf("%d", h.Size))
-		_, err = io.Copy(w, imgTarR)
+		w.WriteHeader(http.StatusOK)
+		return nil
+	}
+
+	if staged {
+		f, err := os.Open(r.stagedBlobPath(dgst))
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte(err.Error()))
-			return err
+			return writeError(w, err, codeBlobUnknown)
 		}
-		return nil
+		defer f.Close()
+		return serveBlob(w, rq, digest, f, stagedSize)
+	}
+
+	blob, size, err := r.openImageBlob(ctx, img, digest)
+	if err != nil {
+		return writeError(w, err, codeBlobUnknown)
 	}
+	defer blob.Close()
+	return serveBlob(w, rq, digest, blob, size)
 }
 
 func (r *Registry) end_3(ctx context.Context, w http.ResponseWriter, rq *http.Request, pathVars map[string]string, formErr error) error {
 	name := pathVars["name"]
 	reference := pathVars["reference"]
 
-	if !r.HasAllowedPrefix(name) {
-		w.WriteHeader(http.StatusNotFound)
-		return fmt.Errorf("does not have allowed prefix")
+	if err := r.checkName(name); err != nil {
+		return writeError(w, err, codeNameUnknown)
 	}
 
 	var imgID string
 	if strings.HasPrefix(reference, "sha256:") {
+		// Per-platform manifests of an index are not images in their own right, so the daemon cannot
+		// find them, but they may have been cached when the index was fetched
+		if manifest, ok := r.getManifestByDigest(name, reference); ok {
+			return writeManifest(w, rq, manifest)
+		}
 		imgID = name + "@" + reference
 	} else {
 		imgID = name + ":" + reference
 	}
 
-	img, err := r.Docker.ImageInspect(ctx, imgID)
+	img, err := r.Backend.ImageInspect(ctx, imgID)
+	if err != nil && errdefs.IsNotFound(err) && strings.HasPrefix(reference, "sha256:") {
+		// The daemon only resolves digest references using the repository name exactly as it recorded it
+		var found *image.InspectResponse
+		found, err = r.findImageByRepoDigest(ctx, name, reference)
+		if found != nil {
+			img = *found
+		}
+	}
+	if err != nil && errdefs.IsNotFound(err) && strings.HasPrefix(reference, "sha256:") {
+		manifest, ok, findErr := r.findManifestByDigest(ctx, name, reference)
+		if findErr != nil {
+			return writeError(w, findErr, codeManifestUnknown)
+		}
+		if ok {
+			return writeManifest(w, rq, manifest)
+		}
+	}
+	if err != nil && r.PullThrough && errdefs.IsNotFound(err) {
+		err = r.pullImage(ctx, imgID)
+		if err == nil {
+			img, err = r.Backend.ImageInspect(ctx, imgID)
+		}
+	}
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(err.Error()))
-		return err
+		return writeError(w, err, codeManifestUnknown)
 	}
 
 	manifest, err := r.getAndCacheManifest(ctx, &img)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(err.Error()))
-		return err
+		return writeError(w, err, codeManifestUnknown)
 	}
 
-	w.Header().Add("Content-Length", fmt.Sprintf("%d", len(manifest.JSON)))
-	w.Header().Add("Content-Type", manifest.Manifest.MediaType)
-	_, err = w.Write(manifest.JSON)
+	return writeManifest(w, rq, manifest)
+}
+
+func writeManifest(w http.ResponseWriter, rq *http.Request, manifest cachedManifest) error {
+	setContentHeaders(w, manifest.Digest, manifest.MediaType)
+	if notModified(w, rq, manifest.Digest) {
+		return nil
+	}
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", len(manifest.JSON)))
+	if rq.Method == http.MethodHead {
+		w.WriteHeader(http.StatusOK)
+		return nil
+	}
+	_, err := w.Write(manifest.JSON)
 	return err
 }
 
+// setContentHeaders sets the headers identifying the content of a blob or manifest response.
+// Content is immutable and addressed by its digest, so the digest also serves as its entity tag.
+func setContentHeaders(w http.ResponseWriter, dgst godigest.Digest, mediaType string) {
+	w.Header().Set("Docker-Content-Digest", dgst.String())
+	w.Header().Set("ETag", `"`+dgst.String()+`"`)
+	w.Header().Set("Content-Type", mediaType)
+}
+
+// notModified writes a 304 response and returns true if the If-None-Match header of a request matches the
+// digest of the content
+func notModified(w http.ResponseWriter, rq *http.Request, dgst godigest.Digest) bool {
+	ifNoneMatch := rq.Header.Get("If-None-Match")
+	if ifNoneMatch == "" {
+		return false
+	}
+	for _, etag := range strings.Split(ifNoneMatch, ",") {
+		etag = strings.TrimPrefix(strings.TrimSpace(etag), "W/")
+		if etag == "*" || etag == `"`+dgst.String()+`"` {
+			w.WriteHeader(http.StatusNotModified)
+			return true
+		}
+	}
+	return false
+}
+
 func (r *Registry) end_4a_4b_11(_ context.Context, w http.ResponseWriter, rq *http.Request, pathVars map[string]string, formErr error) error {
-	w.WriteHeader(http.StatusForbidden)
+	name := pathVars["name"]
+
+	if !r.PushEnabled() {
+		return writeError(w, errPushDisabled, codeBlobUploadUnknown)
+	}
+
+	if err := r.checkName(name); err != nil {
+		return writeError(w, err, codeNameUnknown)
+	}
+
+	q := rq.URL.Query()
+
+	if mount := q.Get("mount"); mount != "" {
+		// Staged blobs are not associated with a repository, so any blob that has already been
+		// uploaded can be mounted. Otherwise, fall back to starting a normal upload session, as
+		// the spec allows.
+		dgst, err := godigest.Parse(mount)
+		if err == nil {
+			if _, ok := r.statStagedBlob(dgst); ok {
+				w.Header().Add("Location", "/v2/"+name+"/blobs/"+dgst.String())
+				w.Header().Add("Docker-Content-Digest", dgst.String())
+				w.WriteHeader(http.StatusCreated)
+				return nil
+			}
+		}
+	}
+
+	if digestStr := q.Get("digest"); digestStr != "" {
+		dgst, err := godigest.Parse(digestStr)
+		if err != nil {
+			return writeError(w, fmt.Errorf("%w: %w", errDigestInvalid, err), codeBlobUploadUnknown)
+		}
+		err = r.stageBlob(rq.Body, dgst)
+		if err != nil {
+			return writeError(w, err, codeBlobUploadUnknown)
+		}
+		w.Header().Add("Location", "/v2/"+name+"/blobs/"+dgst.String())
+		w.Header().Add("Docker-Content-Digest", dgst.String())
+		w.WriteHeader(http.StatusCreated)
+		return nil
+	}
+
+	upload, err := r.startUpload(name)
+	if err != nil {
+		return writeError(w, err, codeBlobUploadUnknown)
+	}
+	w.Header().Add("Location", upload.Location())
+	w.Header().Add("Range", upload.Range())
+	w.Header().Add("Docker-Upload-UUID", upload.ID)
+	w.WriteHeader(http.StatusAccepted)
 	return nil
 }
+
 func (r *Registry) end_5(_ context.Context, w http.ResponseWriter, rq *http.Request, pathVars map[string]string, formErr error) error {
-	w.WriteHeader(http.StatusForbidden)
+	name := pathVars["name"]
+	reference := pathVars["reference"]
+
+	if !r.PushEnabled() {
+		return writeError(w, errPushDisabled, codeBlobUploadUnknown)
+	}
+
+	upload, ok := r.lockUpload(name, reference)
+	if !ok {
+		return writeError(w, errUploadUnknown, codeBlobUploadUnknown)
+	}
+	defer upload.lock.Unlock()
+
+	if contentRange := rq.Header.Get("Content-Range"); contentRange != "" {
+		start, _, err := parseContentRange(contentRange)
+		if err != nil {
+			return writeError(w, err, codeBlobUploadUnknown)
+		}
+		if start != upload.offset {
+			w.Header().Add("Location", upload.Location())
+			w.Header().Add("Range", upload.Range())
+			return writeError(w, fmt.Errorf("%w: chunk starts at %d but upload is at %d", errUploadOutOfOrder, start, upload.offset), codeBlobUploadUnknown)
+		}
+	}
+
+	err := upload.append(rq.Body)
+	if err != nil {
+		return writeError(w, err, codeBlobUploadUnknown)
+	}
+
+	w.Header().Add("Location", upload.Location())
+	w.Header().Add("Range", upload.Range())
+	w.Header().Add("Docker-Upload-UUID", upload.ID)
+	w.WriteHeader(http.StatusAccepted)
 	return nil
 }
+
 func (r *Registry) end_6(_ context.Context, w http.ResponseWriter, rq *http.Request, pathVars map[string]string, formErr error) error {
-	w.WriteHeader(http.StatusForbidden)
+	name := pathVars["name"]
+	reference := pathVars["reference"]
+
+	if !r.PushEnabled() {
+		return writeError(w, errPushDisabled, codeBlobUploadUnknown)
+	}
+
+	dgst, err := godigest.Parse(rq.URL.Query().Get("digest"))
+	if err != nil {
+		return writeError(w, fmt.Errorf("%w: %w", errDigestInvalid, err), codeBlobUploadUnknown)
+	}
+
+	upload, ok := r.lockUpload(name, reference)
+	if !ok {
+		return writeError(w, errUploadUnknown, codeBlobUploadUnknown)
+	}
+	defer upload.lock.Unlock()
+
+	err = upload.append(rq.Body)
+	if err == nil {
+		err = r.finishUpload(upload, dgst)
+	}
+	if errors.Is(err, errDigestMismatch) {
+		r.removeUpload(upload)
+		return writeError(w, err, codeBlobUploadUnknown)
+	}
+	if err != nil {
+		return writeError(w, err, codeBlobUploadUnknown)
+	}
+
+	w.Header().Add("Location", "/v2/"+name+"/blobs/"+dgst.String())
+	w.Header().Add("Docker-Content-Digest", dgst.String())
+	w.WriteHeader(http.StatusCreated)
 	return nil
 }
-func (r *Registry) end_7(_ context.Context, w http.ResponseWriter, rq *http.Request, pathVars map[string]string, formErr error) error {
-	w.WriteHeader(http.StatusForbidden)
+
+func (r *Registry) end_7(ctx context.Context, w http.ResponseWriter, rq *http.Request, pathVars map[string]string, formErr error) error {
+	name := pathVars["name"]
+	reference := pathVars["reference"]
+
+	if !r.PushEnabled() {
+		return writeError(w, errPushDisabled, codeBlobUploadUnknown)
+	}
+
+	if err := r.checkName(name); err != nil {
+		return writeError(w, err, codeNameUnknown)
+	}
+
+	manifestJSON, err := io.ReadAll(io.LimitReader(rq.Body, maxManifestSize+1))
+	if err != nil {
+		return writeError(w, err, codeManifestUnknown)
+	}
+	if len(manifestJSON) > maxManifestSize {
+		return writeError(w, fmt.Errorf("%w: manifest exceeds %d bytes", errManifestTooLarge, maxManifestSize), codeManifestUnknown)
+	}
+
+	dgst, err := r.pushManifest(ctx, name, reference, rq.Header.Get("Content-Type"), manifestJSON)
+	if err != nil {
+		return writeError(w, err, codeManifestUnknown)
+	}
+
+	w.Header().Add("Location", "/v2/"+name+"/manifests/"+dgst.String())
+	w.Header().Add("Docker-Content-Digest", dgst.String())
+	w.WriteHeader(http.StatusCreated)
 	return nil
 }
 func (r *Registry) end_8a_8b(ctx context.Context, w http.ResponseWriter, rq *http.Request, pathVars map[string]string, formErr error) error {
 	name := pathVars["name"]
 
-	if !r.HasAllowedPrefix(name) {
-		w.WriteHeader(http.StatusNotFound)
-		return fmt.Errorf("does not have allowed prefix")
+	if err := r.checkName(name); err != nil {
+		return writeError(w, err, codeNameUnknown)
 	}
 
-	q := rq.URL.Query()
-	nStr := q.Get("n")
-	var n int
-	if nStr != "" {
-		_, err := fmt.Sscanf(nStr, "%d", &n)
-		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			w.Write([]byte(err.Error()))
-			return err
-		}
+	page, err := parsePagination(rq.URL.Query())
+	if err != nil {
+		return writeError(w, err, codeNameUnknown)
 	}
-	// TODO: Implement last and Link
-	// last := q.Get("last")
 
-	imgSums, err := r.Docker.ImageList(ctx, image.ListOptions{Filters: filters.NewArgs(filters.KeyValuePair{"reference", name + ":*"})})
+	// The daemon does not normalize names when filtering, so all images must be checked
+	imgSums, err := r.Backend.ImageList(ctx)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(err.Error()))
-		return err
+		return writeError(w, err, codeNameUnknown)
 	}
 
-	tags := ocidist.TagList{Name: name}
+	var allTags []string
 	tagSet := make(map[string]struct{})
 	for _, imgSum := range imgSums {
 		for _, repoTag := range imgSum.RepoTags {
-			if !strings.HasPrefix(repoTag, name+":") {
+			tag, ok := tagIn(repoTag, name)
+			if !ok {
 				continue
 			}
-			tag := strings.TrimPrefix(repoTag, name+":")
 			if _, ok := tagSet[tag]; ok {
 				continue
 			}
 			tagSet[tag] = struct{}{}
-			tags.Tags = append(tags.Tags, tag)
-		}
-		if n != 0 && len(tagSet) >= n {
-			break
+			allTags = append(allTags, tag)
 		}
 	}
 
+	tags := ocidist.TagList{Name: name, Tags: []string{}}
+	pageTags, more := page.apply(allTags)
+	tags.Tags = append(tags.Tags, pageTags...)
+	if more {
+		page.setNextLink(w, rq, pageTags[len(pageTags)-1])
+	}
+
+	w.Header().Add("Content-Type", "application/json")
 	return json.NewEncoder(w).Encode(&tags)
 }
-func (r *Registry) end_9(_ context.Context, w http.ResponseWriter, _ *http.Request, _ map[string]string, _ error) error {
-	w.WriteHeader(http.StatusForbidden)
+func (r *Registry) end_9(ctx context.Context, w http.ResponseWriter, _ *http.Request, pathVars map[string]string, _ error) error {
+	name := pathVars["name"]
+	reference := pathVars["reference"]
+
+	if !r.AllowDelete {
+		return writeError(w, errDeleteDisabled, codeManifestUnknown)
+	}
+
+	if err := r.checkName(name); err != nil {
+		return writeError(w, err, codeNameUnknown)
+	}
+
+	err := r.deleteManifest(ctx, name, reference)
+	if err != nil {
+		return writeError(w, err, codeManifestUnknown)
+	}
+	w.WriteHeader(http.StatusAccepted)
 	return nil
 }
 func (r *Registry) end_10(_ context.Context, w http.ResponseWriter, _ *http.Request, _ map[string]string, _ error) error {
-	w.WriteHeader(http.StatusForbidden)
-	return nil
+	return writeError(w, errBlobDeleteUnsupported, codeBlobUnknown)
 }
-func (r *Registry) end_11(_ context.Context, w http.ResponseWriter, _ *http.Request, _ map[string]string, _ error) error {
-	w.WriteHeader(http.StatusForbidden)
-	return nil
+func (r *Registry) end_12a_12b(ctx context.Context, w http.ResponseWriter, rq *http.Request, pathVars map[string]string, _ error) error {
+	name := pathVars["name"]
+	digest := pathVars["digest"]
+
+	if err := r.checkName(name); err != nil {
+		return writeError(w, err, codeNameUnknown)
+	}
+
+	if _, err := godigest.Parse(digest); err != nil {
+		return writeError(w, fmt.Errorf("%w: %w", errDigestInvalid, err), codeManifestUnknown)
+	}
+
+	artifactType := rq.URL.Query().Get("artifactType")
+	referrers, err := r.listReferrers(ctx, name, digest, artifactType)
+	if err != nil {
+		return writeError(w, err, codeManifestUnknown)
+	}
+
+	index := ociimage.Index{
+		Versioned: ocispec.Versioned{SchemaVersion: 2},
+		MediaType: ociimage.MediaTypeImageIndex,
+		Manifests: referrers,
+	}
+	if artifactType != "" {
+		w.Header().Add("OCI-Filters-Applied", "artifactType")
+	}
+	w.Header().Add("Content-Type", ociimage.MediaTypeImageIndex)
+	return json.NewEncoder(w).Encode(&index)
 }
-func (r *Registry) end_12a_12b(_ context.Context, w http.ResponseWriter, _ *http.Request, _ map[string]string, _ error) error {
-	w.WriteHeader(http.StatusForbidden)
+
+func (r *Registry) end_13(_ context.Context, w http.ResponseWriter, _ *http.Request, pathVars map[string]string, _ error) error {
+	name := pathVars["name"]
+	reference := pathVars["reference"]
+
+	if !r.PushEnabled() {
+		return writeError(w, errPushDisabled, codeBlobUploadUnknown)
+	}
+
+	upload, ok := r.lockUpload(name, reference)
+	if !ok {
+		return writeError(w, errUploadUnknown, codeBlobUploadUnknown)
+	}
+	defer upload.lock.Unlock()
+
+	w.Header().Add("Location", upload.Location())
+	w.Header().Add("Range", upload.Range())
+	w.Header().Add("Docker-Upload-UUID", upload.ID)
+	w.WriteHeader(http.StatusNoContent)
 	return nil
 }
-func (r *Registry) end_13(_ context.Context, w http.ResponseWriter, _ *http.Request, _ map[string]string, _ error) error {
-	w.WriteHeader(http.StatusForbidden)
+
+func (r *Registry) cancelUpload(_ context.Context, w http.ResponseWriter, _ *http.Request, pathVars map[string]string, _ error) error {
+	name := pathVars["name"]
+	reference := pathVars["reference"]
+
+	if !r.PushEnabled() {
+		return writeError(w, errPushDisabled, codeBlobUploadUnknown)
+	}
+
+	upload, ok := r.lockUpload(name, reference)
+	if !ok {
+		return writeError(w, errUploadUnknown, codeBlobUploadUnknown)
+	}
+	defer upload.lock.Unlock()
+
+	err := r.removeUpload(upload)
+	if err != nil {
+		return writeError(w, err, codeBlobUploadUnknown)
+	}
+	w.WriteHeader(http.StatusNoContent)
 	return nil
 }
+
+func (r *Registry) catalog(ctx context.Context, w http.ResponseWriter, rq *http.Request, _ map[string]string, _ error) error {
+	page, err := parsePagination(rq.URL.Query())
+	if err != nil {
+		return writeError(w, err, codeNameUnknown)
+	}
+
+	repos, err := r.listRepositories(ctx)
+	if err != nil {
+		return writeError(w, err, codeNameUnknown)
+	}
+
+	catalog := ocidist.RepositoryList{Repositories: []string{}}
+	repos, more := page.apply(repos)
+	catalog.Repositories = append(catalog.Repositories, repos...)
+	if more {
+		page.setNextLink(w, rq, repos[len(repos)-1])
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(&catalog)
+}
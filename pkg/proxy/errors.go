@@ -0,0 +1,123 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"github.com/docker/docker/errdefs"
+
+	ocidist "github.com/opencontainers/distribution-spec/specs-go/v1"
+)
+
+// Error codes from the distribution spec
+const (
+	codeBlobUnknown         = "BLOB_UNKNOWN"
+	codeBlobUploadInvalid   = "BLOB_UPLOAD_INVALID"
+	codeBlobUploadUnknown   = "BLOB_UPLOAD_UNKNOWN"
+	codeDigestInvalid       = "DIGEST_INVALID"
+	codeManifestBlobUnknown = "MANIFEST_BLOB_UNKNOWN"
+	codeManifestInvalid     = "MANIFEST_INVALID"
+	codeManifestUnknown     = "MANIFEST_UNKNOWN"
+	codeNameInvalid         = "NAME_INVALID"
+	codeNameUnknown         = "NAME_UNKNOWN"
+	codeSizeInvalid         = "SIZE_INVALID"
+	codeUnauthorized        = "UNAUTHORIZED"
+	codeDenied              = "DENIED"
+	codeUnsupported         = "UNSUPPORTED"
+)
+
+// Error codes not in the distribution spec, but used by the reference registry implementation
+const (
+	codePaginationNumberInvalid = "PAGINATION_NUMBER_INVALID"
+	codeUnknown                 = "UNKNOWN"
+)
+
+// registryError is an error that is reported to clients with a specific status and error code.
+// Errors returned by this package which should be reported as something other than an internal error
+// wrap one of these.
+type registryError struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+func (e *registryError) Error() string {
+	return e.Message
+}
+
+var (
+	// errNameNotAllowed is returned when a repository does not have any of the allowed prefixes
+	errNameNotAllowed = &registryError{Status: http.StatusNotFound, Code: codeNameUnknown, Message: "repository name not known to registry"}
+	// errNameInvalid is returned when a repository name is not a valid image name
+	errNameInvalid = &registryError{Status: http.StatusBadRequest, Code: codeNameInvalid, Message: "invalid repository name"}
+	// errPushDisabled is returned for any push-related request if pushing is not enabled
+	errPushDisabled = &registryError{Status: http.StatusForbidden, Code: codeDenied, Message: "pushing is disabled"}
+	// errDeleteDisabled is returned for manifest delete requests if deleting is not enabled
+	errDeleteDisabled = &registryError{Status: http.StatusMethodNotAllowed, Code: codeUnsupported, Message: "deleting is disabled"}
+	// errBlobDeleteUnsupported is returned for blob delete requests, as the daemon does not allow deleting layers
+	errBlobDeleteUnsupported = &registryError{Status: http.StatusMethodNotAllowed, Code: codeUnsupported, Message: "blobs cannot be deleted, delete manifests instead"}
+	// errUploadUnknown is returned when an upload session does not exist
+	errUploadUnknown = &registryError{Status: http.StatusNotFound, Code: codeBlobUploadUnknown, Message: "blob upload unknown to registry"}
+	// errUploadInvalid is returned when a chunk of an upload is malformed
+	errUploadInvalid = &registryError{Status: http.StatusBadRequest, Code: codeBlobUploadInvalid, Message: "blob upload invalid"}
+	// errUploadOutOfOrder is returned when a chunk of an upload does not start where the previous one ended
+	errUploadOutOfOrder = &registryError{Status: http.StatusRequestedRangeNotSatisfiable, Code: codeBlobUploadInvalid, Message: "blob upload chunk out of order"}
+	// errDigestInvalid is returned when a digest provided by the client cannot be parsed
+	errDigestInvalid = &registryError{Status: http.StatusBadRequest, Code: codeDigestInvalid, Message: "provided digest is invalid"}
+	// errManifestTooLarge is returned when a pushed manifest exceeds maxManifestSize
+	errManifestTooLarge = &registryError{Status: http.StatusRequestEntityTooLarge, Code: codeSizeInvalid, Message: "manifest is too large"}
+	// errPaginationInvalid is returned when the n query parameter is not a non-negative integer
+	errPaginationInvalid = &registryError{Status: http.StatusBadRequest, Code: codePaginationNumberInvalid, Message: "invalid number of results requested"}
+)
+
+// writeError writes an error response in the format of the distribution spec, and returns the error for logging.
+// Errors from the daemon are mapped to an appropriate status, with notFoundCode used as the code for those
+// indicating that the requested object does not exist. Requests the daemon rejects as invalid are reported as
+// invalid manifests on manifest routes, which are those with a notFoundCode of codeManifestUnknown, and as
+// unsupported otherwise, as only the repository name is validated before reaching the daemon.
+// The error is only included in the detail of client errors, as server errors may contain internal paths and
+// messages from the daemon, so they are logged instead.
+func writeError(w http.ResponseWriter, err error, notFoundCode string) error {
+	status, code, message := classifyError(err, notFoundCode)
+	var detail string
+	if status < http.StatusInternalServerError {
+		detail = err.Error()
+	} else {
+		slog.Error("request failed", "status", status, "error", err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(&ocidist.ErrorResponse{
+		Errors: []ocidist.ErrorInfo{{Code: code, Message: message, Detail: detail}},
+	})
+	return err
+}
+
+func classifyError(err error, notFoundCode string) (status int, code string, message string) {
+	var regErr *registryError
+	if errors.As(err, &regErr) {
+		return regErr.Status, regErr.Code, regErr.Message
+	}
+	switch {
+	case errdefs.IsNotFound(err):
+		return http.StatusNotFound, notFoundCode, "not found in daemon"
+	case errdefs.IsInvalidParameter(err):
+		if notFoundCode == codeManifestUnknown {
+			return http.StatusBadRequest, codeManifestInvalid, "daemon rejected manifest as invalid"
+		}
+		return http.StatusBadRequest, codeUnsupported, "daemon rejected request as invalid"
+	case errdefs.IsUnauthorized(err):
+		return http.StatusUnauthorized, codeUnauthorized, "daemon requires authentication"
+	case errdefs.IsForbidden(err):
+		return http.StatusForbidden, codeDenied, "daemon denied request"
+	case errdefs.IsConflict(err):
+		return http.StatusConflict, codeDenied, "daemon reported a conflict"
+	case errdefs.IsNotImplemented(err):
+		return http.StatusMethodNotAllowed, codeUnsupported, "daemon does not support this operation"
+	case errdefs.IsUnavailable(err):
+		return http.StatusServiceUnavailable, codeUnknown, "daemon is unavailable"
+	}
+	return http.StatusInternalServerError, codeUnknown, "internal error"
+}
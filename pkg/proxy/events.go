@@ -0,0 +1,121 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"time"
+
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/errdefs"
+)
+
+const (
+	// minEventBackoff is how long to wait before reconnecting to the event stream after it first drops
+	minEventBackoff = time.Second
+	// maxEventBackoff is the longest to wait before reconnecting to the event stream
+	maxEventBackoff = time.Minute
+)
+
+// WatchEvents keeps the blob index and manifest cache up to date by watching the backend for images being
+// pulled, tagged, untagged, loaded, imported, and deleted.
+// If the event stream drops, it is reconnected with exponential backoff, resuming from the last event seen.
+// This blocks until ctx is cancelled, and so should be called in a separate goroutine.
+// Returns immediately if the backend does not report events.
+func (r *Registry) WatchEvents(ctx context.Context) error {
+	watcher, ok := r.Backend.(WatchingBackend)
+	if !ok {
+		slog.Info("backend does not report events, not watching")
+		return nil
+	}
+
+	var since time.Time
+	backoff := minEventBackoff
+	for {
+		slog.Info("watching daemon events", "since", since)
+		msgs, errs := watcher.ImageEvents(ctx, since)
+		err := r.handleEvents(ctx, msgs, errs, func(msg events.Message) {
+			since = time.Unix(0, msg.TimeNano)
+			backoff = minEventBackoff
+		})
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		slog.Warn("daemon event stream dropped, reconnecting", "error", err, "backoff", backoff)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, maxEventBackoff)
+	}
+}
+
+// handleEvents processes events until the stream returns an error
+func (r *Registry) handleEvents(ctx context.Context, msgs <-chan events.Message, errs <-chan error, onEvent func(events.Message)) error {
+	for {
+		select {
+		case err := <-errs:
+			return err
+		case msg := <-msgs:
+			err := r.handleImageEvent(ctx, msg)
+			if err != nil {
+				slog.Warn("failed to handle daemon event", "action", msg.Action, "id", msg.Actor.ID, "error", err)
+			}
+			onEvent(msg)
+		}
+	}
+}
+
+func (r *Registry) handleImageEvent(ctx context.Context, msg events.Message) error {
+	slog.Info("daemon image event", "action", msg.Action, "id", msg.Actor.ID)
+	if msg.Action == events.ActionDelete {
+		r.cacheLock.Lock()
+		defer r.cacheLock.Unlock()
+		r.indexLock.Lock()
+		defer r.indexLock.Unlock()
+		r.forgetImage(msg.Actor.ID)
+		return nil
+	}
+
+	// Depending on the action, the actor may be an image reference or ID
+	img, err := r.Backend.ImageInspect(ctx, msg.Actor.ID)
+	if errdefs.IsNotFound(err) {
+		// The image was removed again before the event could be handled, which will have its own event
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("inspecting image %s: %w", msg.Actor.ID, err)
+	}
+	if !r.hasAllowedRef(&img) && !r.isIndexed(img.ID) {
+		return nil
+	}
+	err = r.refreshImage(ctx, img.ID)
+	if err != nil {
+		return err
+	}
+	// As with BuildIndex, layers stored compressed are indexed by their digest straight away if the backend can
+	// read the manifest directly, and otherwise once the manifest is fetched
+	r.indexBackendManifest(ctx, &img)
+	return nil
+}
+
+// hasAllowedRef returns true if any of the tags or digests of an image have an allowed prefix
+func (r *Registry) hasAllowedRef(img *image.InspectResponse) bool {
+	for _, ref := range slices.Concat(img.RepoTags, img.RepoDigests) {
+		if repo, ok := normalizeRepoName(ref); ok && r.HasAllowedPrefix(repo) {
+			return true
+		}
+	}
+	return false
+}
+
+// isIndexed returns true if an image is present in the blob index
+func (r *Registry) isIndexed(imgID string) bool {
+	r.indexLock.RLock()
+	defer r.indexLock.RUnlock()
+	_, ok := r.blobIndex[imgID]
+	return ok
+}
@@ -0,0 +1,258 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+)
+
+// exportChunkSize is how much of an export is read from the daemon at a time before waiting readers are woken
+const exportChunkSize = 256 * 1024
+
+// sharedExport is an image being exported from the daemon by a single ImageSave call, which any number of
+// readers can read from concurrently.
+// If only one reader is waiting for the export by the time the daemon starts sending the tarball, it is streamed
+// straight to that reader. Otherwise, it is spooled to a temporary file as it arrives, so readers that read slowly
+// still see the whole tarball. Readers that want the image after it has been streamed to a single reader start
+// another export.
+type sharedExport struct {
+	imgID  string
+	cancel context.CancelFunc
+
+	// lock must be held when using the fields below
+	lock sync.Mutex
+	// direct is the tarball being streamed to the only reader, if it was not spooled
+	direct io.ReadCloser
+	// releaseSlot releases the export slot held while direct is being read
+	releaseSlot func()
+	// spool is the file the tarball is written to as it arrives, if it is shared by more than one reader
+	spool *os.File
+	// size is the number of bytes written to spool so far
+	size int64
+	// done is true once the export has finished, successfully or not, or has been handed to its only reader
+	done bool
+	// err is the reason the export failed, if it did
+	err error
+	// changed is closed and replaced whenever size, done, or direct changes
+	changed chan struct{}
+	// refs is the number of readers that have not been closed yet
+	refs int
+}
+
+// exportGroup shares exports of the same image between concurrent readers, and limits the number of images
+// being exported at once
+type exportGroup struct {
+	lock    sync.Mutex
+	exports map[string]*sharedExport
+	// slots has one element for each export in progress, or is nil if the number of exports is not limited
+	slots chan struct{}
+}
+
+// exportImage returns a reader for the tarball of an image exported from the daemon.
+// If the image is already being exported, the reader reads from that export instead of starting another one.
+// The returned reader must be closed to release the export.
+func (r *Registry) exportImage(ctx context.Context, imgID string) (io.ReadCloser, error) {
+	g := &r.exports
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if g.exports == nil {
+		g.exports = make(map[string]*sharedExport)
+		if r.MaxConcurrentExports > 0 {
+			g.slots = make(chan struct{}, r.MaxConcurrentExports)
+		}
+	}
+
+	if e, ok := g.exports[imgID]; ok {
+		e.lock.Lock()
+		// Once the export has been streamed to a single reader, its start cannot be read again
+		joinable := e.direct == nil
+		if joinable {
+			e.refs++
+		}
+		e.lock.Unlock()
+		if joinable {
+			slog.Info("joining in-progress export", "id", imgID)
+			return &exportReader{ctx: ctx, group: g, export: e}, nil
+		}
+	}
+
+	exportCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	e := &sharedExport{
+		imgID:   imgID,
+		cancel:  cancel,
+		changed: make(chan struct{}),
+		refs:    1,
+	}
+	g.exports[imgID] = e
+	go r.runExport(exportCtx, e)
+	return &exportReader{ctx: ctx, group: g, export: e}, nil
+}
+
+// runExport copies an image from the daemon into the spool of an export until it is finished or canceled, or
+// hands it to the only reader of the export
+func (r *Registry) runExport(ctx context.Context, e *sharedExport) {
+	err := r.copyExport(ctx, e)
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.done = true
+	e.err = err
+	close(e.changed)
+	e.changed = make(chan struct{})
+	if e.refs == 0 {
+		e.closeSpool()
+	}
+}
+
+func (r *Registry) copyExport(ctx context.Context, e *sharedExport) error {
+	releaseSlot := func() {}
+	if slots := r.exports.slots; slots != nil {
+		select {
+		case slots <- struct{}{}:
+			releaseSlot = func() { <-slots }
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	slog.Info("exporting image", "id", e.imgID)
+	imgTar, err := r.Backend.ImageSave(ctx, e.imgID)
+	if err != nil {
+		releaseSlot()
+		return fmt.Errorf("requesting upstream tarball: %w", err)
+	}
+
+	e.lock.Lock()
+	switch e.refs {
+	case 0:
+		e.lock.Unlock()
+		imgTar.Close()
+		releaseSlot()
+		return fmt.Errorf("export of %s was abandoned", e.imgID)
+	case 1:
+		slog.Info("streaming export to its only reader", "id", e.imgID)
+		e.direct = imgTar
+		e.releaseSlot = releaseSlot
+		e.lock.Unlock()
+		return nil
+	}
+	e.spool, err = os.CreateTemp(r.ExportDir, "export-")
+	e.lock.Unlock()
+	defer releaseSlot()
+	defer imgTar.Close()
+	if err != nil {
+		return fmt.Errorf("creating export spool file: %w", err)
+	}
+
+	buf := make([]byte, exportChunkSize)
+	for {
+		n, err := io.ReadFull(imgTar, buf)
+		if n != 0 {
+			_, writeErr := e.spool.Write(buf[:n])
+			if writeErr != nil {
+				return fmt.Errorf("writing export spool file: %w", writeErr)
+			}
+			e.lock.Lock()
+			e.size += int64(n)
+			close(e.changed)
+			e.changed = make(chan struct{})
+			e.lock.Unlock()
+		}
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			slog.Info("exported image", "id", e.imgID, "size", e.size)
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("reading upstream tarball: %w", err)
+		}
+	}
+}
+
+// closeSpool removes the spool file of an export once nothing is using it.
+// lock must be held.
+func (e *sharedExport) closeSpool() {
+	if e.spool == nil {
+		return
+	}
+	e.spool.Close()
+	os.Remove(e.spool.Name())
+}
+
+// release is called when a reader of an export is closed.
+// Once all readers are closed, the export is stopped if still in progress, and later requests start a new one.
+func (g *exportGroup) release(e *sharedExport) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.refs--
+	if e.refs != 0 {
+		return
+	}
+	if g.exports[e.imgID] == e {
+		delete(g.exports, e.imgID)
+	}
+	e.cancel()
+	if e.direct != nil {
+		e.direct.Close()
+		e.releaseSlot()
+	}
+	if e.done {
+		e.closeSpool()
+	}
+}
+
+// exportReader reads a shared export from the start, waiting for more data while the export is in progress
+type exportReader struct {
+	ctx    context.Context
+	group  *exportGroup
+	export *sharedExport
+	offset int64
+	closed bool
+}
+
+func (x *exportReader) Read(b []byte) (int, error) {
+	e := x.export
+	for {
+		e.lock.Lock()
+		direct, size, done, err, changed := e.direct, e.size, e.done, e.err, e.changed
+		e.lock.Unlock()
+		if direct != nil {
+			// This is the only reader, so nothing else reads direct
+			return direct.Read(b)
+		}
+		if x.offset < size {
+			if int64(len(b)) > size-x.offset {
+				b = b[:size-x.offset]
+			}
+			n, err := e.spool.ReadAt(b, x.offset)
+			x.offset += int64(n)
+			if n != 0 {
+				return n, nil
+			}
+			return 0, fmt.Errorf("reading export spool file: %w", err)
+		}
+		if done {
+			if err != nil {
+				return 0, err
+			}
+			return 0, io.EOF
+		}
+		select {
+		case <-changed:
+		case <-x.ctx.Done():
+			return 0, x.ctx.Err()
+		}
+	}
+}
+
+func (x *exportReader) Close() error {
+	if x.closed {
+		return nil
+	}
+	x.closed = true
+	x.group.release(x.export)
+	return nil
+}
@@ -0,0 +1,404 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/distribution/reference"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/image"
+	docker "github.com/docker/docker/client"
+	"github.com/docker/docker/errdefs"
+
+	godigest "github.com/opencontainers/go-digest"
+)
+
+// federatedRetryInterval is how long a backend which has failed is skipped for before it is tried again
+const federatedRetryInterval = 30 * time.Second
+
+// FederatedBackend serves the images of several backends, such as the daemons of several CI executors, as one.
+// Backends are searched in priority order, so a tag present in more than one refers to the image in the first
+// backend which has it, while repositories and tags are merged across all of them.
+// Each image and blob is read from the backend it was last found in, so the blobs in the index of the registry are
+// served from the backend which holds them.
+// A backend which fails by being unavailable, such as a daemon which cannot be reached, is skipped until
+// federatedRetryInterval has passed, rather than failing every request.
+// Pushed images are loaded into the first backend which has not failed.
+type FederatedBackend struct {
+	// members are the backends, in priority order
+	members []Backend
+
+	// lock must be held when using retryAt, sources, and blobSources
+	lock sync.Mutex
+	// retryAt is the time after which each member which has failed may be used again
+	retryAt map[int]time.Time
+	// sources is a map from image ID to the member it was last found in
+	sources map[string]int
+	// blobSources is a map from digest to the member each blob was last read from, or the manifest of an image
+	// was last found in, since images were last listed
+	blobSources map[godigest.Digest]int
+}
+
+var _ WatchingBackend = &FederatedBackend{}
+var _ PullingBackend = &FederatedBackend{}
+var _ BlobBackend = &FederatedBackend{}
+
+// NewFederatedBackend returns a backend serving the images of members, in priority order
+func NewFederatedBackend(members ...Backend) *FederatedBackend {
+	return &FederatedBackend{
+		members:     members,
+		retryAt:     make(map[int]time.Time),
+		sources:     make(map[string]int),
+		blobSources: make(map[godigest.Digest]int),
+	}
+}
+
+// isBackendFailure returns true if an error from a backend indicates it cannot be reached or is otherwise
+// unavailable, rather than that the request could not be satisfied
+func isBackendFailure(ctx context.Context, err error) bool {
+	if err == nil || ctx.Err() != nil {
+		return false
+	}
+	var netErr net.Error
+	return errdefs.IsUnavailable(err) || docker.IsErrConnectionFailed(err) || errors.As(err, &netErr)
+}
+
+// healthy returns the indexes of the members which have not failed recently, in priority order.
+// If first is a member, it is returned first.
+func (f *FederatedBackend) healthy(first int) []int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	now := time.Now()
+	var members []int
+	for i := range f.members {
+		if retryAt, ok := f.retryAt[i]; ok {
+			if now.Before(retryAt) {
+				continue
+			}
+			delete(f.retryAt, i)
+		}
+		if i == first {
+			members = slices.Insert(members, 0, i)
+		} else {
+			members = append(members, i)
+		}
+	}
+	return members
+}
+
+// failed marks a member as unhealthy if err indicates it has failed, and returns true if so
+func (f *FederatedBackend) failed(ctx context.Context, member int, err error) bool {
+	if !isBackendFailure(ctx, err) {
+		return false
+	}
+	slog.Warn("backend failed, skipping it", "backend", member, "retryAfter", federatedRetryInterval, "error", err)
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.retryAt[member] = time.Now().Add(federatedRetryInterval)
+	return true
+}
+
+// source returns the member an image was last found in, or -1 if it is not known
+func (f *FederatedBackend) source(imgID string) int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if member, ok := f.sources[imgID]; ok {
+		return member
+	}
+	return -1
+}
+
+// blobSource returns the member a blob was last found in, or -1 if it is not known
+func (f *FederatedBackend) blobSource(dgst godigest.Digest) int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if member, ok := f.blobSources[dgst]; ok {
+		return member
+	}
+	return -1
+}
+
+// unavailable returns the error to report when no member could satisfy a request
+func unavailable(errs []error) error {
+	if len(errs) == 0 {
+		return errdefs.Unavailable(errors.New("every backend has failed recently"))
+	}
+	return errdefs.Unavailable(fmt.Errorf("no backend is available: %w", errors.Join(errs...)))
+}
+
+// try calls fn with each healthy member in priority order, starting with first if it is a member, until it
+// succeeds or fails with an error other than not found or the failure of the member.
+// Returns the member it succeeded with.
+func (f *FederatedBackend) try(ctx context.Context, first int, fn func(Backend) error) (int, error) {
+	var notFound error
+	var errs []error
+	for _, i := range f.healthy(first) {
+		err := fn(f.members[i])
+		switch {
+		case err == nil:
+			return i, nil
+		case errdefs.IsNotFound(err):
+			notFound = err
+		case f.failed(ctx, i, err):
+			errs = append(errs, err)
+		default:
+			return i, err
+		}
+	}
+	if notFound != nil {
+		return -1, notFound
+	}
+	return -1, unavailable(errs)
+}
+
+// tagKey returns a tag as reported by a backend in a form which is the same for every backend, as some report
+// tags in their familiar form, and others fully qualified
+func tagKey(tag string) string {
+	named, err := reference.ParseNormalizedNamed(tag)
+	if err != nil {
+		return tag
+	}
+	return named.String()
+}
+
+// ImageList merges the images of every healthy member.
+// Images in more than one member are listed once, with the tags and digests from all of them, except for tags which
+// refer to a different image in a member with a higher priority.
+func (f *FederatedBackend) ImageList(ctx context.Context) ([]image.Summary, error) {
+	var summaries []image.Summary
+	// byID is a map from image ID to its index in summaries
+	byID := make(map[string]int)
+	// claimed is a map from tag to the ID of the image it refers to
+	claimed := make(map[string]string)
+	sources := make(map[string]int)
+	blobSources := make(map[godigest.Digest]int)
+	var errs []error
+	listed := false
+	for _, i := range f.healthy(-1) {
+		memberSums, err := f.members[i].ImageList(ctx)
+		if f.failed(ctx, i, err) {
+			errs = append(errs, err)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		listed = true
+		for _, summary := range memberSums {
+			summary.RepoTags = slices.DeleteFunc(slices.Clone(summary.RepoTags), func(tag string) bool {
+				id, ok := claimed[tagKey(tag)]
+				return ok && id != summary.ID
+			})
+			for _, tag := range summary.RepoTags {
+				claimed[tagKey(tag)] = summary.ID
+			}
+			if j, ok := byID[summary.ID]; ok {
+				merged := &summaries[j]
+				for _, tag := range summary.RepoTags {
+					if !slices.ContainsFunc(merged.RepoTags, func(t string) bool { return tagKey(t) == tagKey(tag) }) {
+						merged.RepoTags = append(merged.RepoTags, tag)
+					}
+				}
+				for _, digest := range summary.RepoDigests {
+					if !slices.Contains(merged.RepoDigests, digest) {
+						merged.RepoDigests = append(merged.RepoDigests, digest)
+					}
+				}
+				continue
+			}
+			byID[summary.ID] = len(summaries)
+			sources[summary.ID] = i
+			if summary.Descriptor != nil {
+				blobSources[summary.Descriptor.Digest] = i
+			}
+			summaries = append(summaries, summary)
+		}
+	}
+	if !listed {
+		return nil, unavailable(errs)
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.sources = sources
+	f.blobSources = blobSources
+	return summaries, nil
+}
+
+func (f *FederatedBackend) ImageInspect(ctx context.Context, ref string) (image.InspectResponse, error) {
+	var img image.InspectResponse
+	member, err := f.try(ctx, f.source(ref), func(b Backend) error {
+		var err error
+		img, err = b.ImageInspect(ctx, ref)
+		return err
+	})
+	if err != nil {
+		return image.InspectResponse{}, err
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.sources[img.ID] = member
+	if img.Descriptor != nil {
+		f.blobSources[img.Descriptor.Digest] = member
+	}
+	return img, nil
+}
+
+func (f *FederatedBackend) ImageSave(ctx context.Context, imgID string) (io.ReadCloser, error) {
+	var archive io.ReadCloser
+	_, err := f.try(ctx, f.source(imgID), func(b Backend) error {
+		var err error
+		archive, err = b.ImageSave(ctx, imgID)
+		return err
+	})
+	return archive, err
+}
+
+// BlobOpen reads a blob from the first member which can read blobs directly and has it, starting with the member
+// it was last found in.
+// If it is not found, and any member cannot read blobs directly, errdefs.NotImplemented is returned so that the
+// image the blob belongs to is exported instead.
+func (f *FederatedBackend) BlobOpen(ctx context.Context, dgst godigest.Digest) (io.ReadCloser, int64, error) {
+	var content io.ReadCloser
+	var size int64
+	exportOnly := false
+	member, err := f.try(ctx, f.blobSource(dgst), func(b Backend) error {
+		blobs, ok := b.(BlobBackend)
+		if !ok {
+			exportOnly = true
+			return errdefs.NotFound(fmt.Errorf("backend cannot read blob %s directly", dgst))
+		}
+		var err error
+		content, size, err = blobs.BlobOpen(ctx, dgst)
+		return err
+	})
+	if errdefs.IsNotFound(err) && exportOnly {
+		return nil, 0, errdefs.NotImplemented(fmt.Errorf("blob %s is not in any backend which can read it directly", dgst))
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.blobSources[dgst] = member
+	return content, size, nil
+}
+
+// ImageLoad loads an image into the first healthy member.
+// The archive can only be read once, so other members are not tried if it fails.
+func (f *FederatedBackend) ImageLoad(ctx context.Context, archive io.Reader) error {
+	members := f.healthy(-1)
+	if len(members) == 0 {
+		return unavailable(nil)
+	}
+	err := f.members[members[0]].ImageLoad(ctx, archive)
+	f.failed(ctx, members[0], err)
+	return err
+}
+
+// ImageRemove removes a reference from every healthy member which has it, so that the reference does not then
+// refer to an image in a member with a lower priority
+func (f *FederatedBackend) ImageRemove(ctx context.Context, ref string) error {
+	removed := false
+	var notFound error
+	var errs []error
+	for _, i := range f.healthy(-1) {
+		err := f.members[i].ImageRemove(ctx, ref)
+		switch {
+		case err == nil:
+			removed = true
+		case errdefs.IsNotFound(err):
+			notFound = err
+		case f.failed(ctx, i, err):
+			errs = append(errs, err)
+		default:
+			return err
+		}
+	}
+	if removed {
+		return nil
+	}
+	if notFound != nil {
+		return notFound
+	}
+	return unavailable(errs)
+}
+
+// ImagePull pulls an image with the first healthy member which can pull images
+func (f *FederatedBackend) ImagePull(ctx context.Context, ref string) error {
+	canPull := false
+	_, err := f.try(ctx, -1, func(b Backend) error {
+		puller, ok := b.(PullingBackend)
+		if !ok {
+			return errdefs.NotFound(fmt.Errorf("%s not found and backend cannot pull images", ref))
+		}
+		canPull = true
+		return puller.ImagePull(ctx, ref)
+	})
+	if err != nil && !canPull {
+		return errdefs.NotFound(fmt.Errorf("%s not found and no backend can pull images", ref))
+	}
+	return err
+}
+
+// ImageEvents merges the events of every member which reports them.
+// The event stream of a member which drops is reconnected after federatedRetryInterval, rather than ending the
+// merged stream, which only ends when ctx is cancelled.
+// An image deleted from one member may still be present in another, in which case it is reported as untagged.
+func (f *FederatedBackend) ImageEvents(ctx context.Context, since time.Time) (<-chan events.Message, <-chan error) {
+	msgs := make(chan events.Message)
+	errs := make(chan error, 1)
+	for i, member := range f.members {
+		if watcher, ok := member.(WatchingBackend); ok {
+			go f.forwardEvents(ctx, i, watcher, since, msgs)
+		}
+	}
+	go func() {
+		<-ctx.Done()
+		errs <- ctx.Err()
+	}()
+	return msgs, errs
+}
+
+// forwardEvents forwards the events of a member until ctx is cancelled, reconnecting whenever its stream drops
+func (f *FederatedBackend) forwardEvents(ctx context.Context, member int, watcher WatchingBackend, since time.Time, msgs chan<- events.Message) {
+	for {
+		memberMsgs, memberErrs := watcher.ImageEvents(ctx, since)
+	stream:
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case err := <-memberErrs:
+				if ctx.Err() != nil {
+					return
+				}
+				slog.Warn("backend event stream dropped, reconnecting", "backend", member, "retryAfter", federatedRetryInterval, "error", err)
+				break stream
+			case msg := <-memberMsgs:
+				since = time.Unix(0, msg.TimeNano)
+				if msg.Action == events.ActionDelete {
+					if _, err := f.ImageInspect(ctx, msg.Actor.ID); err == nil {
+						msg.Action = events.ActionUnTag
+					}
+				}
+				select {
+				case msgs <- msg:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(federatedRetryInterval):
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package proxy_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/errdefs"
+	ocidist "github.com/opencontainers/distribution-spec/specs-go/v1"
+	godigest "github.com/opencontainers/go-digest"
+
+	"github.com/meln5674/oci-reg-docker/pkg/proxy"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// unreachableBackend is a backend whose daemon cannot be reached
+type unreachableBackend struct{}
+
+var errUnreachable = errdefs.Unavailable(errors.New("cannot connect to the daemon"))
+
+func (unreachableBackend) ImageList(context.Context) ([]image.Summary, error) {
+	return nil, errUnreachable
+}
+
+func (unreachableBackend) ImageInspect(context.Context, string) (image.InspectResponse, error) {
+	return image.InspectResponse{}, errUnreachable
+}
+
+func (unreachableBackend) ImageSave(context.Context, string) (io.ReadCloser, error) {
+	return nil, errUnreachable
+}
+
+func (unreachableBackend) ImageLoad(context.Context, io.Reader) error {
+	return errUnreachable
+}
+
+func (unreachableBackend) ImageRemove(context.Context, string) error {
+	return errUnreachable
+}
+
+// failingExportBackend is a backend which cannot export its images, such as one with corrupt storage
+type failingExportBackend struct {
+	proxy.Backend
+}
+
+func (failingExportBackend) ImageSave(context.Context, string) (io.ReadCloser, error) {
+	return nil, errors.New("export failed")
+}
+
+// blobCountingBackend counts the blobs read from a backend, whether or not they are found
+type blobCountingBackend struct {
+	*proxy.MemoryBackend
+	opens atomic.Int32
+}
+
+func (b *blobCountingBackend) BlobOpen(ctx context.Context, dgst godigest.Digest) (io.ReadCloser, int64, error) {
+	b.opens.Add(1)
+	return b.MemoryBackend.BlobOpen(ctx, dgst)
+}
+
+// exportOnlyBackend hides every method of a backend other than those of Backend, such as BlobOpen, as with a daemon
+type exportOnlyBackend struct {
+	proxy.Backend
+}
+
+var _ = Describe("FederatedBackend", func() {
+	When("a backend is unreachable", func() {
+		itServesPushedImages(func() proxy.Backend {
+			return proxy.NewFederatedBackend(unreachableBackend{}, exportOnlyBackend{proxy.NewMemoryBackend()})
+		})
+	})
+
+	When("images are spread across backends", func() {
+		var first, second *proxy.MemoryBackend
+		var shared, firstOnly, secondOnly, shadowed testImage
+		var client registryClient
+
+		BeforeEach(func(ctx context.Context) {
+			first = proxy.NewMemoryBackend()
+			second = proxy.NewMemoryBackend()
+			shared = newTestImage("shared layer")
+			firstOnly = newTestImage("first layer")
+			secondOnly = newTestImage("second layer")
+			shadowed = newTestImage("shadowed layer")
+
+			firstClient := startRegistry(ctx, first)
+			firstClient.push(ctx, "test/app", "shared", shared)
+			firstClient.push(ctx, "test/app", "first", firstOnly)
+			firstClient.push(ctx, "test/app", "latest", firstOnly)
+			secondClient := startRegistry(ctx, second)
+			secondClient.push(ctx, "test/app", "shared-too", shared)
+			secondClient.push(ctx, "test/app", "second", secondOnly)
+			secondClient.push(ctx, "test/other", "v1", secondOnly)
+			secondClient.push(ctx, "test/app", "latest", shadowed)
+
+			client = startRegistry(ctx, proxy.NewFederatedBackend(first, exportOnlyBackend{second}))
+		})
+
+		It("should merge the catalog", func(ctx context.Context) {
+			resp := client.do(ctx, http.MethodGet, "/v2/_catalog", nil)
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			var catalog ocidist.RepositoryList
+			Expect(json.NewDecoder(resp.Body).Decode(&catalog)).To(Succeed())
+			Expect(catalog.Repositories).To(ConsistOf("docker.io/test/app", "docker.io/test/other"))
+		})
+
+		It("should merge the tags", func(ctx context.Context) {
+			resp := client.do(ctx, http.MethodGet, "/v2/test/app/tags/list", nil)
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			var tags ocidist.TagList
+			Expect(json.NewDecoder(resp.Body).Decode(&tags)).To(Succeed())
+			Expect(tags.Tags).To(ConsistOf("shared", "shared-too", "first", "second", "latest"))
+		})
+
+		It("should resolve a tag in more than one backend to the first", func(ctx context.Context) {
+			resp := client.do(ctx, http.MethodGet, "/v2/test/app/manifests/latest", nil)
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			Expect(readBody(resp)).To(Equal(firstOnly.Manifest))
+		})
+
+		It("should serve blobs from the backend which holds them", func(ctx context.Context) {
+			resp := client.do(ctx, http.MethodGet, "/v2/test/app/blobs/"+firstOnly.LayerDigest.String(), nil)
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			Expect(readBody(resp)).To(Equal(firstOnly.Layer))
+
+			resp = client.do(ctx, http.MethodGet, "/v2/test/other/blobs/"+secondOnly.LayerDigest.String(), nil)
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			Expect(readBody(resp)).To(Equal(secondOnly.Layer))
+
+			resp = client.do(ctx, http.MethodGet, "/v2/test/app/manifests/shared-too", nil)
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			Expect(readBody(resp)).To(Equal(shared.Manifest))
+		})
+
+		It("should load pushed images into the first backend", func(ctx context.Context) {
+			pushed := newTestImage("pushed layer")
+			client.push(ctx, "test/pushed", "v1", pushed)
+			_, err := first.ImageInspect(ctx, "test/pushed:v1")
+			Expect(err).ToNot(HaveOccurred())
+			_, err = second.ImageInspect(ctx, "test/pushed:v1")
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("should read blobs from the backend they were last found in", func(ctx context.Context) {
+			counting := &blobCountingBackend{MemoryBackend: first}
+			federated := proxy.NewFederatedBackend(counting, second)
+			_, err := federated.ImageInspect(ctx, "test/other:v1")
+			Expect(err).ToNot(HaveOccurred())
+
+			content, _, err := federated.BlobOpen(ctx, secondOnly.Digest)
+			Expect(err).ToNot(HaveOccurred())
+			content.Close()
+			Expect(counting.opens.Load()).To(BeZero())
+
+			for range 2 {
+				content, _, err = federated.BlobOpen(ctx, secondOnly.LayerDigest)
+				Expect(err).ToNot(HaveOccurred())
+				content.Close()
+			}
+			Expect(counting.opens.Load()).To(Equal(int32(1)))
+		})
+
+		It("should keep using a backend which fails for reasons other than being unavailable", func(ctx context.Context) {
+			client = startRegistry(ctx, proxy.NewFederatedBackend(failingExportBackend{exportOnlyBackend{first}}, exportOnlyBackend{second}))
+
+			resp := client.do(ctx, http.MethodGet, "/v2/test/app/manifests/first", nil)
+			Expect(resp.StatusCode).To(Equal(http.StatusInternalServerError))
+
+			resp = client.do(ctx, http.MethodGet, "/v2/test/app/manifests/latest", nil)
+			Expect(resp.StatusCode).To(Equal(http.StatusInternalServerError))
+			resp = client.do(ctx, http.MethodGet, "/v2/test/app/manifests/second", nil)
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			Expect(readBody(resp)).To(Equal(secondOnly.Manifest))
+		})
+	})
+})
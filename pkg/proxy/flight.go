@@ -0,0 +1,48 @@
+package proxy
+
+import (
+	"context"
+	"sync"
+)
+
+// flight is an operation in progress that other callers with the same key wait on instead of repeating
+type flight struct {
+	done chan struct{}
+	err  error
+}
+
+// flightGroup deduplicates concurrent operations with the same key
+type flightGroup struct {
+	lock    sync.Mutex
+	flights map[string]*flight
+}
+
+// Do calls fn, unless a call with the same key is already in progress, in which case it waits for that call
+// and returns its result instead.
+// fn is not canceled if the caller that started it gives up waiting, as other callers may still be waiting on it.
+func (g *flightGroup) Do(ctx context.Context, key string, fn func(ctx context.Context) error) error {
+	g.lock.Lock()
+	if g.flights == nil {
+		g.flights = make(map[string]*flight)
+	}
+	f, ok := g.flights[key]
+	if !ok {
+		f = &flight{done: make(chan struct{})}
+		g.flights[key] = f
+		go func() {
+			f.err = fn(context.WithoutCancel(ctx))
+			g.lock.Lock()
+			delete(g.flights, key)
+			g.lock.Unlock()
+			close(f.done)
+		}()
+	}
+	g.lock.Unlock()
+
+	select {
+	case <-f.done:
+		return f.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,464 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/distribution/reference"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/errdefs"
+
+	godigest "github.com/opencontainers/go-digest"
+	ociimage "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// blobSource provides the content of blobs to an imageStore
+type blobSource interface {
+	// openBlob returns the content of a blob and its size, or an errdefs.NotFound error if it is not present
+	openBlob(dgst godigest.Digest) (io.ReadCloser, int64, error)
+}
+
+// sectionReadCloser is the content of a blob read from part of a file or other io.ReaderAt
+type sectionReadCloser struct {
+	*io.SectionReader
+	// closer is closed when the blob is closed, if not nil
+	closer io.Closer
+}
+
+func (s *sectionReadCloser) Close() error {
+	if s.closer == nil {
+		return nil
+	}
+	return s.closer.Close()
+}
+
+// storedImage is an image in an imageStore
+type storedImage struct {
+	// Descriptor is the descriptor of the manifest or index of the image, which is also its ID
+	Descriptor ociimage.Descriptor
+	// Inspect is the metadata of the image in the form reported by the Docker Engine API
+	Inspect image.InspectResponse
+}
+
+// imageStore implements listing, inspecting, exporting, and untagging images for backends which have direct
+// access to the manifests and blobs of their images, rather than delegating to a daemon.
+// Images are identified by the digest of their manifest or index, as with the containerd image store.
+type imageStore struct {
+	blobs blobSource
+
+	// lock must be held when using images
+	lock sync.RWMutex
+	// images is a map from image ID to image
+	images map[string]*storedImage
+}
+
+func newImageStore(blobs blobSource) *imageStore {
+	return &imageStore{
+		blobs:  blobs,
+		images: make(map[string]*storedImage),
+	}
+}
+
+func (s *imageStore) list() []image.Summary {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	summaries := make([]image.Summary, 0, len(s.images))
+	for _, img := range s.images {
+		var created int64
+		if t, err := time.Parse(time.RFC3339Nano, img.Inspect.Created); err == nil {
+			created = t.Unix()
+		}
+		desc := img.Descriptor
+		summaries = append(summaries, image.Summary{
+			ID:          img.Inspect.ID,
+			RepoTags:    slices.Clone(img.Inspect.RepoTags),
+			RepoDigests: slices.Clone(img.Inspect.RepoDigests),
+			Created:     created,
+			Size:        img.Inspect.Size,
+			Descriptor:  &desc,
+		})
+	}
+	sort.Slice(summaries, func(i, j int) bool { return summaries[i].ID < summaries[j].ID })
+	return summaries
+}
+
+func (s *imageStore) inspect(ref string) (image.InspectResponse, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	img, ok := s.resolve(ref)
+	if !ok {
+		return image.InspectResponse{}, errdefs.NotFound(fmt.Errorf("no such image: %s", ref))
+	}
+	inspect := img.Inspect
+	inspect.RepoTags = slices.Clone(inspect.RepoTags)
+	inspect.RepoDigests = slices.Clone(inspect.RepoDigests)
+	inspect.RootFS.Layers = slices.Clone(inspect.RootFS.Layers)
+	return inspect, nil
+}
+
+// resolve finds an image by ID, tag, or digest reference.
+// lock must be held.
+func (s *imageStore) resolve(ref string) (*storedImage, bool) {
+	if img, ok := s.images[ref]; ok {
+		return img, true
+	}
+	named, err := reference.ParseNormalizedNamed(ref)
+	if err != nil {
+		return nil, false
+	}
+	if canonical, ok := named.(reference.Canonical); ok {
+		img, ok := s.images[canonical.Digest().String()]
+		return img, ok
+	}
+	tag := reference.FamiliarString(reference.TagNameOnly(named))
+	for _, img := range s.images {
+		if slices.Contains(img.Inspect.RepoTags, tag) {
+			return img, true
+		}
+	}
+	return nil, false
+}
+
+// save exports an image as an OCI image layout tarball, with a descriptor in its index for each tag.
+func (s *imageStore) save(imgID string) (io.ReadCloser, error) {
+	s.lock.RLock()
+	img, ok := s.resolve(imgID)
+	var tags []string
+	if ok {
+		tags = slices.Clone(img.Inspect.RepoTags)
+	}
+	s.lock.RUnlock()
+	if !ok {
+		return nil, errdefs.NotFound(fmt.Errorf("no such image: %s", imgID))
+	}
+
+	descs, err := s.reachableBlobs(img.Descriptor)
+	if err != nil {
+		return nil, err
+	}
+	blobs := make([]archiveBlob, 0, len(descs))
+	for _, desc := range descs {
+		blobs = append(blobs, archiveBlob{
+			Digest: desc.Digest,
+			Size:   desc.Size,
+			Open: func() (io.ReadCloser, error) {
+				content, _, err := s.blobs.openBlob(desc.Digest)
+				return content, err
+			},
+		})
+	}
+
+	var index ociimage.Index
+	for _, tag := range tags {
+		desc := img.Descriptor
+		desc.Annotations = tagAnnotations(desc.Annotations, tag)
+		index.Manifests = append(index.Manifests, desc)
+	}
+	if len(index.Manifests) == 0 {
+		index.Manifests = append(index.Manifests, img.Descriptor)
+	}
+
+	archiveR, archiveW := io.Pipe()
+	go func() {
+		archiveW.CloseWithError(writeOCIArchive(archiveW, index, nil, blobs))
+	}()
+	return archiveR, nil
+}
+
+// tagAnnotations returns a copy of the annotations of a descriptor with the image name annotations for a tag
+func tagAnnotations(annotations map[string]string, tag string) map[string]string {
+	tagged := make(map[string]string, len(annotations)+2)
+	for k, v := range annotations {
+		tagged[k] = v
+	}
+	if named, err := reference.ParseNormalizedNamed(tag); err == nil {
+		tagged[annotationImageName] = named.String()
+		if t, ok := named.(reference.Tagged); ok {
+			tagged[ociimage.AnnotationRefName] = t.Tag()
+		}
+	}
+	return tagged
+}
+
+// reachableBlobs returns the descriptors of a manifest or index and every blob reachable from it which is present.
+// Child manifests of an index which are not present are skipped, as not every platform is necessarily stored.
+func (s *imageStore) reachableBlobs(root ociimage.Descriptor) ([]ociimage.Descriptor, error) {
+	descs := []ociimage.Descriptor{root}
+	manifest, err := s.readManifest(root)
+	if err != nil {
+		return nil, err
+	}
+	if manifest.IsIndex() {
+		for _, child := range manifest.Index.Manifests {
+			childDescs, err := s.reachableBlobs(child)
+			if errdefs.IsNotFound(err) {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			descs = append(descs, childDescs...)
+		}
+		return descs, nil
+	}
+	descs = append(descs, manifest.Manifest.Config)
+	descs = append(descs, manifest.Manifest.Layers...)
+	return descs, nil
+}
+
+// readBlob returns the content of a small blob, such as a manifest or config
+func (s *imageStore) readBlob(dgst godigest.Digest) ([]byte, error) {
+	content, size, err := s.blobs.openBlob(dgst)
+	if err != nil {
+		return nil, err
+	}
+	defer content.Close()
+	if size > smallBlobCap {
+		return nil, fmt.Errorf("blob %s is too large to be a manifest or config", dgst)
+	}
+	var buf bytes.Buffer
+	_, err = io.Copy(&buf, content)
+	if err != nil {
+		return nil, fmt.Errorf("reading blob %s: %w", dgst, err)
+	}
+	return buf.Bytes(), nil
+}
+
+func (s *imageStore) readManifest(desc ociimage.Descriptor) (cachedManifest, error) {
+	manifestJSON, err := s.readBlob(desc.Digest)
+	if err != nil {
+		return cachedManifest{}, err
+	}
+	manifest, err := parseManifest(manifestJSON, desc.MediaType)
+	if err != nil {
+		return cachedManifest{}, fmt.Errorf("invalid manifest %s: %w", desc.Digest, err)
+	}
+	return manifest, nil
+}
+
+// addImage adds an image with the given manifest or index, whose blobs must already be present, and tags it.
+// Tags are moved from any other image that had them.
+func (s *imageStore) addImage(desc ociimage.Descriptor, tags []string) error {
+	s.lock.RLock()
+	img, ok := s.images[desc.Digest.String()]
+	s.lock.RUnlock()
+	if !ok {
+		inspect, err := s.inspectManifest(desc)
+		if err != nil {
+			return err
+		}
+		desc.Annotations = nil
+		img = &storedImage{Descriptor: desc, Inspect: inspect}
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if existing, ok := s.images[img.Inspect.ID]; ok {
+		img = existing
+	}
+	s.images[img.Inspect.ID] = img
+	for _, tag := range tags {
+		named, err := reference.ParseNormalizedNamed(tag)
+		if err != nil {
+			return errdefs.InvalidParameter(fmt.Errorf("invalid tag %s: %w", tag, err))
+		}
+		tag = reference.FamiliarString(reference.TagNameOnly(named))
+		if slices.Contains(img.Inspect.RepoTags, tag) {
+			continue
+		}
+		for _, other := range s.images {
+			other.Inspect.RepoTags = slices.DeleteFunc(other.Inspect.RepoTags, func(t string) bool { return t == tag })
+		}
+		img.Inspect.RepoTags = append(img.Inspect.RepoTags, tag)
+	}
+	return nil
+}
+
+// reset replaces the images in the store with the given images, logging and skipping any which cannot be read.
+// The metadata of images which were already present is reused rather than read again.
+func (s *imageStore) reset(images []archiveImage) {
+	fresh := newImageStore(s.blobs)
+	s.lock.RLock()
+	for _, img := range images {
+		id := img.Descriptor.Digest.String()
+		if existing, ok := s.images[id]; ok {
+			inspect := existing.Inspect
+			inspect.RepoTags = []string{}
+			inspect.RepoDigests = slices.Clone(inspect.RepoDigests)
+			inspect.RootFS.Layers = slices.Clone(inspect.RootFS.Layers)
+			fresh.images[id] = &storedImage{Descriptor: existing.Descriptor, Inspect: inspect}
+		}
+	}
+	s.lock.RUnlock()
+
+	for _, img := range images {
+		err := fresh.addImage(img.Descriptor, img.Tags)
+		if err != nil {
+			slog.Warn("skipping image", "digest", img.Descriptor.Digest, "error", err)
+		}
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.images = fresh.images
+}
+
+// inspectManifest builds the metadata of an image from its manifest or index and config
+func (s *imageStore) inspectManifest(desc ociimage.Descriptor) (image.InspectResponse, error) {
+	manifest, err := s.readManifest(desc)
+	if err != nil {
+		return image.InspectResponse{}, err
+	}
+	if manifest.IsIndex() {
+		// Describe the image by the first platform that is present, as a daemon would describe it by its own
+		found := false
+		for _, child := range manifest.Index.Manifests {
+			childManifest, err := s.readManifest(child)
+			if err == nil && !childManifest.IsIndex() {
+				manifest = childManifest
+				found = true
+				break
+			}
+		}
+		if !found {
+			return image.InspectResponse{}, errdefs.InvalidParameter(fmt.Errorf("index %s has no platform manifests present", desc.Digest))
+		}
+	}
+	configJSON, err := s.readBlob(manifest.Manifest.Config.Digest)
+	if err != nil {
+		return image.InspectResponse{}, fmt.Errorf("reading config of %s: %w", desc.Digest, err)
+	}
+	var config ociimage.Image
+	err = json.Unmarshal(configJSON, &config)
+	if err != nil {
+		return image.InspectResponse{}, errdefs.InvalidParameter(fmt.Errorf("invalid config of %s: %w", desc.Digest, err))
+	}
+
+	inspect := image.InspectResponse{
+		ID:           desc.Digest.String(),
+		RepoTags:     []string{},
+		RepoDigests:  []string{},
+		Architecture: config.Architecture,
+		Variant:      config.Variant,
+		Os:           config.OS,
+		OsVersion:    config.OSVersion,
+		Author:       config.Author,
+		RootFS:       image.RootFS{Type: config.RootFS.Type},
+		Descriptor:   &ociimage.Descriptor{MediaType: desc.MediaType, Digest: desc.Digest, Size: desc.Size},
+	}
+	if config.Created != nil {
+		inspect.Created = config.Created.Format(time.RFC3339Nano)
+	}
+	for _, diffID := range config.RootFS.DiffIDs {
+		inspect.RootFS.Layers = append(inspect.RootFS.Layers, diffID.String())
+	}
+	for _, layer := range manifest.Manifest.Layers {
+		inspect.Size += layer.Size
+	}
+	return inspect, nil
+}
+
+// removeRef removes a tag from an image, removing the image if it was its last tag, or removes an image entirely
+// if referred to by ID or digest.
+// Returns the image if it was removed.
+func (s *imageStore) removeRef(ref string) (*storedImage, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	img, ok := s.resolve(ref)
+	if !ok {
+		return nil, errdefs.NotFound(fmt.Errorf("no such image: %s", ref))
+	}
+	if named, err := reference.ParseNormalizedNamed(ref); err == nil {
+		if _, isDigest := named.(reference.Canonical); !isDigest {
+			tag := reference.FamiliarString(reference.TagNameOnly(named))
+			img.Inspect.RepoTags = slices.DeleteFunc(img.Inspect.RepoTags, func(t string) bool { return t == tag })
+			if len(img.Inspect.RepoTags) != 0 {
+				return nil, nil
+			}
+		}
+	}
+	delete(s.images, img.Inspect.ID)
+	return img, nil
+}
+
+// loadArchive reads an OCI image layout tarball, storing its blobs with putBlob, and adds each image in its index,
+// tagged according to its annotations or the docker save manifest.json.
+func (s *imageStore) loadArchive(ctx context.Context, archive io.Reader, putBlob func(dgst godigest.Digest, content io.Reader) error) error {
+	index, dockerManifests, err := readOCIArchive(archive, putBlob)
+	if err != nil {
+		return errdefs.InvalidParameter(err)
+	}
+	images, err := s.archiveImages(ctx, index, dockerManifests)
+	if err != nil {
+		return err
+	}
+	for _, img := range images {
+		err = s.addImage(img.Descriptor, img.Tags)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// archiveImage is an image in the index of an OCI image layout tarball
+type archiveImage struct {
+	// Descriptor is the descriptor of the manifest or index of the image from the index
+	Descriptor ociimage.Descriptor
+	// Tags are the tags the image should be given when loaded
+	Tags []string
+}
+
+// archiveImages returns the images in the index of an OCI image layout tarball whose blobs have been stored,
+// with the tags given to them by their annotations or the docker save manifest.json.
+func (s *imageStore) archiveImages(ctx context.Context, index ociimage.Index, dockerManifests []dockerArchiveManifest) ([]archiveImage, error) {
+	images := make([]archiveImage, 0, len(index.Manifests))
+	for _, desc := range index.Manifests {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		tags := annotatedTags(desc)
+		manifest, err := s.readManifest(desc)
+		if err != nil {
+			return nil, err
+		}
+		if !manifest.IsIndex() {
+			for _, dockerManifest := range dockerManifests {
+				if dockerManifest.Config == archiveBlobPath(manifest.Manifest.Config.Digest) {
+					tags = append(tags, dockerManifest.RepoTags...)
+				}
+			}
+		}
+		images = append(images, archiveImage{Descriptor: desc, Tags: tags})
+	}
+	return images, nil
+}
+
+// annotatedTags returns the tags of an image in an OCI image layout given by the annotations of its descriptor.
+// The containerd image name annotation is a full reference, while the ref name annotation is usually just a tag,
+// and so is only used if it is a full reference.
+func annotatedTags(desc ociimage.Descriptor) []string {
+	var tags []string
+	for _, key := range []string{annotationImageName, ociimage.AnnotationRefName} {
+		name, ok := desc.Annotations[key]
+		if !ok {
+			continue
+		}
+		named, err := reference.ParseNormalizedNamed(name)
+		if err != nil {
+			continue
+		}
+		if _, ok := named.(reference.Tagged); ok {
+			tags = append(tags, name)
+		}
+	}
+	return tags
+}
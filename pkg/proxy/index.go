@@ -4,58 +4,128 @@ import (
 	"context"
 	"fmt"
 	"log/slog"
+	"slices"
 
-	"github.com/docker/docker/api/types/filters"
+	"github.com/distribution/reference"
 	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/errdefs"
 )
 
 // BuildIndex builds the blob to manifest index.
 // Docker only allows listing and retreiving images, not layers/blobs, so the proxy must maintain its own
 // index mapping blobs to manifests.
 // On startup, this index is empty, but calling BuildIndex will list all images with the provided prefixes
-// (or all images if no prefixes are provided), and build this index.
-// This is slow, however, any successful /v2/{name}/manifests/{reference} will also index that particular image,
-// so this call should only be needed if the API is used directly to fetch blobs without first obtaining a manifest.
+// (or all images if no prefixes are provided), and index their blobs without exporting them.
+// If the backend can read the manifest of an image directly, every blob it refers to is indexed by its digest, so
+// that blobs can be served without their manifest being fetched first. Otherwise, layers are indexed by their
+// diffID, along with the config and manifest if the daemon reports them, and layers stored compressed are indexed
+// by their digest once the manifest of their image is first fetched.
 func (r *Registry) BuildIndex(ctx context.Context) error {
-	r.indexLock.Lock()
-	defer r.indexLock.Unlock()
-	return r.buildIndex(ctx)
-}
-
-func (r *Registry) buildIndex(ctx context.Context) error {
-	if r.Prefixes == nil {
-		return r.buildIndexForPrefix(ctx, "")
+	// Images pulled by digest have no tags, so the daemon's reference filter would miss them
+	imgSums, err := r.Backend.ImageList(ctx)
+	if err != nil {
+		return fmt.Errorf("listing images: %w", err)
 	}
-	for prefix := range r.Prefixes {
-		err := r.buildIndexForPrefix(ctx, prefix)
+	for _, imgSum := range imgSums {
+		img, err := r.Backend.ImageInspect(ctx, imgSum.ID)
 		if err != nil {
-			return err
+			return fmt.Errorf("inspecting image %s: %w", imgSum.ID, err)
 		}
+		if !r.hasAllowedRef(&img) {
+			continue
+		}
+		r.indexLock.Lock()
+		r.addImageToIndex(&img, nil)
+		r.indexLock.Unlock()
+		r.indexBackendManifest(ctx, &img)
 	}
 	return nil
 }
 
-func (r *Registry) buildIndexForPrefix(ctx context.Context, prefix string) error {
-	imgSums, err := r.Docker.ImageList(ctx, image.ListOptions{Filters: filters.NewArgs(filters.KeyValuePair{"reference", prefix + "*:*"})})
-	if err != nil {
-		return fmt.Errorf("listing images with prefix %s: %w", prefix, err)
+// indexBackendManifest reads, caches, and indexes the manifest of an image if the backend can read it directly,
+// so that the blobs it refers to are indexed by their digest.
+// Nothing is done if the manifest is already cached, or could only be read by exporting the image.
+func (r *Registry) indexBackendManifest(ctx context.Context, img *image.InspectResponse) {
+	blobs, ok := r.Backend.(BlobBackend)
+	if !ok || img.Descriptor == nil {
+		return
 	}
-	for _, imgSum := range imgSums {
-		imgSum := imgSum
-		img, err := r.Docker.ImageInspect(ctx, imgSum.ID)
-		if err != nil {
-			return fmt.Errorf("inspecting image %s: %w", imgSum.ID, err)
-		}
-		r.addImageToIndex(&img)
+	if _, ok := r.getCachedManifest(img.ID); ok {
+		return
 	}
-	return nil
+	manifest, err := readBackendManifest(ctx, blobs, *img.Descriptor)
+	if errdefs.IsNotImplemented(err) {
+		return
+	}
+	if err != nil {
+		slog.Warn("failed to read manifest of image, indexing its layers by diffID", "imageID", img.ID, "error", err)
+		return
+	}
+	r.cacheManifest(img, manifest)
 }
 
-func (r *Registry) addImageToIndex(img *image.InspectResponse) {
+// addImageToIndex indexes the blobs of an image.
+// Layers are always indexed by their diffID, along with the manifest of the image if the daemon reports it, and
+// if the manifest of the image is known, the config, layers, and child manifests it refers to are indexed by their
+// digest, which differs from the diffID for compressed layers.
+// indexLock must be held.
+func (r *Registry) addImageToIndex(img *image.InspectResponse, manifest *cachedManifest) {
 	for _, blobID := range img.RootFS.Layers {
 		r.addBlobToIndex(blobID, img)
 	}
 	r.addBlobToIndex(img.ID, img)
+	if img.Descriptor != nil {
+		r.addBlobToIndex(string(img.Descriptor.Digest), img)
+	}
+	if manifest == nil {
+		return
+	}
+	r.addManifestToIndex(img, manifest)
+	for i := range manifest.Related {
+		r.addManifestToIndex(img, &manifest.Related[i])
+	}
+	// Only the manifest for the platform of the daemon will have layers matching the rootfs of the image,
+	// which is the only one present in most cases
+	if !manifest.IsIndex() {
+		r.addDiffIDs(img, manifest)
+	} else if len(manifest.Children) == 1 {
+		r.addDiffIDs(img, &manifest.Children[0])
+	}
+}
+
+func (r *Registry) addManifestToIndex(img *image.InspectResponse, manifest *cachedManifest) {
+	r.addBlobToIndex(string(manifest.Digest), img)
+	if manifest.IsIndex() {
+		for _, desc := range manifest.Index.Manifests {
+			r.addBlobToIndex(string(desc.Digest), img)
+		}
+		for i := range manifest.Children {
+			r.addManifestToIndex(img, &manifest.Children[i])
+		}
+		return
+	}
+	r.addBlobToIndex(string(manifest.Manifest.Config.Digest), img)
+	for _, layer := range manifest.Manifest.Layers {
+		r.addBlobToIndex(string(layer.Digest), img)
+	}
+}
+
+// addDiffIDs records the digest of each layer of a manifest by the diffID of the corresponding layer of the image
+func (r *Registry) addDiffIDs(img *image.InspectResponse, manifest *cachedManifest) {
+	if len(manifest.Manifest.Layers) != len(img.RootFS.Layers) {
+		return
+	}
+	for i, diffID := range img.RootFS.Layers {
+		r.diffIDs[diffID] = string(manifest.Manifest.Layers[i].Digest)
+	}
+}
+
+// layerForDiffID returns the digest of the layer with the given diffID, if known
+func (r *Registry) layerForDiffID(diffID string) (string, bool) {
+	r.indexLock.RLock()
+	defer r.indexLock.RUnlock()
+	digest, ok := r.diffIDs[diffID]
+	return digest, ok
 }
 
 func (r *Registry) addBlobToIndex(blobID string, img *image.InspectResponse) {
@@ -67,3 +137,114 @@ func (r *Registry) addBlobToIndex(blobID string, img *image.InspectResponse) {
 	imgs[img.ID] = img
 	slog.Info("indexed layer", "blobID", blobID, "imageID", img.ID)
 }
+
+// normalizeRepoName returns the fully-qualified name of the repository of an image reference as reported by the
+// daemon or requested by a client, such as docker.io/library/alpine for alpine:latest or alpine@sha256:...
+func normalizeRepoName(ref string) (string, bool) {
+	named, err := reference.ParseNormalizedNamed(ref)
+	if err != nil {
+		return "", false
+	}
+	return named.Name(), true
+}
+
+// sameRepo returns true if an image reference as reported by the daemon belongs to the given repository
+func sameRepo(ref, name string) bool {
+	refRepo, ok := normalizeRepoName(ref)
+	if !ok {
+		return false
+	}
+	nameRepo, ok := normalizeRepoName(name)
+	return ok && refRepo == nameRepo
+}
+
+// repoTagsIn returns the tags of an image, as reported by the daemon, which belong to the given repository
+func repoTagsIn(img *image.InspectResponse, name string) []string {
+	var tags []string
+	for _, tag := range img.RepoTags {
+		if sameRepo(tag, name) {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// tagIn returns the tag of an image reference as reported by the daemon, if it belongs to the given repository
+func tagIn(ref, name string) (string, bool) {
+	named, err := reference.ParseNormalizedNamed(ref)
+	if err != nil || !sameRepo(ref, name) {
+		return "", false
+	}
+	tagged, ok := named.(reference.Tagged)
+	if !ok {
+		return "", false
+	}
+	return tagged.Tag(), true
+}
+
+// inRepo returns true if an image has a tag or digest in the given repository, as images that were pulled by
+// digest have no tags
+func inRepo(img *image.InspectResponse, name string) bool {
+	return refsInRepo(slices.Concat(img.RepoTags, img.RepoDigests), name)
+}
+
+// refsInRepo returns true if any of the image references, as reported by the daemon, belong to the given repository
+func refsInRepo(refs []string, name string) bool {
+	for _, ref := range refs {
+		if sameRepo(ref, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// findImageByRepoDigest returns the image in the given repository which was pulled with the given manifest digest.
+// Returns a not found error if there is no such image.
+func (r *Registry) findImageByRepoDigest(ctx context.Context, name, digest string) (*image.InspectResponse, error) {
+	imgSums, err := r.Backend.ImageList(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("listing images: %w", err)
+	}
+	for _, imgSum := range imgSums {
+		for _, repoDigest := range imgSum.RepoDigests {
+			named, err := reference.ParseNormalizedNamed(repoDigest)
+			if err != nil || !sameRepo(repoDigest, name) {
+				continue
+			}
+			canonical, ok := named.(reference.Canonical)
+			if !ok || canonical.Digest().String() != digest {
+				continue
+			}
+			img, err := r.Backend.ImageInspect(ctx, imgSum.ID)
+			if err != nil {
+				return nil, fmt.Errorf("inspecting image %s: %w", imgSum.ID, err)
+			}
+			return &img, nil
+		}
+	}
+	return nil, errdefs.NotFound(fmt.Errorf("no image in %s has digest %s", name, digest))
+}
+
+// forgetImage removes an image from the index and cache, such as after it has been removed from the daemon.
+// Both indexLock and cacheLock must be held.
+func (r *Registry) forgetImage(imgID string) {
+	delete(r.manifestCache, imgID)
+	for digest, indexed := range r.manifestDigests {
+		if indexed.Image.ID == imgID {
+			delete(r.manifestDigests, digest)
+		}
+	}
+	for blobID, imgs := range r.blobIndex {
+		delete(imgs, imgID)
+		if len(imgs) == 0 {
+			delete(r.blobIndex, blobID)
+		}
+	}
+	// Layers shared with other images are still indexed by their diffID
+	for diffID := range r.diffIDs {
+		if _, ok := r.blobIndex[diffID]; !ok {
+			delete(r.diffIDs, diffID)
+		}
+	}
+	slog.Info("forgot image", "imageID", imgID)
+}
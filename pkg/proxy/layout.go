@@ -0,0 +1,475 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/distribution/reference"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/errdefs"
+
+	godigest "github.com/opencontainers/go-digest"
+	ociimage "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// layoutPollInterval is how often the index of an OCI image layout is checked for changes made by other tools
+const layoutPollInterval = 5 * time.Second
+
+// LayoutBackend serves images from an OCI image layout directory, such as those written by buildkit or skopeo.
+// Images are tagged by the org.opencontainers.image.ref.name annotations of their descriptors in the index of the
+// layout. As that annotation is usually only a tag, those images are placed in a single repository, unless the
+// descriptor also has the io.containerd.image.name annotation, or the ref name is a full reference.
+// Pushed images are written into the layout, and changes made to the layout by other tools are picked up the next
+// time it is read.
+type LayoutBackend struct {
+	// dir is the root of the layout
+	dir string
+	// repository is the repository of images whose ref name annotation is only a tag
+	repository reference.Named
+
+	// lock must be held when using the fields below, and held for writing when writing the index of the layout
+	lock sync.RWMutex
+	// images are the images in the index of the layout as it was last read or written
+	images *imageStore
+	// index is the index of the layout as it was last read or written
+	index ociimage.Index
+	// indexModTime is the modification time of the index file when it was last read or written
+	indexModTime time.Time
+}
+
+var _ WatchingBackend = &LayoutBackend{}
+var _ BlobStoringBackend = &LayoutBackend{}
+
+// NewLayoutBackend returns a backend serving the OCI image layout in dir, creating an empty layout if there is
+// none. Images tagged by only a tag are placed in repository, or in a repository named after dir if it is empty.
+func NewLayoutBackend(dir, repository string) (*LayoutBackend, error) {
+	if repository == "" {
+		absDir, err := filepath.Abs(dir)
+		if err != nil {
+			return nil, err
+		}
+		repository = filepath.Base(absDir)
+	}
+	named, err := reference.ParseNormalizedNamed(repository)
+	if err != nil {
+		return nil, fmt.Errorf("invalid repository %s for OCI image layout %s: %w", repository, dir, err)
+	}
+	if !reference.IsNameOnly(named) {
+		return nil, fmt.Errorf("invalid repository %s for OCI image layout %s: must not have a tag or digest", repository, dir)
+	}
+	b := &LayoutBackend{dir: dir, repository: named}
+	err = b.init()
+	if err != nil {
+		return nil, fmt.Errorf("initializing OCI image layout %s: %w", dir, err)
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	err = b.readIndex()
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// init creates the files of an empty layout which are missing
+func (b *LayoutBackend) init() error {
+	err := os.MkdirAll(filepath.Join(b.dir, ociimage.ImageBlobsDir), 0o755)
+	if err != nil {
+		return err
+	}
+	layoutPath := filepath.Join(b.dir, ociimage.ImageLayoutFile)
+	_, err = os.Stat(layoutPath)
+	if errors.Is(err, os.ErrNotExist) {
+		layoutJSON, err := json.Marshal(ociimage.ImageLayout{Version: ociimage.ImageLayoutVersion})
+		if err != nil {
+			return err
+		}
+		err = os.WriteFile(layoutPath, layoutJSON, 0o644)
+		if err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+	_, err = os.Stat(b.indexPath())
+	if errors.Is(err, os.ErrNotExist) {
+		b.lock.Lock()
+		defer b.lock.Unlock()
+		return b.writeIndex()
+	}
+	return err
+}
+
+func (b *LayoutBackend) indexPath() string {
+	return filepath.Join(b.dir, ociimage.ImageIndexFile)
+}
+
+func (b *LayoutBackend) blobPath(dgst godigest.Digest) string {
+	return filepath.Join(b.dir, ociimage.ImageBlobsDir, dgst.Algorithm().String(), dgst.Encoded())
+}
+
+// current returns the images in the layout, reading its index again if it has changed since it was last read
+func (b *LayoutBackend) current() (*imageStore, error) {
+	info, err := os.Stat(b.indexPath())
+	if err != nil {
+		return nil, fmt.Errorf("reading OCI image layout index: %w", err)
+	}
+	b.lock.RLock()
+	images, unchanged := b.images, info.ModTime().Equal(b.indexModTime)
+	b.lock.RUnlock()
+	if unchanged {
+		return images, nil
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	err = b.readIndex()
+	if err != nil {
+		return nil, err
+	}
+	return b.images, nil
+}
+
+// readIndex reads the index of the layout and the images in it.
+// Images which cannot be read are skipped, as other tools may be partway through writing them.
+// lock must be held for writing.
+func (b *LayoutBackend) readIndex() error {
+	info, err := os.Stat(b.indexPath())
+	if err != nil {
+		return fmt.Errorf("reading OCI image layout index: %w", err)
+	}
+	indexJSON, err := os.ReadFile(b.indexPath())
+	if err != nil {
+		return fmt.Errorf("reading OCI image layout index: %w", err)
+	}
+	var index ociimage.Index
+	err = json.Unmarshal(indexJSON, &index)
+	if err != nil {
+		return fmt.Errorf("invalid OCI image layout index: %w", err)
+	}
+	images := newImageStore(b)
+	for _, desc := range index.Manifests {
+		err := images.addImage(desc, b.layoutTags(desc))
+		if err != nil {
+			slog.Warn("skipping image in OCI image layout", "dir", b.dir, "digest", desc.Digest, "error", err)
+		}
+	}
+	b.index = index
+	b.images = images
+	b.indexModTime = info.ModTime()
+	return nil
+}
+
+// writeIndex replaces the index of the layout, then reads it back.
+// lock must be held for writing.
+func (b *LayoutBackend) writeIndex() error {
+	index := b.index
+	index.SchemaVersion = 2
+	if index.MediaType == "" {
+		index.MediaType = ociimage.MediaTypeImageIndex
+	}
+	if index.Manifests == nil {
+		index.Manifests = []ociimage.Descriptor{}
+	}
+	indexJSON, err := json.Marshal(&index)
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file first so that other tools never see a partially written index
+	f, err := os.CreateTemp(b.dir, ".index-")
+	if err != nil {
+		return fmt.Errorf("writing OCI image layout index: %w", err)
+	}
+	_, err = f.Write(indexJSON)
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), 0o644)
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), b.indexPath())
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("writing OCI image layout index: %w", err)
+	}
+	return b.readIndex()
+}
+
+// layoutTags returns the normalized tags given to an image by its descriptor in the index of the layout
+func (b *LayoutBackend) layoutTags(desc ociimage.Descriptor) []string {
+	var tags []string
+	for _, tag := range annotatedTags(desc) {
+		if named, err := reference.ParseNormalizedNamed(tag); err == nil {
+			tags = append(tags, reference.TagNameOnly(named).String())
+		}
+	}
+	if len(tags) != 0 {
+		return tags
+	}
+	refName, ok := desc.Annotations[ociimage.AnnotationRefName]
+	if !ok {
+		return nil
+	}
+	tagged, err := reference.WithTag(b.repository, refName)
+	if err != nil {
+		return nil
+	}
+	return []string{tagged.String()}
+}
+
+// indexImage adds an image to the index of the layout with a descriptor for each of its tags, moving those tags
+// from any other image.
+// lock must be held for writing.
+func (b *LayoutBackend) indexImage(img archiveImage) error {
+	tags := make([]string, 0, len(img.Tags))
+	for _, tag := range img.Tags {
+		named, err := reference.ParseNormalizedNamed(tag)
+		if err != nil {
+			return errdefs.InvalidParameter(fmt.Errorf("invalid tag %s: %w", tag, err))
+		}
+		tag = reference.TagNameOnly(named).String()
+		if !slices.Contains(tags, tag) {
+			tags = append(tags, tag)
+		}
+	}
+
+	desc := img.Descriptor
+	var annotations map[string]string
+	for k, v := range desc.Annotations {
+		if k == annotationImageName || k == ociimage.AnnotationRefName {
+			continue
+		}
+		if annotations == nil {
+			annotations = make(map[string]string, len(desc.Annotations))
+		}
+		annotations[k] = v
+	}
+	desc.Annotations = annotations
+
+	if len(tags) == 0 {
+		// An untagged image only needs to be added if it is not already in the index
+		if !slices.ContainsFunc(b.index.Manifests, func(existing ociimage.Descriptor) bool { return existing.Digest == desc.Digest }) {
+			b.index.Manifests = append(b.index.Manifests, desc)
+		}
+		return nil
+	}
+
+	b.index.Manifests = slices.DeleteFunc(b.index.Manifests, func(existing ociimage.Descriptor) bool {
+		existingTags := b.layoutTags(existing)
+		if len(existingTags) == 0 {
+			return existing.Digest == desc.Digest
+		}
+		return slices.ContainsFunc(existingTags, func(tag string) bool { return slices.Contains(tags, tag) })
+	})
+	for _, tag := range tags {
+		tagged := desc
+		tagged.Annotations = tagAnnotations(desc.Annotations, tag)
+		b.index.Manifests = append(b.index.Manifests, tagged)
+	}
+	return nil
+}
+
+func (b *LayoutBackend) openBlob(dgst godigest.Digest) (io.ReadCloser, int64, error) {
+	if err := dgst.Validate(); err != nil {
+		return nil, 0, errdefs.InvalidParameter(err)
+	}
+	f, err := os.Open(b.blobPath(dgst))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, 0, errdefs.NotFound(fmt.Errorf("no such blob: %s", dgst))
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, info.Size(), nil
+}
+
+func (b *LayoutBackend) BlobOpen(_ context.Context, dgst godigest.Digest) (io.ReadCloser, int64, error) {
+	return b.openBlob(dgst)
+}
+
+// putBlob writes a blob into the layout if it is not already present
+func (b *LayoutBackend) putBlob(dgst godigest.Digest, content io.Reader) error {
+	blobPath := b.blobPath(dgst)
+	_, err := os.Stat(blobPath)
+	if err == nil {
+		return nil
+	}
+	err = os.MkdirAll(filepath.Dir(blobPath), 0o755)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(blobPath), ".tmp-"+dgst.Encoded()+"-")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, content)
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), 0o444)
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), blobPath)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return nil
+}
+
+func (b *LayoutBackend) ImageList(_ context.Context) ([]image.Summary, error) {
+	images, err := b.current()
+	if err != nil {
+		return nil, err
+	}
+	return images.list(), nil
+}
+
+func (b *LayoutBackend) ImageInspect(_ context.Context, ref string) (image.InspectResponse, error) {
+	images, err := b.current()
+	if err != nil {
+		return image.InspectResponse{}, err
+	}
+	return images.inspect(ref)
+}
+
+func (b *LayoutBackend) ImageSave(_ context.Context, imgID string) (io.ReadCloser, error) {
+	images, err := b.current()
+	if err != nil {
+		return nil, err
+	}
+	return images.save(imgID)
+}
+
+// BlobDir returns the blobs directory of the layout, so that pushed blobs are written into it directly
+func (b *LayoutBackend) BlobDir() string {
+	return filepath.Join(b.dir, ociimage.ImageBlobsDir)
+}
+
+// ImageLoad writes the blobs of an OCI image layout tarball into the layout, and adds its images to the index
+func (b *LayoutBackend) ImageLoad(ctx context.Context, archive io.Reader) error {
+	index, dockerManifests, err := readOCIArchive(archive, b.putBlob)
+	if err != nil {
+		return errdefs.InvalidParameter(err)
+	}
+	return b.addImages(ctx, index, dockerManifests)
+}
+
+// ImagePut adds an image whose blobs have already been written into the layout to the index
+func (b *LayoutBackend) ImagePut(ctx context.Context, desc ociimage.Descriptor) error {
+	return b.addImages(ctx, ociimage.Index{Manifests: []ociimage.Descriptor{desc}}, nil)
+}
+
+// addImages adds the images in the index of an OCI image layout tarball, whose blobs are in the layout, to the
+// index of the layout
+func (b *LayoutBackend) addImages(ctx context.Context, index ociimage.Index, dockerManifests []dockerArchiveManifest) error {
+	images, err := b.current()
+	if err != nil {
+		return err
+	}
+	loaded, err := images.archiveImages(ctx, index, dockerManifests)
+	if err != nil {
+		return err
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for _, img := range loaded {
+		err = b.indexImage(img)
+		if err != nil {
+			return err
+		}
+	}
+	return b.writeIndex()
+}
+
+// ImageRemove removes the descriptors of a tag from the index of the layout, or every descriptor of an image if
+// referred to by ID or digest.
+// Blobs are kept, as other tools may be sharing the layout.
+func (b *LayoutBackend) ImageRemove(_ context.Context, ref string) error {
+	images, err := b.current()
+	if err != nil {
+		return err
+	}
+	img, err := images.inspect(ref)
+	if err != nil {
+		return err
+	}
+	var tag string
+	if ref != img.ID {
+		named, err := reference.ParseNormalizedNamed(ref)
+		if err != nil {
+			return errdefs.InvalidParameter(err)
+		}
+		if _, isDigest := named.(reference.Canonical); !isDigest {
+			tag = reference.TagNameOnly(named).String()
+		}
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.index.Manifests = slices.DeleteFunc(b.index.Manifests, func(desc ociimage.Descriptor) bool {
+		if tag == "" {
+			return desc.Digest.String() == img.ID
+		}
+		return slices.Contains(b.layoutTags(desc), tag)
+	})
+	return b.writeIndex()
+}
+
+// ImageEvents reports changes to the images in the layout, including those made by other tools, by checking its
+// index for changes periodically.
+// Events are only reported for changes made after it is called, so since is ignored.
+func (b *LayoutBackend) ImageEvents(ctx context.Context, _ time.Time) (<-chan events.Message, <-chan error) {
+	msgs := make(chan events.Message)
+	errs := make(chan error, 1)
+	b.lock.RLock()
+	seen := b.images.list()
+	b.lock.RUnlock()
+	go func() {
+		ticker := time.NewTicker(layoutPollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				errs <- ctx.Err()
+				return
+			case <-ticker.C:
+			}
+			images, err := b.current()
+			if err != nil {
+				slog.Warn("failed to check OCI image layout for changes", "dir", b.dir, "error", err)
+				continue
+			}
+			latest := images.list()
+			for _, msg := range imageChangeEvents(seen, latest) {
+				select {
+				case msgs <- msg:
+				case <-ctx.Done():
+					errs <- ctx.Err()
+					return
+				}
+			}
+			seen = latest
+		}
+	}()
+	return msgs, errs
+}
@@ -0,0 +1,206 @@
+package proxy_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+
+	"github.com/meln5674/oci-reg-docker/pkg/proxy"
+	godigest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go"
+	ociimage "github.com/opencontainers/image-spec/specs-go/v1"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// writeLayoutBlob writes a blob into an OCI image layout directory
+func writeLayoutBlob(dir string, content []byte) {
+	dgst := godigest.FromBytes(content)
+	blobDir := filepath.Join(dir, ociimage.ImageBlobsDir, dgst.Algorithm().String())
+	Expect(os.MkdirAll(blobDir, 0o755)).To(Succeed())
+	Expect(os.WriteFile(filepath.Join(blobDir, dgst.Encoded()), content, 0o644)).To(Succeed())
+}
+
+// readLayoutIndex reads the index of an OCI image layout directory
+func readLayoutIndex(dir string) ociimage.Index {
+	indexJSON, err := os.ReadFile(filepath.Join(dir, ociimage.ImageIndexFile))
+	Expect(err).ToNot(HaveOccurred())
+	var index ociimage.Index
+	Expect(json.Unmarshal(indexJSON, &index)).To(Succeed())
+	return index
+}
+
+var _ = Describe("LayoutBackend", func() {
+	itServesPushedImages(func() proxy.Backend {
+		backend, err := proxy.NewLayoutBackend(GinkgoT().TempDir(), "test/layout")
+		Expect(err).ToNot(HaveOccurred())
+		return backend
+	})
+
+	When("a layout was written by another tool", func() {
+		var dir string
+		var img testImage
+		BeforeEach(func() {
+			dir = filepath.Join(GinkgoT().TempDir(), "prebuilt")
+			img = newTestImage("prebuilt layer")
+			for _, blob := range [][]byte{img.Layer, img.Config, img.Manifest} {
+				writeLayoutBlob(dir, blob)
+			}
+			layoutJSON, err := json.Marshal(ociimage.ImageLayout{Version: ociimage.ImageLayoutVersion})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(os.WriteFile(filepath.Join(dir, ociimage.ImageLayoutFile), layoutJSON, 0o644)).To(Succeed())
+			indexJSON, err := json.Marshal(ociimage.Index{
+				MediaType: ociimage.MediaTypeImageIndex,
+				Manifests: []ociimage.Descriptor{
+					{
+						MediaType:   ociimage.MediaTypeImageManifest,
+						Digest:      img.Digest,
+						Size:        int64(len(img.Manifest)),
+						Annotations: map[string]string{ociimage.AnnotationRefName: "v1"},
+					},
+					{
+						MediaType:   ociimage.MediaTypeImageManifest,
+						Digest:      img.Digest,
+						Size:        int64(len(img.Manifest)),
+						Annotations: map[string]string{ociimage.AnnotationRefName: "example.com/other/app:v2"},
+					},
+				},
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(os.WriteFile(filepath.Join(dir, ociimage.ImageIndexFile), indexJSON, 0o644)).To(Succeed())
+		})
+
+		It("should serve images tagged only by ref name in the repository named after the layout", func(ctx context.Context) {
+			backend, err := proxy.NewLayoutBackend(dir, "")
+			Expect(err).ToNot(HaveOccurred())
+			client := startRegistry(ctx, backend)
+
+			resp := client.do(ctx, http.MethodGet, "/v2/prebuilt/manifests/v1", nil)
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			Expect(readBody(resp)).To(Equal(img.Manifest))
+
+			resp = client.do(ctx, http.MethodGet, "/v2/prebuilt/blobs/"+img.LayerDigest.String(), nil)
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			Expect(readBody(resp)).To(Equal(img.Layer))
+		})
+
+		It("should serve images whose ref name is a full reference in that repository", func(ctx context.Context) {
+			backend, err := proxy.NewLayoutBackend(dir, "")
+			Expect(err).ToNot(HaveOccurred())
+			client := startRegistry(ctx, backend)
+
+			resp := client.do(ctx, http.MethodGet, "/v2/example.com/other/app/manifests/v2", nil)
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			Expect(readBody(resp)).To(Equal(img.Manifest))
+		})
+
+		It("should write pushed images into the layout", func(ctx context.Context) {
+			backend, err := proxy.NewLayoutBackend(dir, "")
+			Expect(err).ToNot(HaveOccurred())
+			client := startRegistry(ctx, backend)
+			pushed := newTestImage("pushed layer")
+			client.push(ctx, "prebuilt", "v1", pushed)
+
+			for _, dgst := range []godigest.Digest{pushed.LayerDigest, pushed.ConfigDigest, pushed.Digest} {
+				Expect(filepath.Join(dir, ociimage.ImageBlobsDir, dgst.Algorithm().String(), dgst.Encoded())).To(BeAnExistingFile())
+			}
+			index := readLayoutIndex(dir)
+			Expect(index.Manifests).To(HaveLen(2))
+			Expect(index.Manifests[0].Digest).To(Equal(img.Digest))
+			Expect(index.Manifests[0].Annotations).To(HaveKeyWithValue(ociimage.AnnotationRefName, "example.com/other/app:v2"))
+			Expect(index.Manifests[1].Digest).To(Equal(pushed.Digest))
+			Expect(index.Manifests[1].Annotations).To(HaveKeyWithValue(ociimage.AnnotationRefName, "v1"))
+
+			reopened, err := proxy.NewLayoutBackend(dir, "")
+			Expect(err).ToNot(HaveOccurred())
+			inspect, err := reopened.ImageInspect(ctx, "prebuilt:v1")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(inspect.ID).To(Equal(pushed.Digest.String()))
+		})
+
+		It("should upload blobs directly into the layout", func(ctx context.Context) {
+			backend, err := proxy.NewLayoutBackend(dir, "")
+			Expect(err).ToNot(HaveOccurred())
+			uploadDir := filepath.Join(GinkgoT().TempDir(), "uploads")
+			reg := proxy.New(proxy.Config{Backend: backend, UploadDir: uploadDir})
+			Expect(reg.BuildIndex(ctx)).To(Succeed())
+			srv := httptest.NewServer(reg.BuildHandler())
+			DeferCleanup(srv.Close)
+			client := registryClient{srv: srv}
+
+			pushed := newTestImage("uploaded layer")
+			resp := client.do(ctx, http.MethodPost, "/v2/prebuilt/blobs/uploads/?digest="+pushed.LayerDigest.String(), pushed.Layer)
+			Expect(resp.StatusCode).To(Equal(http.StatusCreated))
+			layerPath := filepath.Join(dir, ociimage.ImageBlobsDir, pushed.LayerDigest.Algorithm().String(), pushed.LayerDigest.Encoded())
+			Expect(os.ReadFile(layerPath)).To(Equal(pushed.Layer))
+
+			client.push(ctx, "prebuilt", "v2", pushed)
+			Expect(filepath.Join(uploadDir, "blobs")).ToNot(BeADirectory())
+			resp = client.do(ctx, http.MethodGet, "/v2/prebuilt/manifests/v2", nil)
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			Expect(readBody(resp)).To(Equal(pushed.Manifest))
+		})
+
+		It("should pick up changes to the layout made by other tools", func(ctx context.Context) {
+			backend, err := proxy.NewLayoutBackend(dir, "")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(os.WriteFile(filepath.Join(dir, ociimage.ImageIndexFile), []byte(`{"schemaVersion":2,"manifests":[]}`), 0o644)).To(Succeed())
+
+			images, err := backend.ImageList(ctx)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(images).To(BeEmpty())
+		})
+	})
+	When("an image index is pushed", func() {
+		var client registryClient
+		BeforeEach(func(ctx context.Context) {
+			backend, err := proxy.NewLayoutBackend(GinkgoT().TempDir(), "")
+			Expect(err).ToNot(HaveOccurred())
+			client = startRegistry(ctx, backend)
+		})
+
+		It("should serve it once its manifests have been pushed", func(ctx context.Context) {
+			amd64 := newTestImage("amd64 layer")
+			arm64 := newTestImage("arm64 layer")
+			client.push(ctx, "test/app", amd64.Digest.String(), amd64)
+			client.push(ctx, "test/app", arm64.Digest.String(), arm64)
+			indexJSON := mustMarshal(ociimage.Index{
+				Versioned: ocispec.Versioned{SchemaVersion: 2},
+				MediaType: ociimage.MediaTypeImageIndex,
+				Manifests: []ociimage.Descriptor{
+					{MediaType: ociimage.MediaTypeImageManifest, Digest: amd64.Digest, Size: int64(len(amd64.Manifest)), Platform: &ociimage.Platform{Architecture: "amd64", OS: "linux"}},
+					{MediaType: ociimage.MediaTypeImageManifest, Digest: arm64.Digest, Size: int64(len(arm64.Manifest)), Platform: &ociimage.Platform{Architecture: "arm64", OS: "linux"}},
+				},
+			})
+
+			resp := client.do(ctx, http.MethodPut, "/v2/test/app/manifests/v1", indexJSON, "Content-Type", ociimage.MediaTypeImageIndex)
+			Expect(resp.StatusCode).To(Equal(http.StatusCreated), string(readBody(resp)))
+			Expect(resp.Header.Get("Docker-Content-Digest")).To(Equal(godigest.FromBytes(indexJSON).String()))
+
+			resp = client.do(ctx, http.MethodGet, "/v2/test/app/manifests/v1", nil)
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			Expect(resp.Header.Get("Content-Type")).To(Equal(ociimage.MediaTypeImageIndex))
+			Expect(readBody(resp)).To(Equal(indexJSON))
+
+			resp = client.do(ctx, http.MethodGet, "/v2/test/app/manifests/"+arm64.Digest.String(), nil)
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			Expect(readBody(resp)).To(Equal(arm64.Manifest))
+		})
+
+		It("should reject it if one of its manifests has not been pushed", func(ctx context.Context) {
+			missing := newTestImage("missing layer")
+			indexJSON := mustMarshal(ociimage.Index{
+				Versioned: ocispec.Versioned{SchemaVersion: 2},
+				MediaType: ociimage.MediaTypeImageIndex,
+				Manifests: []ociimage.Descriptor{{MediaType: ociimage.MediaTypeImageManifest, Digest: missing.Digest, Size: int64(len(missing.Manifest))}},
+			})
+
+			resp := client.do(ctx, http.MethodPut, "/v2/test/app/manifests/v1", indexJSON, "Content-Type", ociimage.MediaTypeImageIndex)
+			expectErrorCode(resp, http.StatusBadRequest, "MANIFEST_BLOB_UNKNOWN")
+		})
+	})
+})
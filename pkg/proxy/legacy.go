@@ -0,0 +1,151 @@
+package proxy
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"path"
+	"strings"
+
+	godigest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go"
+	ociimage "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// readLegacyFile records the digest and size of a file outside of the blobs directory of a saved image tarball.
+// Daemons older than Docker 25, and those using the classic graphdriver store, export images as a manifest.json
+// referring to <id>/layer.tar files and <id>.json configs, which are not named by their digest,
+// so every such file must be hashed to build a manifest from them.
+// Each layer and config is also added to cache, which may be nil.
+func (s *savedImage) readLegacyFile(h *tar.Header, content io.Reader, cache *blobCache) error {
+	switch h.Typeflag {
+	case tar.TypeSymlink:
+		s.legacyLinks[h.Name] = path.Join(path.Dir(h.Name), h.Linkname)
+		return nil
+	case tar.TypeLink:
+		s.legacyLinks[h.Name] = h.Linkname
+		return nil
+	case tar.TypeReg:
+	default:
+		return nil
+	}
+
+	digester := godigest.Canonical.Digester()
+	var buf bytes.Buffer
+	w := io.Writer(digester.Hash())
+	if h.Size <= smallBlobCap {
+		w = io.MultiWriter(w, &buf)
+	}
+	var cacheWriter *blobCacheWriter
+	if isLegacyBlobFile(h.Name) {
+		var err error
+		cacheWriter, err = cache.NewWriter("")
+		if err != nil {
+			slog.Warn("failed to cache blob", "path", h.Name, "error", err)
+			cacheWriter = nil
+		}
+	}
+	if cacheWriter != nil {
+		w = io.MultiWriter(w, cacheWriter)
+	}
+	n, err := io.Copy(w, content)
+	if err != nil {
+		cacheWriter.Discard()
+		return fmt.Errorf("reading %s from upstream tarball: %w", h.Name, err)
+	}
+	_, err = cacheWriter.Commit()
+	if err != nil {
+		slog.Warn("failed to cache blob", "path", h.Name, "error", err)
+	}
+	desc := ociimage.Descriptor{Digest: digester.Digest(), Size: n}
+	s.LegacyFiles[h.Name] = desc
+	if h.Size <= smallBlobCap {
+		s.SmallBlobs[string(desc.Digest)] = buf.Bytes()
+	}
+	return nil
+}
+
+// isLegacyBlobFile returns true if a file outside of the blobs directory of a tarball exported by a daemon older
+// than Docker 25 is a layer or config, rather than metadata such as the repositories file or the json and VERSION
+// files of each layer
+func isLegacyBlobFile(name string) bool {
+	if path.Base(name) == "layer.tar" {
+		return true
+	}
+	return path.Dir(name) == "." && strings.HasSuffix(name, ".json") && name != dockerArchiveManifestFile
+}
+
+// legacyFile returns the descriptor and actual path of a file outside of the blobs directory, following links
+func (s *savedImage) legacyFile(name string) (ociimage.Descriptor, string, bool) {
+	// Bound the number of links followed in case of a cycle
+	for range 16 {
+		if desc, ok := s.LegacyFiles[name]; ok {
+			return desc, name, true
+		}
+		target, ok := s.legacyLinks[name]
+		if !ok {
+			return ociimage.Descriptor{}, "", false
+		}
+		name = target
+	}
+	return ociimage.Descriptor{}, "", false
+}
+
+// legacyManifest builds an OCI image manifest for an image from the manifest.json of a saved image tarball.
+// Layers in this format are uncompressed, so their digests are the same as their diffIDs.
+func (s *savedImage) legacyManifest(imgID string) (manifest cachedManifest, err error) {
+	for _, dockerManifest := range s.DockerManifests {
+		configDesc, configPath, ok := s.legacyFile(dockerManifest.Config)
+		if !ok {
+			err = fmt.Errorf("daemon save tarball did not contain config %s", dockerManifest.Config)
+			return
+		}
+		if string(configDesc.Digest) != imgID {
+			continue
+		}
+
+		ociManifest := ociimage.Manifest{
+			Versioned: ocispec.Versioned{SchemaVersion: 2},
+			MediaType: ociimage.MediaTypeImageManifest,
+			Config: ociimage.Descriptor{
+				MediaType: ociimage.MediaTypeImageConfig,
+				Digest:    configDesc.Digest,
+				Size:      configDesc.Size,
+			},
+			Layers: make([]ociimage.Descriptor, 0, len(dockerManifest.Layers)),
+		}
+		blobPaths := map[string]string{string(configDesc.Digest): configPath}
+		for _, layer := range dockerManifest.Layers {
+			layerDesc, layerPath, ok := s.legacyFile(layer)
+			if !ok {
+				err = fmt.Errorf("daemon save tarball did not contain layer %s", layer)
+				return
+			}
+			ociManifest.Layers = append(ociManifest.Layers, ociimage.Descriptor{
+				MediaType: ociimage.MediaTypeImageLayer,
+				Digest:    layerDesc.Digest,
+				Size:      layerDesc.Size,
+			})
+			blobPaths[string(layerDesc.Digest)] = layerPath
+		}
+
+		var manifestJSON []byte
+		manifestJSON, err = json.Marshal(&ociManifest)
+		if err != nil {
+			return
+		}
+		manifest = cachedManifest{
+			JSON:      json.RawMessage(manifestJSON),
+			MediaType: ociimage.MediaTypeImageManifest,
+			Digest:    godigest.FromBytes(manifestJSON),
+			Manifest:  ociManifest,
+			BlobPaths: blobPaths,
+		}
+		return
+	}
+	err = fmt.Errorf("upstream tarball did not contain expected config with ID %s", imgID)
+	return
+}
@@ -9,74 +9,261 @@ import (
 	"fmt"
 	"io"
 	"log/slog"
+	"slices"
 	"strings"
 
 	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/errdefs"
 
+	godigest "github.com/opencontainers/go-digest"
 	ociimage "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
+const (
+	// mediaTypeDockerManifest is the media type of a docker image manifest, which is structurally identical
+	// to an OCI image manifest
+	mediaTypeDockerManifest = "application/vnd.docker.distribution.manifest.v2+json"
+	// mediaTypeDockerManifestList is the media type of a docker manifest list, which is structurally identical
+	// to an OCI image index
+	mediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+)
+
+func isIndexMediaType(mediaType string) bool {
+	return mediaType == ociimage.MediaTypeImageIndex || mediaType == mediaTypeDockerManifestList
+}
+
 type cachedManifest struct {
-	JSON     json.RawMessage
+	JSON json.RawMessage
+	// MediaType is the media type to serve JSON as
+	MediaType string
+	// Digest is the digest of JSON
+	Digest godigest.Digest
+	// Manifest is the parsed manifest, if JSON is an image manifest
 	Manifest ociimage.Manifest
+	// Index is the parsed index, if JSON is an image index or manifest list
+	Index ociimage.Index
+	// Children are the manifests referred to by Index which were present in the daemon
+	Children []cachedManifest
+	// Related are any other manifests in the exported tarball, such as attestations, which are not part of this
+	// manifest, but can be fetched by digest in the same repository
+	Related []cachedManifest
+	// BlobPaths is a map from digest to path within the saved image tarball for blobs which are not stored
+	// in the blobs directory, as is the case for tarballs exported by daemons older than Docker 25
+	BlobPaths map[string]string
 }
 
-func (r *Registry) getManifest(ctx context.Context, img *image.InspectResponse) (manifest cachedManifest, err error) {
-	imgTarStream, err := r.Docker.ImageSave(ctx, []string{img.ID})
+// blobPath returns the path within the saved image tarball of a blob referenced by this manifest
+func (m *cachedManifest) blobPath(digest godigest.Digest) string {
+	if blobPath, ok := m.BlobPaths[string(digest)]; ok {
+		return blobPath
+	}
+	return archiveBlobPath(digest)
+}
+
+// blobSize returns the size of this manifest or a blob referenced by it, any of its children if it is an index,
+// or any of its related manifests
+func (m *cachedManifest) blobSize(digest godigest.Digest) (int64, bool) {
+	if m.Digest == digest {
+		return int64(len(m.JSON)), true
+	}
+	for i := range m.Related {
+		if size, ok := m.Related[i].blobSize(digest); ok {
+			return size, true
+		}
+	}
+	if m.IsIndex() {
+		for _, desc := range m.Index.Manifests {
+			if desc.Digest == digest {
+				return desc.Size, true
+			}
+		}
+		for i := range m.Children {
+			if size, ok := m.Children[i].blobSize(digest); ok {
+				return size, true
+			}
+		}
+		return 0, false
+	}
+	if m.Manifest.Config.Digest == digest {
+		return m.Manifest.Config.Size, true
+	}
+	for _, layer := range m.Manifest.Layers {
+		if layer.Digest == digest {
+			return layer.Size, true
+		}
+	}
+	return 0, false
+}
+
+// IsIndex returns true if the manifest is an image index or manifest list
+func (m *cachedManifest) IsIndex() bool {
+	return isIndexMediaType(m.MediaType)
+}
+
+// parseManifest parses a manifest or index blob.
+// mediaType is the media type from the descriptor that referred to it, if any, which is used if the blob
+// does not specify its own.
+func parseManifest(manifestJSON []byte, mediaType string) (manifest cachedManifest, err error) {
+	manifest = cachedManifest{
+		JSON:      json.RawMessage(manifestJSON),
+		MediaType: mediaType,
+		Digest:    godigest.FromBytes(manifestJSON),
+	}
+	var probe struct {
+		MediaType string          `json:"mediaType"`
+		Manifests json.RawMessage `json:"manifests"`
+	}
+	err = json.Unmarshal(manifestJSON, &probe)
 	if err != nil {
-		err = fmt.Errorf("requesting upstream tarball: %w", err)
 		return
 	}
+	if probe.MediaType != "" {
+		manifest.MediaType = probe.MediaType
+	}
+	if manifest.MediaType == "" {
+		if probe.Manifests != nil {
+			manifest.MediaType = ociimage.MediaTypeImageIndex
+		} else {
+			manifest.MediaType = ociimage.MediaTypeImageManifest
+		}
+	}
+	if manifest.IsIndex() {
+		err = json.Unmarshal(manifestJSON, &manifest.Index)
+	} else {
+		err = json.Unmarshal(manifestJSON, &manifest.Manifest)
+	}
+	return
+}
+
+// indexedManifest is a manifest along with the image it was found in
+type indexedManifest struct {
+	Image    *image.InspectResponse
+	Manifest cachedManifest
+}
+
+// smallBlobCap is the largest blob that will be buffered in memory while reading a saved image tarball
+const smallBlobCap = 512 * 1024 // 512KiB
+
+// savedImage is the parsed content of a tarball exported by the daemon
+type savedImage struct {
+	Layout ociimage.ImageLayout
+	Index  ociimage.Index
+	// SmallBlobs is a map from digest to the content of each blob small enough to possibly be a manifest or config
+	SmallBlobs map[string][]byte
+	// DockerManifests is the content of manifest.json, which is the only index of tarballs exported by daemons
+	// older than Docker 25
+	DockerManifests []dockerArchiveManifest
+	// LegacyFiles is a map from path to descriptor of each file outside of the blobs directory, which are the
+	// layers and configs of tarballs exported by daemons older than Docker 25
+	LegacyFiles map[string]ociimage.Descriptor
+	// legacyLinks is a map from path to the path it links to for each link outside of the blobs directory
+	legacyLinks map[string]string
+}
+
+// saveImage exports an image from the daemon and parses the resulting tarball
+func (r *Registry) saveImage(ctx context.Context, imgID string) (*savedImage, error) {
+	imgTarStream, err := r.exportImage(ctx, imgID)
+	if err != nil {
+		return nil, err
+	}
+	defer imgTarStream.Close()
+	return readSavedImage(imgTarStream, r.blobCache, nil)
+}
+
+// readSavedImage reads the layout, index, and potential manifest blobs from a tarball exported by the daemon.
+// Every blob in the tarball is also added to cache, which may be nil.
+// onEntry, if not nil, is called with the header of each entry before its content is read.
+func readSavedImage(imgTarStream io.Reader, cache *blobCache, onEntry func(h *tar.Header)) (*savedImage, error) {
 	imgTar := tar.NewReader(imgTarStream)
-	var h *tar.Header
 
-	smallBlobs := make(map[string][]byte)
-	const smallBlobCap = 512 * 1024 * 1024 // 512KiB
+	saved := &savedImage{
+		SmallBlobs:  make(map[string][]byte),
+		LegacyFiles: make(map[string]ociimage.Descriptor),
+		legacyLinks: make(map[string]string),
+	}
 
-	var layout ociimage.ImageLayout
-	var index ociimage.Index
 	for {
-		h, err = imgTar.Next()
+		h, err := imgTar.Next()
 		if errors.Is(err, io.EOF) {
-			err = nil
 			break
 		}
 		if err != nil {
-			err = fmt.Errorf("reading upstream tarball: %w", err)
-			return
+			return nil, fmt.Errorf("reading upstream tarball: %w", err)
 		}
 		slog.Info("upstream tarball entry", "name", h.Name, "type", h.Typeflag)
+		if onEntry != nil {
+			onEntry(h)
+		}
+		if h.Typeflag == tar.TypeDir {
+			// Some exporters, such as podman, include the directories of the layout
+			continue
+		}
 		switch h.Name {
 		case ociimage.ImageLayoutFile:
-			err = json.NewDecoder(imgTar).Decode(&layout)
+			err = json.NewDecoder(imgTar).Decode(&saved.Layout)
 			if err != nil {
-				err = fmt.Errorf("daemon save tarball contained invalid layout: %w", err)
-				return
+				return nil, fmt.Errorf("daemon save tarball contained invalid layout: %w", err)
 			}
 		case ociimage.ImageIndexFile:
-			err = json.NewDecoder(imgTar).Decode(&index)
+			err = json.NewDecoder(imgTar).Decode(&saved.Index)
 			if err != nil {
-				err = fmt.Errorf("daemon save tarball contained invalid index: %w", err)
-				return
+				return nil, fmt.Errorf("daemon save tarball contained invalid index: %w", err)
 			}
-		default:
-			if h.Size > smallBlobCap {
-				continue
+		case dockerArchiveManifestFile:
+			err = json.NewDecoder(imgTar).Decode(&saved.DockerManifests)
+			if err != nil {
+				return nil, fmt.Errorf("daemon save tarball contained invalid %s: %w", dockerArchiveManifestFile, err)
 			}
+		default:
 			if !strings.HasPrefix(h.Name, ociimage.ImageBlobsDir+"/") {
+				err = saved.readLegacyFile(h, imgTar, cache)
+				if err != nil {
+					return nil, err
+				}
 				continue
 			}
 			digest := strings.ReplaceAll(strings.TrimPrefix(h.Name, ociimage.ImageBlobsDir+"/"), "/", ":")
+			// The blob is only cached on a best-effort basis, and if reading it from the tarball failed instead,
+			// reading the next entry fails as well
+			if h.Size > smallBlobCap {
+				err = cache.Put(godigest.Digest(digest), imgTar)
+				if err != nil {
+					slog.Warn("failed to cache blob", "digest", digest, "error", err)
+				}
+				continue
+			}
 			var buf bytes.Buffer
 			_, err = io.Copy(&buf, imgTar)
 			if err != nil {
-				err = fmt.Errorf("failed reading potential manifest blob: %w", err)
-				return
+				return nil, fmt.Errorf("failed reading potential manifest blob: %w", err)
+			}
+			saved.SmallBlobs[digest] = buf.Bytes()
+			err = cache.Put(godigest.Digest(digest), bytes.NewReader(buf.Bytes()))
+			if err != nil {
+				slog.Warn("failed to cache blob", "digest", digest, "error", err)
 			}
-			smallBlobs[digest] = buf.Bytes()
 		}
 	}
+	return saved, nil
+}
 
+func (r *Registry) getManifest(ctx context.Context, img *image.InspectResponse) (manifest cachedManifest, err error) {
+	if blobs, ok := r.Backend.(BlobBackend); ok && img.Descriptor != nil {
+		manifest, err = readBackendManifest(ctx, blobs, *img.Descriptor)
+		if !errdefs.IsNotImplemented(err) {
+			return
+		}
+	}
+	saved, err := r.saveImage(ctx, img.ID)
+	if err != nil {
+		return
+	}
+	index := saved.Index
+
+	if len(index.Manifests) == 0 && len(saved.DockerManifests) != 0 {
+		slog.Info("upstream tarball has no index, falling back to legacy format", "id", img.ID)
+		return saved.legacyManifest(img.ID)
+	}
 	if len(index.Manifests) == 0 {
 		err = fmt.Errorf("upstream tarball did not contain any manifests")
 		return
@@ -84,49 +271,293 @@ func (r *Registry) getManifest(ctx context.Context, img *image.InspectResponse)
 	slog.Info("upstream tarball manifests", "manifests", index.Manifests)
 
 	for _, descriptor := range index.Manifests {
-		manifestJSON, ok := smallBlobs[string(descriptor.Digest)]
-		if !ok {
-			err = fmt.Errorf("daemon save tarball did not contain manifest blob %s or it was very big", descriptor.Digest)
-			return
-		}
-		possibleManifest := cachedManifest{
-			JSON: json.RawMessage(manifestJSON),
-		}
-		err = json.Unmarshal(manifestJSON, &possibleManifest.Manifest)
+		manifest, err = saved.loadManifest(descriptor)
 		if err != nil {
-			err = fmt.Errorf("daemon save tarball contained invalid manifest blob %s: %w", descriptor.Digest, err)
 			return
 		}
-		if string(possibleManifest.Manifest.Config.Digest) == img.ID {
-			manifest = possibleManifest
-			slog.Info("found manifest", "id", img.ID, "manifest", manifest)
-			return
+		// With the containerd image store, the image ID is the digest of its manifest or index,
+		// otherwise, it is the digest of its config.
+		// Backends which identify images otherwise, such as podman does manifest lists, export only that image.
+		if len(index.Manifests) > 1 && manifest.Digest != godigest.Digest(img.ID) && (manifest.IsIndex() || string(manifest.Manifest.Config.Digest) != img.ID) {
+			continue
+		}
+		slog.Info("found manifest", "id", img.ID, "manifest", manifest)
+		if manifest.IsIndex() {
+			for _, childDescriptor := range manifest.Index.Manifests {
+				child, childErr := saved.loadManifest(childDescriptor)
+				if childErr != nil {
+					// Not every platform of an index is necessarily present in the daemon
+					slog.Info("skipping child manifest", "id", img.ID, "digest", childDescriptor.Digest, "error", childErr)
+					continue
+				}
+				manifest.Children = append(manifest.Children, child)
+			}
 		}
+		manifest.Related = saved.relatedManifests(&manifest)
+		return
 	}
 	err = fmt.Errorf("upstream tarball did not contain expected manifest with ID %s", img.ID)
 	return
 }
 
+// readBackendManifest reads the manifest or index of an image directly from a backend that can read blobs,
+// along with the children of an index which are present, without exporting the image
+func readBackendManifest(ctx context.Context, blobs BlobBackend, desc ociimage.Descriptor) (cachedManifest, error) {
+	manifest, err := readBackendManifestBlob(ctx, blobs, desc)
+	if err != nil {
+		return cachedManifest{}, err
+	}
+	if manifest.IsIndex() {
+		for _, childDescriptor := range manifest.Index.Manifests {
+			child, err := readBackendManifestBlob(ctx, blobs, childDescriptor)
+			if err != nil {
+				// Not every platform of an index is necessarily present in the backend
+				slog.Info("skipping child manifest", "id", desc.Digest, "digest", childDescriptor.Digest, "error", err)
+				continue
+			}
+			manifest.Children = append(manifest.Children, child)
+		}
+	}
+	return manifest, nil
+}
+
+func readBackendManifestBlob(ctx context.Context, blobs BlobBackend, desc ociimage.Descriptor) (cachedManifest, error) {
+	content, size, err := blobs.BlobOpen(ctx, desc.Digest)
+	if err != nil {
+		return cachedManifest{}, err
+	}
+	defer content.Close()
+	if size > smallBlobCap {
+		return cachedManifest{}, fmt.Errorf("manifest blob %s is too large", desc.Digest)
+	}
+	manifestJSON, err := io.ReadAll(content)
+	if err != nil {
+		return cachedManifest{}, fmt.Errorf("reading manifest blob %s: %w", desc.Digest, err)
+	}
+	manifest, err := parseManifest(manifestJSON, desc.MediaType)
+	if err != nil {
+		return cachedManifest{}, fmt.Errorf("backend contained invalid manifest blob %s: %w", desc.Digest, err)
+	}
+	if manifest.Digest != desc.Digest {
+		return cachedManifest{}, fmt.Errorf("backend returned content with digest %s for manifest blob %s", manifest.Digest, desc.Digest)
+	}
+	return manifest, nil
+}
+
+// relatedManifests loads every manifest reachable from the index of the tarball which is not the given manifest or
+// one of its children
+func (s *savedImage) relatedManifests(manifest *cachedManifest) []cachedManifest {
+	known := map[godigest.Digest]struct{}{manifest.Digest: {}}
+	for _, child := range manifest.Children {
+		known[child.Digest] = struct{}{}
+	}
+	var related []cachedManifest
+	for _, desc := range s.reachableManifests() {
+		if _, ok := known[desc.Digest]; ok {
+			continue
+		}
+		m, err := s.loadManifest(desc)
+		if err != nil {
+			continue
+		}
+		related = append(related, m)
+	}
+	return related
+}
+
+// loadManifest parses a manifest or index in the tarball
+func (s *savedImage) loadManifest(descriptor ociimage.Descriptor) (cachedManifest, error) {
+	manifestJSON, ok := s.SmallBlobs[string(descriptor.Digest)]
+	if !ok {
+		return cachedManifest{}, fmt.Errorf("daemon save tarball did not contain manifest blob %s or it was very big", descriptor.Digest)
+	}
+	manifest, err := parseManifest(manifestJSON, descriptor.MediaType)
+	if err != nil {
+		return cachedManifest{}, fmt.Errorf("daemon save tarball contained invalid manifest blob %s: %w", descriptor.Digest, err)
+	}
+	return manifest, nil
+}
+
+// getAndCacheManifest returns the manifest of an image, exporting the image to find it if it is not cached.
+// Concurrent requests for the same image wait on the same export, while other images are unaffected.
 func (r *Registry) getAndCacheManifest(ctx context.Context, img *image.InspectResponse) (manifest cachedManifest, err error) {
-	r.cacheLock.RLock()
-	defer r.cacheLock.RUnlock()
-	var ok bool
-	manifest, ok = r.manifestCache[img.ID]
+	manifest, ok := r.getCachedManifest(img.ID)
 	if ok {
 		return
 	}
-	r.cacheLock.RUnlock()
-	defer r.cacheLock.RLock()
-	r.cacheLock.Lock()
-	defer r.cacheLock.Unlock()
-	manifest, err = r.getManifest(ctx, img)
+	err = r.manifests.Do(ctx, img.ID, func(ctx context.Context) error {
+		if _, ok := r.getCachedManifest(img.ID); ok {
+			return nil
+		}
+		manifest, err := r.getManifest(ctx, img)
+		if err != nil {
+			return err
+		}
+		r.cacheManifest(img, manifest)
+		return nil
+	})
 	if err != nil {
 		return
 	}
+	manifest, ok = r.getCachedManifest(img.ID)
+	if !ok {
+		err = fmt.Errorf("image %s was removed while reading its manifest", img.ID)
+	}
+	return
+}
+
+func (r *Registry) getCachedManifest(imgID string) (cachedManifest, bool) {
+	r.cacheLock.RLock()
+	defer r.cacheLock.RUnlock()
+	manifest, ok := r.manifestCache[imgID]
+	return manifest, ok
+}
+
+// addManifestToCache caches the manifest of an image, and makes it and any child manifests retrievable by digest.
+// cacheLock must be held.
+func (r *Registry) addManifestToCache(img *image.InspectResponse, manifest cachedManifest) {
 	r.manifestCache[img.ID] = manifest
+	r.manifestDigests[string(manifest.Digest)] = indexedManifest{Image: img, Manifest: manifest}
+	for _, child := range manifest.Children {
+		r.manifestDigests[string(child.Digest)] = indexedManifest{Image: img, Manifest: child}
+	}
+	for _, related := range manifest.Related {
+		r.manifestDigests[string(related.Digest)] = indexedManifest{Image: img, Manifest: related}
+	}
+}
+
+// getManifestByDigest returns a previously cached manifest with the given digest, if it belongs to an image
+// in the given repository
+func (r *Registry) getManifestByDigest(name, digest string) (cachedManifest, bool) {
+	r.cacheLock.RLock()
+	defer r.cacheLock.RUnlock()
+	indexed, ok := r.manifestDigests[digest]
+	if !ok || !inRepo(indexed.Image, name) {
+		return cachedManifest{}, false
+	}
+	return indexed.Manifest, true
+}
+
+// findManifestByDigest returns the manifest with the given digest in the given repository, reading it if it is not
+// cached yet.
+// The digest of a manifest is not necessarily the ID of its image, nor one of its repo digests, such as for images
+// that were built locally with the classic image store, so the daemon cannot be asked for it directly. If the
+// daemon does not report it as the manifest of an indexed image either, the manifests of the images in the
+// repository which are not cached yet are read to find it.
+func (r *Registry) findManifestByDigest(ctx context.Context, name, digest string) (cachedManifest, bool, error) {
+	if img, ok := r.findImageByDescriptor(name, digest); ok {
+		_, err := r.getAndCacheManifest(ctx, img)
+		if err != nil {
+			return cachedManifest{}, false, err
+		}
+		if manifest, ok := r.getManifestByDigest(name, digest); ok {
+			return manifest, true, nil
+		}
+	}
+	err := r.loadRepoManifests(ctx, name)
+	if err != nil {
+		return cachedManifest{}, false, err
+	}
+	manifest, ok := r.getManifestByDigest(name, digest)
+	return manifest, ok, nil
+}
+
+// findImageIDByDigest returns the ID of the image in the given repository with a manifest with the given digest,
+// resolving the digest the same way as when fetching a manifest by digest: from the cache, then by asking the
+// daemon, then by repo digest, then by reading the manifests of the repository.
+func (r *Registry) findImageIDByDigest(ctx context.Context, name, digest string) (string, error) {
+	if imgID, ok := r.getImageIDByManifestDigest(name, digest); ok {
+		return imgID, nil
+	}
+	img, err := r.Backend.ImageInspect(ctx, name+"@"+digest)
+	if err == nil {
+		return img.ID, nil
+	}
+	if !errdefs.IsNotFound(err) {
+		return "", err
+	}
+	found, err := r.findImageByRepoDigest(ctx, name, digest)
+	if err == nil {
+		return found.ID, nil
+	}
+	if !errdefs.IsNotFound(err) {
+		return "", err
+	}
+	_, ok, err := r.findManifestByDigest(ctx, name, digest)
+	if err != nil {
+		return "", err
+	}
+	if ok {
+		if imgID, ok := r.getImageIDByManifestDigest(name, digest); ok {
+			return imgID, nil
+		}
+	}
+	return "", errdefs.NotFound(fmt.Errorf("no image in %s has a manifest with digest %s", name, digest))
+}
+
+// getImageIDByManifestDigest returns the ID of the image a previously cached manifest with the given digest
+// belongs to, if it is in the given repository
+func (r *Registry) getImageIDByManifestDigest(name, digest string) (string, bool) {
+	r.cacheLock.RLock()
+	defer r.cacheLock.RUnlock()
+	indexed, ok := r.manifestDigests[digest]
+	if !ok || !inRepo(indexed.Image, name) {
+		return "", false
+	}
+	return indexed.Image.ID, true
+}
+
+// loadRepoManifests reads and caches the manifest of every image in the given repository which is not cached yet,
+// so that every manifest in the repository can be found in the cache.
+// Unless the backend can read manifests directly, this exports each such image, so it is only done when a manifest
+// cannot be found otherwise.
+func (r *Registry) loadRepoManifests(ctx context.Context, name string) error {
+	imgSums, err := r.Backend.ImageList(ctx)
+	if err != nil {
+		return fmt.Errorf("listing images: %w", err)
+	}
+	for _, imgSum := range imgSums {
+		if !refsInRepo(slices.Concat(imgSum.RepoTags, imgSum.RepoDigests), name) {
+			continue
+		}
+		if _, ok := r.getCachedManifest(imgSum.ID); ok {
+			continue
+		}
+		img, err := r.Backend.ImageInspect(ctx, imgSum.ID)
+		if errdefs.IsNotFound(err) {
+			// The image was removed after listing images
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("inspecting image %s: %w", imgSum.ID, err)
+		}
+		_, err = r.getAndCacheManifest(ctx, &img)
+		if err != nil && !errdefs.IsNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// findImageByDescriptor returns an indexed image in the given repository whose manifest the daemon reports as
+// having the given digest
+func (r *Registry) findImageByDescriptor(name, digest string) (*image.InspectResponse, bool) {
+	r.indexLock.RLock()
+	defer r.indexLock.RUnlock()
+	for _, img := range r.blobIndex[digest] {
+		if img.Descriptor != nil && string(img.Descriptor.Digest) == digest && inRepo(img, name) {
+			return img, true
+		}
+	}
+	return nil, false
+}
+
+// cacheManifest adds the manifest of an image to the cache, and indexes the image
+func (r *Registry) cacheManifest(img *image.InspectResponse, manifest cachedManifest) {
+	r.cacheLock.Lock()
+	defer r.cacheLock.Unlock()
+	r.addManifestToCache(img, manifest)
 	r.indexLock.Lock()
 	defer r.indexLock.Unlock()
-	r.addImageToIndex(img)
-
-	return
+	r.addImageToIndex(img, &manifest)
 }
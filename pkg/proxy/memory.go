@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/errdefs"
+
+	godigest "github.com/opencontainers/go-digest"
+)
+
+// MemoryBackend is a Backend which holds images in memory, such as for tests, or for serving images produced by a
+// program without a daemon.
+// Images are added by loading OCI image layout tarballs with ImageLoad, or by pushing them to the registry.
+type MemoryBackend struct {
+	images *imageStore
+
+	// lock must be held when using blobs
+	lock sync.RWMutex
+	// blobs is a map from digest to content of every blob of every image
+	blobs map[godigest.Digest][]byte
+}
+
+var _ BlobBackend = &MemoryBackend{}
+
+// NewMemoryBackend returns an empty MemoryBackend
+func NewMemoryBackend() *MemoryBackend {
+	m := &MemoryBackend{
+		blobs: make(map[godigest.Digest][]byte),
+	}
+	m.images = newImageStore(m)
+	return m
+}
+
+func (m *MemoryBackend) openBlob(dgst godigest.Digest) (io.ReadCloser, int64, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	content, ok := m.blobs[dgst]
+	if !ok {
+		return nil, 0, errdefs.NotFound(fmt.Errorf("no such blob: %s", dgst))
+	}
+	return &sectionReadCloser{SectionReader: io.NewSectionReader(bytes.NewReader(content), 0, int64(len(content)))}, int64(len(content)), nil
+}
+
+func (m *MemoryBackend) putBlob(dgst godigest.Digest, content io.Reader) error {
+	var buf bytes.Buffer
+	_, err := io.Copy(&buf, content)
+	if err != nil {
+		return err
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.blobs[dgst] = buf.Bytes()
+	return nil
+}
+
+func (m *MemoryBackend) BlobOpen(_ context.Context, dgst godigest.Digest) (io.ReadCloser, int64, error) {
+	return m.openBlob(dgst)
+}
+
+func (m *MemoryBackend) ImageList(_ context.Context) ([]image.Summary, error) {
+	return m.images.list(), nil
+}
+
+func (m *MemoryBackend) ImageInspect(_ context.Context, ref string) (image.InspectResponse, error) {
+	return m.images.inspect(ref)
+}
+
+func (m *MemoryBackend) ImageSave(_ context.Context, imgID string) (io.ReadCloser, error) {
+	return m.images.save(imgID)
+}
+
+func (m *MemoryBackend) ImageLoad(ctx context.Context, archive io.Reader) error {
+	return m.images.loadArchive(ctx, archive, m.putBlob)
+}
+
+// ImageRemove removes a reference to an image.
+// Blobs are kept even once no image refers to them, in case they are pushed again.
+func (m *MemoryBackend) ImageRemove(_ context.Context, ref string) error {
+	_, err := m.images.removeRef(ref)
+	return err
+}
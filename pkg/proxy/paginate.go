@@ -0,0 +1,57 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+)
+
+// pagination is the n and last query parameters used by the catalog and tag list endpoints
+type pagination struct {
+	// N is the maximum number of results to return, or -1 if unlimited
+	N int
+	// Last is the result after which to start returning results
+	Last string
+}
+
+// parsePagination parses the n and last query parameters of a request
+func parsePagination(q url.Values) (pagination, error) {
+	page := pagination{N: -1, Last: q.Get("last")}
+	nStr := q.Get("n")
+	if nStr == "" {
+		return page, nil
+	}
+	n, err := strconv.Atoi(nStr)
+	if err != nil || n < 0 {
+		return page, fmt.Errorf("%w: %q", errPaginationInvalid, nStr)
+	}
+	page.N = n
+	return page, nil
+}
+
+// apply sorts items lexically and returns the requested page of them, and whether there are more items after it
+func (p pagination) apply(items []string) (page []string, more bool) {
+	sort.Strings(items)
+	start := sort.SearchStrings(items, p.Last)
+	if p.Last != "" && start < len(items) && items[start] == p.Last {
+		start++
+	}
+	page = items[start:]
+	if p.N >= 0 && len(page) > p.N {
+		// There is no last item to link from if no items were requested
+		return page[:p.N], p.N != 0
+	}
+	return page, false
+}
+
+// setNextLink sets the Link header of a response to point to the page following the last item returned,
+// as described by RFC 5988.
+func (p pagination) setNextLink(w http.ResponseWriter, rq *http.Request, last string) {
+	q := url.Values{}
+	q.Set("n", strconv.Itoa(p.N))
+	q.Set("last", last)
+	next := url.URL{Path: rq.URL.Path, RawQuery: q.Encode()}
+	w.Header().Set("Link", fmt.Sprintf("<%s>; rel=\"next\"", next.String()))
+}
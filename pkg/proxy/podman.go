@@ -0,0 +1,695 @@
+package proxy
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/errdefs"
+
+	godigest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go"
+	ociimage "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// podmanAPIPrefix is the path prefix of the libpod API endpoints.
+// Podman serves any API version up to its own, and 4.0.0 is the oldest with every endpoint used here.
+const podmanAPIPrefix = "/v4.0.0/libpod"
+
+// PodmanBackend serves images from podman using its libpod API, rather than its Docker-compatible API.
+// Images are exported as OCI archives, which unlike docker save tarballs keep the compression of their layers,
+// such as zstd.
+// Manifest lists are served as the lists they are in podman's storage, with each platform which is present.
+// Images, including manifest lists, are identified by their ID in podman's storage, which for images other than
+// manifest lists is the digest of their config, as with the Docker daemon.
+type PodmanBackend struct {
+	client *http.Client
+	// baseURL is the URL of the API, without the version prefix
+	baseURL string
+
+	// lock must be held when using lists
+	lock sync.RWMutex
+	// lists records whether each image, by its reported ID, is a manifest list, as of the last time images were
+	// listed. Only podman 5 and later report this when listing images.
+	lists map[string]bool
+}
+
+var _ WatchingBackend = &PodmanBackend{}
+var _ PullingBackend = &PodmanBackend{}
+
+// NewPodmanBackend returns a backend using the podman API at address, which is either unix:// followed by the path
+// of a socket, or tcp:// followed by a host and port, as with CONTAINER_HOST
+func NewPodmanBackend(address string) (*PodmanBackend, error) {
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid podman address %s: %w", address, err)
+	}
+	p := &PodmanBackend{lists: make(map[string]bool)}
+	transport := &http.Transport{}
+	switch u.Scheme {
+	case "unix":
+		socket := u.Path
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", socket)
+		}
+		// The host is ignored when connecting over a socket
+		p.baseURL = "http://podman"
+	case "tcp":
+		p.baseURL = "http://" + u.Host
+	default:
+		return nil, fmt.Errorf("invalid podman address %s: scheme must be unix or tcp", address)
+	}
+	p.client = &http.Client{Transport: transport}
+	return p, nil
+}
+
+// podmanImageSummary is an image as listed by the libpod API
+type podmanImageSummary struct {
+	ID          string `json:"Id"`
+	RepoTags    []string
+	RepoDigests []string
+	Created     int64
+	Size        int64
+	// Digest is the digest of the manifest of the image
+	Digest string
+	// IsManifestList is only reported by podman 5 and later
+	IsManifestList *bool
+}
+
+// podmanImageInspect is the metadata of an image as reported by the libpod API
+type podmanImageInspect struct {
+	ID           string `json:"Id"`
+	RepoTags     []string
+	RepoDigests  []string
+	Created      *time.Time
+	Author       string
+	Architecture string
+	Os           string
+	Size         int64
+	RootFS       *struct {
+		Type   string
+		Layers []string
+	}
+}
+
+// podmanImageID returns the ID the Docker Engine API would report for an image with the given libpod ID
+func podmanImageID(id string) string {
+	if strings.Contains(id, ":") {
+		return id
+	}
+	return string(godigest.SHA256) + ":" + id
+}
+
+// podmanError converts an unsuccessful response from the libpod API to the equivalent errdefs error
+func podmanError(resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, smallBlobCap))
+	var errResp struct {
+		Message string `json:"message"`
+	}
+	msg := strings.TrimSpace(string(body))
+	if json.Unmarshal(body, &errResp) == nil && errResp.Message != "" {
+		msg = errResp.Message
+	}
+	err := fmt.Errorf("podman returned %s: %s", resp.Status, msg)
+	switch resp.StatusCode {
+	case http.StatusBadRequest:
+		return errdefs.InvalidParameter(err)
+	case http.StatusUnauthorized:
+		return errdefs.Unauthorized(err)
+	case http.StatusForbidden:
+		return errdefs.Forbidden(err)
+	case http.StatusNotFound:
+		return errdefs.NotFound(err)
+	case http.StatusConflict:
+		return errdefs.Conflict(err)
+	case http.StatusNotImplemented:
+		return errdefs.NotImplemented(err)
+	case http.StatusServiceUnavailable:
+		return errdefs.Unavailable(err)
+	}
+	return errdefs.System(err)
+}
+
+// do makes a request to the libpod API, returning an errdefs error if it is not successful.
+// The body of the response must be closed.
+func (p *PodmanBackend) do(ctx context.Context, method, endpoint string, query url.Values, body io.Reader) (*http.Response, error) {
+	u := p.baseURL + podmanAPIPrefix + endpoint
+	if len(query) != 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/x-tar")
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, errdefs.Unavailable(fmt.Errorf("connecting to podman: %w", err))
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	return nil, podmanError(resp)
+}
+
+// getJSON decodes the response of a GET request to the libpod API into v
+func (p *PodmanBackend) getJSON(ctx context.Context, endpoint string, query url.Values, v any) error {
+	resp, err := p.do(ctx, http.MethodGet, endpoint, query, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	err = json.NewDecoder(resp.Body).Decode(v)
+	if err != nil {
+		return fmt.Errorf("reading podman response: %w", err)
+	}
+	return nil
+}
+
+// imageEndpoint returns the path of a libpod API endpoint for an image
+func imageEndpoint(kind, name, action string) string {
+	return "/" + kind + "/" + url.PathEscape(name) + "/" + action
+}
+
+// knownManifestList returns whether an image is a manifest list, if podman reported it when images were last listed
+func (p *PodmanBackend) knownManifestList(ref string) (isList, known bool) {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	isList, known = p.lists[podmanImageID(ref)]
+	return isList, known
+}
+
+// isManifestList returns true if the named image is a manifest list
+func (p *PodmanBackend) isManifestList(ctx context.Context, name string) (bool, error) {
+	if isList, known := p.knownManifestList(name); known {
+		return isList, nil
+	}
+	resp, err := p.do(ctx, http.MethodGet, imageEndpoint("manifests", name, "exists"), nil, nil)
+	if errdefs.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("checking for manifest list %s: %w", name, err)
+	}
+	resp.Body.Close()
+	return true, nil
+}
+
+// manifestList returns the descriptor and content of a manifest list as podman parses it, which is not
+// necessarily byte for byte as it was stored
+func (p *PodmanBackend) manifestList(ctx context.Context, name string) (ociimage.Descriptor, []byte, error) {
+	resp, err := p.do(ctx, http.MethodGet, imageEndpoint("manifests", name, "json"), nil, nil)
+	if err != nil {
+		return ociimage.Descriptor{}, nil, fmt.Errorf("inspecting manifest list %s: %w", name, err)
+	}
+	defer resp.Body.Close()
+	var buf bytes.Buffer
+	_, err = io.Copy(&buf, io.LimitReader(resp.Body, smallBlobCap+1))
+	if err != nil {
+		return ociimage.Descriptor{}, nil, fmt.Errorf("reading manifest list %s: %w", name, err)
+	}
+	if buf.Len() > smallBlobCap {
+		return ociimage.Descriptor{}, nil, fmt.Errorf("manifest list %s is too large", name)
+	}
+	listJSON := bytes.TrimSpace(buf.Bytes())
+	var list struct {
+		MediaType string `json:"mediaType"`
+	}
+	err = json.Unmarshal(listJSON, &list)
+	if err != nil {
+		return ociimage.Descriptor{}, nil, fmt.Errorf("invalid manifest list %s: %w", name, err)
+	}
+	if list.MediaType == "" {
+		list.MediaType = ociimage.MediaTypeImageIndex
+	}
+	desc := ociimage.Descriptor{
+		MediaType: list.MediaType,
+		Digest:    godigest.FromBytes(listJSON),
+		Size:      int64(len(listJSON)),
+	}
+	return desc, listJSON, nil
+}
+
+// listImages lists the images matching the given libpod filters, or every image if there are none
+func (p *PodmanBackend) listImages(ctx context.Context, filters map[string][]string) ([]podmanImageSummary, error) {
+	var query url.Values
+	if len(filters) != 0 {
+		filtersJSON, err := json.Marshal(filters)
+		if err != nil {
+			return nil, err
+		}
+		query = url.Values{"filters": {string(filtersJSON)}}
+	}
+	var podmanSums []podmanImageSummary
+	err := p.getJSON(ctx, "/images/json", query, &podmanSums)
+	if err != nil {
+		return nil, fmt.Errorf("listing podman images: %w", err)
+	}
+	return podmanSums, nil
+}
+
+// ImageList lists every image with a single request.
+// Podman 5 and later report which images are manifest lists, which is recorded so that they need not be checked
+// for later.
+func (p *PodmanBackend) ImageList(ctx context.Context) ([]image.Summary, error) {
+	podmanSums, err := p.listImages(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	lists := make(map[string]bool)
+	summaries := make([]image.Summary, 0, len(podmanSums))
+	for _, podmanSum := range podmanSums {
+		summary := image.Summary{
+			ID:          podmanImageID(podmanSum.ID),
+			RepoTags:    podmanSum.RepoTags,
+			RepoDigests: podmanSum.RepoDigests,
+			Created:     podmanSum.Created,
+			Size:        podmanSum.Size,
+		}
+		if podmanSum.IsManifestList != nil {
+			lists[summary.ID] = *podmanSum.IsManifestList
+		}
+		summaries = append(summaries, summary)
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.lists = lists
+	return summaries, nil
+}
+
+// ImageInspect inspects an image by ID or reference.
+// Podman resolves the name of a manifest list to the image for its own platform, so unless podman already reported
+// whether the image is a manifest list, it is checked for if podman inspects an image not known by that name.
+func (p *PodmanBackend) ImageInspect(ctx context.Context, ref string) (image.InspectResponse, error) {
+	isList, known := p.knownManifestList(ref)
+	if isList {
+		return p.inspectManifestList(ctx, ref)
+	}
+	inspect, err := p.inspectImage(ctx, ref)
+	if known || (err == nil && imageKnownAs(inspect, ref)) {
+		return inspect, err
+	}
+	if err != nil && !errdefs.IsNotFound(err) {
+		return image.InspectResponse{}, err
+	}
+	isList, listErr := p.isManifestList(ctx, ref)
+	if listErr != nil {
+		return image.InspectResponse{}, listErr
+	}
+	if isList {
+		return p.inspectManifestList(ctx, ref)
+	}
+	return inspect, err
+}
+
+// inspectImage inspects an image other than a manifest list
+func (p *PodmanBackend) inspectImage(ctx context.Context, ref string) (image.InspectResponse, error) {
+	var podmanInspect podmanImageInspect
+	err := p.getJSON(ctx, imageEndpoint("images", ref, "json"), nil, &podmanInspect)
+	if err != nil {
+		return image.InspectResponse{}, fmt.Errorf("inspecting podman image %s: %w", ref, err)
+	}
+	inspect := image.InspectResponse{
+		ID:           podmanImageID(podmanInspect.ID),
+		RepoTags:     podmanInspect.RepoTags,
+		RepoDigests:  podmanInspect.RepoDigests,
+		Author:       podmanInspect.Author,
+		Architecture: podmanInspect.Architecture,
+		Os:           podmanInspect.Os,
+		Size:         podmanInspect.Size,
+	}
+	if podmanInspect.Created != nil {
+		inspect.Created = podmanInspect.Created.Format(time.RFC3339Nano)
+	}
+	if podmanInspect.RootFS != nil {
+		inspect.RootFS = image.RootFS{Type: podmanInspect.RootFS.Type, Layers: podmanInspect.RootFS.Layers}
+	}
+	return inspect, nil
+}
+
+// imageKnownAs returns true if ref is the ID, or one of the tags or digests, of an inspected image
+func imageKnownAs(inspect image.InspectResponse, ref string) bool {
+	if podmanImageID(ref) == inspect.ID {
+		return true
+	}
+	return slices.ContainsFunc(slices.Concat(inspect.RepoTags, inspect.RepoDigests), func(name string) bool {
+		return tagKey(name) == tagKey(ref)
+	})
+}
+
+// inspectManifestList describes a manifest list by how it is reported when listing images, which is the only
+// place podman reports its tags.
+// No descriptor is reported, as podman only reports the content of the list as it parses it, so the list is found
+// by exporting it instead.
+func (p *PodmanBackend) inspectManifestList(ctx context.Context, name string) (image.InspectResponse, error) {
+	filters := map[string][]string{"reference": {name}}
+	if dgst, err := godigest.Parse(name); err == nil {
+		filters = map[string][]string{"id": {dgst.Encoded()}}
+	}
+	podmanSums, err := p.listImages(ctx, filters)
+	if err != nil {
+		return image.InspectResponse{}, err
+	}
+	if len(podmanSums) == 0 {
+		return image.InspectResponse{}, errdefs.NotFound(fmt.Errorf("no such manifest list: %s", name))
+	}
+	podmanSum := podmanSums[0]
+	return image.InspectResponse{
+		ID:          podmanImageID(podmanSum.ID),
+		RepoTags:    podmanSum.RepoTags,
+		RepoDigests: podmanSum.RepoDigests,
+		Created:     time.Unix(podmanSum.Created, 0).UTC().Format(time.RFC3339Nano),
+		Size:        podmanSum.Size,
+	}, nil
+}
+
+// ImageSave exports an image as an OCI archive.
+// Podman only exports a single image at a time, so a manifest list is exported by adding the export of each of its
+// platforms which is present to the export of the list.
+func (p *PodmanBackend) ImageSave(ctx context.Context, imgID string) (io.ReadCloser, error) {
+	isList, err := p.isManifestList(ctx, imgID)
+	if err != nil {
+		return nil, err
+	}
+	if isList {
+		return p.saveManifestList(ctx, imgID)
+	}
+	return p.export(ctx, imgID)
+}
+
+// export exports a single image as an OCI archive
+func (p *PodmanBackend) export(ctx context.Context, name string) (io.ReadCloser, error) {
+	resp, err := p.do(ctx, http.MethodGet, imageEndpoint("images", name, "get"), url.Values{"format": {"oci-archive"}}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("exporting podman image %s: %w", name, err)
+	}
+	return resp.Body, nil
+}
+
+func (p *PodmanBackend) saveManifestList(ctx context.Context, name string) (io.ReadCloser, error) {
+	listExport, err := p.export(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	archiveR, archiveW := io.Pipe()
+	go func() {
+		defer listExport.Close()
+		archiveW.CloseWithError(p.writeManifestList(ctx, archiveW, name, listExport))
+	}()
+	return archiveR, nil
+}
+
+// writeManifestList writes an OCI image layout tarball containing a manifest list and the blobs of each of its
+// platforms which is present, starting from podman's export of the list.
+// The list is served as it was stored, so that its digest is the one it was pushed or pulled by, unless podman only
+// exported the image for its own platform, in which case the list is served as podman parses it.
+func (p *PodmanBackend) writeManifestList(ctx context.Context, w io.Writer, name string, listExport io.Reader) error {
+	tw := tar.NewWriter(w)
+	written := make(map[string]struct{})
+	small := make(map[string][]byte)
+	exported, err := copyArchiveBlobs(tw, listExport, written, small)
+	if err != nil {
+		return fmt.Errorf("reading export of podman image %s: %w", name, err)
+	}
+	list, desc, ok := exportedManifestList(exported, small)
+	if !ok {
+		slog.Warn("podman did not export manifest list, serving it as podman parses it instead", "name", name)
+		var listJSON []byte
+		desc, listJSON, err = p.manifestList(ctx, name)
+		if err != nil {
+			return err
+		}
+		list, err = parseManifest(listJSON, desc.MediaType)
+		if err != nil {
+			return fmt.Errorf("invalid manifest list %s: %w", name, err)
+		}
+		listPath := archiveBlobPath(desc.Digest)
+		if _, ok := written[listPath]; !ok {
+			written[listPath] = struct{}{}
+			err = writeArchiveFile(tw, listPath, listJSON)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// Platforms missing from the export are images in their own right in podman's storage, found by the digest of
+	// their manifest
+	var podmanSums []podmanImageSummary
+	listed := false
+	for _, child := range list.Index.Manifests {
+		if _, ok := written[archiveBlobPath(child.Digest)]; ok {
+			continue
+		}
+		if !listed {
+			podmanSums, err = p.listImages(ctx, nil)
+			if err != nil {
+				return err
+			}
+			listed = true
+		}
+		i := slices.IndexFunc(podmanSums, func(podmanSum podmanImageSummary) bool {
+			return podmanSum.Digest == child.Digest.String() || slices.ContainsFunc(podmanSum.RepoDigests, func(ref string) bool {
+				return strings.HasSuffix(ref, "@"+child.Digest.String())
+			})
+		})
+		if i == -1 {
+			continue
+		}
+		err = p.copyExportedBlobs(ctx, tw, podmanSums[i].ID, written)
+		if err != nil {
+			return err
+		}
+	}
+
+	layoutJSON, err := json.Marshal(ociimage.ImageLayout{Version: ociimage.ImageLayoutVersion})
+	if err != nil {
+		return err
+	}
+	err = writeArchiveFile(tw, ociimage.ImageLayoutFile, layoutJSON)
+	if err != nil {
+		return err
+	}
+	indexJSON, err := json.Marshal(ociimage.Index{
+		Versioned: ocispec.Versioned{SchemaVersion: 2},
+		MediaType: ociimage.MediaTypeImageIndex,
+		Manifests: []ociimage.Descriptor{desc},
+	})
+	if err != nil {
+		return err
+	}
+	err = writeArchiveFile(tw, ociimage.ImageIndexFile, indexJSON)
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// exportedManifestList returns the manifest list in the index of an export and its descriptor, or false if podman
+// exported the image for its own platform instead.
+// blobs is the content of the small blobs of the export by path.
+func exportedManifestList(index ociimage.Index, blobs map[string][]byte) (cachedManifest, ociimage.Descriptor, bool) {
+	if len(index.Manifests) != 1 {
+		return cachedManifest{}, ociimage.Descriptor{}, false
+	}
+	desc := index.Manifests[0]
+	listJSON, ok := blobs[archiveBlobPath(desc.Digest)]
+	if !ok {
+		return cachedManifest{}, ociimage.Descriptor{}, false
+	}
+	list, err := parseManifest(listJSON, desc.MediaType)
+	if err != nil || !list.IsIndex() {
+		return cachedManifest{}, ociimage.Descriptor{}, false
+	}
+	desc.MediaType = list.MediaType
+	return list, desc, true
+}
+
+// copyExportedBlobs exports an image and copies each of its blobs not yet written to tw
+func (p *PodmanBackend) copyExportedBlobs(ctx context.Context, tw *tar.Writer, name string, written map[string]struct{}) error {
+	archive, err := p.export(ctx, name)
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+	_, err = copyArchiveBlobs(tw, archive, written, nil)
+	if err != nil {
+		return fmt.Errorf("reading export of podman image %s: %w", name, err)
+	}
+	return nil
+}
+
+// copyArchiveBlobs copies each blob of an OCI archive not yet written to tw, and returns the index of the archive.
+// If small is not nil, the content of each blob small enough to be a manifest is added to it by path.
+func copyArchiveBlobs(tw *tar.Writer, archive io.Reader, written map[string]struct{}, small map[string][]byte) (ociimage.Index, error) {
+	var index ociimage.Index
+	tr := tar.NewReader(archive)
+	for {
+		h, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return index, nil
+		}
+		if err != nil {
+			return ociimage.Index{}, err
+		}
+		if h.Typeflag != tar.TypeReg {
+			continue
+		}
+		blobPath := path.Clean(h.Name)
+		if blobPath == ociimage.ImageIndexFile {
+			err = json.NewDecoder(tr).Decode(&index)
+			if err != nil {
+				return ociimage.Index{}, fmt.Errorf("invalid %s: %w", ociimage.ImageIndexFile, err)
+			}
+			continue
+		}
+		if !strings.HasPrefix(blobPath, ociimage.ImageBlobsDir+"/") {
+			continue
+		}
+		if _, ok := written[blobPath]; ok {
+			continue
+		}
+		written[blobPath] = struct{}{}
+		var content io.Reader = tr
+		if small != nil && h.Size <= smallBlobCap {
+			blob, err := io.ReadAll(tr)
+			if err != nil {
+				return ociimage.Index{}, err
+			}
+			small[blobPath] = blob
+			content = bytes.NewReader(blob)
+		}
+		err = tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     blobPath,
+			Size:     h.Size,
+			Mode:     0o444,
+		})
+		if err != nil {
+			return ociimage.Index{}, fmt.Errorf("writing %s to archive: %w", blobPath, err)
+		}
+		_, err = io.Copy(tw, content)
+		if err != nil {
+			return ociimage.Index{}, fmt.Errorf("writing %s to archive: %w", blobPath, err)
+		}
+	}
+}
+
+// ImageLoad loads an OCI archive or docker save tarball.
+// Podman names images by their io.containerd.image.name annotation, and only keeps the platform of a manifest list
+// matching its own.
+func (p *PodmanBackend) ImageLoad(ctx context.Context, archive io.Reader) error {
+	resp, err := p.do(ctx, http.MethodPost, "/images/load", nil, archive)
+	if err != nil {
+		return fmt.Errorf("loading image into podman: %w", err)
+	}
+	defer resp.Body.Close()
+	_, err = io.Copy(io.Discard, resp.Body)
+	return err
+}
+
+// ImageRemove removes a name of an image, or the image itself if it has no other names.
+// Podman refuses to remove an image with more than one name by ID.
+func (p *PodmanBackend) ImageRemove(ctx context.Context, ref string) error {
+	resp, err := p.do(ctx, http.MethodDelete, "/images/"+url.PathEscape(ref), nil, nil)
+	if err != nil {
+		return fmt.Errorf("removing podman image %s: %w", ref, err)
+	}
+	defer resp.Body.Close()
+	_, err = io.Copy(io.Discard, resp.Body)
+	return err
+}
+
+func (p *PodmanBackend) ImagePull(ctx context.Context, ref string) error {
+	resp, err := p.do(ctx, http.MethodPost, "/images/pull", url.Values{"reference": {ref}, "quiet": {"true"}}, nil)
+	if err != nil {
+		return fmt.Errorf("pulling %s with podman: %w", ref, err)
+	}
+	defer resp.Body.Close()
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var report struct {
+			Error string `json:"error"`
+		}
+		err := dec.Decode(&report)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("reading podman response: %w", err)
+		}
+		if report.Error != "" {
+			return fmt.Errorf("pulling %s with podman: %s", ref, report.Error)
+		}
+	}
+}
+
+// ImageEvents reports changes to images by listing them again whenever podman reports an image event.
+// Only changes after it is called are reported, so since is ignored.
+func (p *PodmanBackend) ImageEvents(ctx context.Context, _ time.Time) (<-chan events.Message, <-chan error) {
+	msgs := make(chan events.Message)
+	errs := make(chan error, 1)
+	go func() {
+		query := url.Values{
+			"stream":  {"true"},
+			"filters": {`{"type":["image"]}`},
+		}
+		resp, err := p.do(ctx, http.MethodGet, "/events", query, nil)
+		if err != nil {
+			errs <- fmt.Errorf("watching podman events: %w", err)
+			return
+		}
+		defer resp.Body.Close()
+		seen, err := p.ImageList(ctx)
+		if err != nil {
+			errs <- err
+			return
+		}
+		dec := json.NewDecoder(resp.Body)
+		for {
+			var msg events.Message
+			err := dec.Decode(&msg)
+			if errors.Is(err, io.EOF) {
+				err = errors.New("podman event stream closed")
+			}
+			if err != nil {
+				errs <- err
+				return
+			}
+			latest, err := p.ImageList(ctx)
+			if err != nil {
+				errs <- err
+				return
+			}
+			for _, msg := range imageChangeEvents(seen, latest) {
+				select {
+				case msgs <- msg:
+				case <-ctx.Done():
+					errs <- ctx.Err()
+					return
+				}
+			}
+			seen = latest
+		}
+	}()
+	return msgs, errs
+}
@@ -0,0 +1,278 @@
+package proxy_test
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync/atomic"
+
+	"github.com/meln5674/oci-reg-docker/pkg/proxy"
+	godigest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go"
+	ociimage "github.com/opencontainers/image-spec/specs-go/v1"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// fakePodmanImage is an image served by a fake libpod API
+type fakePodmanImage struct {
+	Summary map[string]any
+	Inspect map[string]any
+	// Export is the OCI archive of the image
+	Export []tarballEntry
+	// List is the manifest list as it was stored, if it is one
+	List []byte
+}
+
+// fakePodman serves the libpod API endpoints used by the podman backend for a fixed set of images, found by any of
+// their names
+func fakePodman(images map[string]*fakePodmanImage) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer GinkgoRecover()
+		endpoint, ok := strings.CutPrefix(r.URL.Path, "/v4.0.0/libpod")
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if endpoint == "/images/json" {
+			candidates := images
+			if filtersJSON := r.URL.Query().Get("filters"); filtersJSON != "" {
+				// Only filtering by name or ID is supported
+				var filters map[string][]string
+				Expect(json.Unmarshal([]byte(filtersJSON), &filters)).To(Succeed())
+				candidates = make(map[string]*fakePodmanImage)
+				for _, name := range slices.Concat(filters["reference"], filters["id"]) {
+					if img, ok := images[name]; ok {
+						candidates[name] = img
+					}
+				}
+			}
+			var summaries []map[string]any
+			seen := make(map[*fakePodmanImage]bool)
+			for _, img := range candidates {
+				if !seen[img] {
+					seen[img] = true
+					summaries = append(summaries, img.Summary)
+				}
+			}
+			Expect(json.NewEncoder(w).Encode(summaries)).To(Succeed())
+			return
+		}
+		kind, rest, _ := strings.Cut(strings.TrimPrefix(endpoint, "/"), "/")
+		slash := strings.LastIndex(rest, "/")
+		if slash == -1 {
+			http.NotFound(w, r)
+			return
+		}
+		img, ok := images[rest[:slash]]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"message":"image not known","response":404}`))
+			return
+		}
+		switch kind + " " + rest[slash+1:] {
+		case "images json":
+			Expect(json.NewEncoder(w).Encode(img.Inspect)).To(Succeed())
+		case "images get":
+			Expect(r.URL.Query().Get("format")).To(Equal("oci-archive"))
+			tw := tar.NewWriter(w)
+			// Podman includes the directories of the layout
+			for _, dir := range []string{"blobs/", "blobs/sha256/"} {
+				Expect(tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: dir, Mode: 0o755})).To(Succeed())
+			}
+			for _, entry := range img.Export {
+				Expect(tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: entry.Name, Size: int64(len(entry.Content)), Mode: 0o644})).To(Succeed())
+				_, err := tw.Write(entry.Content)
+				Expect(err).ToNot(HaveOccurred())
+			}
+			Expect(tw.Close()).To(Succeed())
+		case "manifests exists":
+			if img.List == nil {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		case "manifests json":
+			if img.List == nil {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			// Podman reports manifest lists as it parses them, which is not byte for byte as they were stored
+			var list ociimage.Index
+			Expect(json.Unmarshal(img.List, &list)).To(Succeed())
+			enc := json.NewEncoder(w)
+			enc.SetIndent("", "    ")
+			Expect(enc.Encode(list)).To(Succeed())
+		default:
+			http.NotFound(w, r)
+		}
+	})
+}
+
+// fakePodmanExport returns the entries of an OCI archive of an image as exported by podman
+func fakePodmanExport(img testImage) []tarballEntry {
+	return []tarballEntry{
+		{Name: ociimage.ImageLayoutFile, Content: mustMarshal(ociimage.ImageLayout{Version: ociimage.ImageLayoutVersion})},
+		{Name: ociimage.ImageIndexFile, Content: mustMarshal(ociimage.Index{
+			Versioned: ocispec.Versioned{SchemaVersion: 2},
+			Manifests: []ociimage.Descriptor{{MediaType: ociimage.MediaTypeImageManifest, Digest: img.Digest, Size: int64(len(img.Manifest))}},
+		})},
+		blobEntry(img.Layer),
+		blobEntry(img.Config),
+		blobEntry(img.Manifest),
+	}
+}
+
+var _ = Describe("PodmanBackend", func() {
+	var plainImg testImage
+	var zstdImg testImage
+	var listJSON []byte
+	var instance *fakePodmanImage
+	var list *fakePodmanImage
+	var requests atomic.Int32
+	var backend *proxy.PodmanBackend
+	var client registryClient
+
+	BeforeEach(func(ctx context.Context) {
+		plainImg = newTestImage("plain layer")
+
+		zstdImg = newTestImage("zstd layer")
+		zstdImg.Manifest = mustMarshal(ociimage.Manifest{
+			Versioned: ocispec.Versioned{SchemaVersion: 2},
+			MediaType: ociimage.MediaTypeImageManifest,
+			Config:    ociimage.Descriptor{MediaType: ociimage.MediaTypeImageConfig, Digest: zstdImg.ConfigDigest, Size: int64(len(zstdImg.Config))},
+			Layers:    []ociimage.Descriptor{{MediaType: ociimage.MediaTypeImageLayerZstd, Digest: zstdImg.LayerDigest, Size: int64(len(zstdImg.Layer))}},
+		})
+		zstdImg.Digest = godigest.FromBytes(zstdImg.Manifest)
+
+		listJSON = mustMarshal(ociimage.Index{
+			Versioned: ocispec.Versioned{SchemaVersion: 2},
+			MediaType: ociimage.MediaTypeImageIndex,
+			Manifests: []ociimage.Descriptor{
+				{
+					MediaType: ociimage.MediaTypeImageManifest,
+					Digest:    zstdImg.Digest,
+					Size:      int64(len(zstdImg.Manifest)),
+					Platform:  &ociimage.Platform{Architecture: "amd64", OS: "linux"},
+				},
+				{
+					// Not every platform of a list is necessarily present
+					MediaType: ociimage.MediaTypeImageManifest,
+					Digest:    godigest.FromString("missing platform"),
+					Size:      16,
+					Platform:  &ociimage.Platform{Architecture: "arm64", OS: "linux"},
+				},
+			},
+		})
+
+		plain := &fakePodmanImage{
+			Summary: map[string]any{"Id": plainImg.ConfigDigest.Encoded(), "RepoTags": []string{"localhost/plain:v1"}, "Digest": plainImg.Digest, "IsManifestList": false},
+			Inspect: map[string]any{"Id": plainImg.ConfigDigest.Encoded(), "RepoTags": []string{"localhost/plain:v1"}, "Digest": plainImg.Digest, "RootFS": map[string]any{"Type": "layers", "Layers": []string{plainImg.LayerDigest.String()}}},
+			Export:  fakePodmanExport(plainImg),
+		}
+		instance = &fakePodmanImage{
+			Summary: map[string]any{"Id": zstdImg.ConfigDigest.Encoded(), "Digest": zstdImg.Digest},
+			Inspect: map[string]any{"Id": zstdImg.ConfigDigest.Encoded(), "Digest": zstdImg.Digest, "RootFS": map[string]any{"Type": "layers", "Layers": []string{zstdImg.LayerDigest.String()}}},
+			Export:  fakePodmanExport(zstdImg),
+		}
+		listID := godigest.FromString("list").Encoded()
+		list = &fakePodmanImage{
+			// The summary is missing IsManifestList, as with podman 4
+			Summary: map[string]any{"Id": listID, "RepoTags": []string{"localhost/multi:v1"}},
+			// Podman inspects the image for its own platform when given the name of a list
+			Inspect: instance.Inspect,
+			// Podman exports the list as it was stored, with only the platform matching its own
+			Export: []tarballEntry{
+				{Name: ociimage.ImageLayoutFile, Content: mustMarshal(ociimage.ImageLayout{Version: ociimage.ImageLayoutVersion})},
+				{Name: ociimage.ImageIndexFile, Content: mustMarshal(ociimage.Index{
+					Versioned: ocispec.Versioned{SchemaVersion: 2},
+					Manifests: []ociimage.Descriptor{{MediaType: ociimage.MediaTypeImageIndex, Digest: godigest.FromBytes(listJSON), Size: int64(len(listJSON))}},
+				})},
+				blobEntry(listJSON),
+			},
+			List: listJSON,
+		}
+		requests.Store(0)
+		handler := fakePodman(map[string]*fakePodmanImage{
+			plainImg.ConfigDigest.Encoded(): plain,
+			plainImg.ConfigDigest.String():  plain,
+			"localhost/plain:v1":            plain,
+			zstdImg.ConfigDigest.Encoded():  instance,
+			zstdImg.ConfigDigest.String():   instance,
+			listID:                          list,
+			"sha256:" + listID:              list,
+			"localhost/multi:v1":            list,
+		})
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests.Add(1)
+			handler.ServeHTTP(w, r)
+		}))
+		DeferCleanup(srv.Close)
+
+		var err error
+		backend, err = proxy.NewPodmanBackend("tcp://" + strings.TrimPrefix(srv.URL, "http://"))
+		Expect(err).ToNot(HaveOccurred())
+		client = startRegistry(ctx, backend)
+	})
+
+	It("should serve images exported as OCI archives", func(ctx context.Context) {
+		resp := client.do(ctx, http.MethodGet, "/v2/localhost/plain/manifests/v1", nil)
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		Expect(readBody(resp)).To(Equal(plainImg.Manifest))
+
+		resp = client.do(ctx, http.MethodGet, "/v2/localhost/plain/blobs/"+plainImg.LayerDigest.String(), nil)
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		Expect(readBody(resp)).To(Equal(plainImg.Layer))
+	})
+
+	It("should serve manifest lists with their platforms and zstd layers", func(ctx context.Context) {
+		resp := client.do(ctx, http.MethodGet, "/v2/localhost/multi/manifests/v1", nil)
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		Expect(resp.Header.Get("Content-Type")).To(Equal(ociimage.MediaTypeImageIndex))
+		Expect(resp.Header.Get("Docker-Content-Digest")).To(Equal(godigest.FromBytes(listJSON).String()))
+		Expect(readBody(resp)).To(Equal(listJSON))
+
+		resp = client.do(ctx, http.MethodGet, "/v2/localhost/multi/manifests/"+zstdImg.Digest.String(), nil)
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		Expect(readBody(resp)).To(Equal(zstdImg.Manifest))
+
+		resp = client.do(ctx, http.MethodGet, "/v2/localhost/multi/blobs/"+zstdImg.LayerDigest.String(), nil)
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		Expect(readBody(resp)).To(Equal(zstdImg.Layer))
+	})
+
+	It("should serve manifest lists as podman parses them if podman does not export them", func(ctx context.Context) {
+		list.Export = instance.Export
+
+		resp := client.do(ctx, http.MethodGet, "/v2/localhost/multi/manifests/v1", nil)
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		var served ociimage.Index
+		Expect(json.NewDecoder(resp.Body).Decode(&served)).To(Succeed())
+		Expect(mustMarshal(served)).To(Equal(listJSON))
+
+		resp = client.do(ctx, http.MethodGet, "/v2/localhost/multi/blobs/"+zstdImg.LayerDigest.String(), nil)
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		Expect(readBody(resp)).To(Equal(zstdImg.Layer))
+	})
+
+	It("should list images with a single request", func(ctx context.Context) {
+		before := requests.Load()
+		images, err := backend.ImageList(ctx)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(images).To(HaveLen(3))
+		Expect(requests.Load()).To(Equal(before + 1))
+	})
+
+	It("should list the repositories of every image", func(ctx context.Context) {
+		resp := client.do(ctx, http.MethodGet, "/v2/_catalog", nil)
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		var catalog struct{ Repositories []string }
+		Expect(json.NewDecoder(resp.Body).Decode(&catalog)).To(Succeed())
+		Expect(catalog.Repositories).To(ConsistOf("localhost/plain", "localhost/multi"))
+	})
+})
@@ -0,0 +1,27 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"github.com/docker/docker/errdefs"
+)
+
+// pullImage pulls an image into the backend from its upstream registry.
+// Concurrent requests to pull the same image wait on the same pull.
+func (r *Registry) pullImage(ctx context.Context, ref string) error {
+	puller, ok := r.Backend.(PullingBackend)
+	if !ok {
+		return errdefs.NotFound(fmt.Errorf("%s not found and backend cannot pull images", ref))
+	}
+	return r.pulls.Do(ctx, ref, func(ctx context.Context) error {
+		slog.Info("pulling image on manifest miss", "ref", ref)
+		err := puller.ImagePull(ctx, ref)
+		if err != nil {
+			return fmt.Errorf("pulling %s: %w", ref, err)
+		}
+		slog.Info("pulled image", "ref", ref)
+		return nil
+	})
+}
@@ -0,0 +1,243 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	godigest "github.com/opencontainers/go-digest"
+	ociimage "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	// annotationImageName is the annotation containerd uses to name images when loading an OCI image layout
+	annotationImageName = "io.containerd.image.name"
+	// maxManifestSize is the largest manifest that will be accepted from a client
+	maxManifestSize = 4 * 1024 * 1024 // 4MiB
+)
+
+var (
+	// errManifestInvalid is returned when a pushed manifest cannot be parsed or does not match its reference
+	errManifestInvalid = &registryError{Status: http.StatusBadRequest, Code: codeManifestInvalid, Message: "manifest invalid"}
+	// errManifestBlobUnknown is returned when a pushed manifest refers to a blob that was not uploaded
+	errManifestBlobUnknown = &registryError{Status: http.StatusBadRequest, Code: codeManifestBlobUnknown, Message: "manifest references a blob that was not uploaded"}
+	// errIndexPushUnsupported is returned when an image index is pushed to a backend which cannot store one
+	errIndexPushUnsupported = &registryError{Status: http.StatusBadRequest, Code: codeUnsupported, Message: "image indexes can only be pushed to backends which store blobs"}
+)
+
+// pushManifest loads an image consisting of a pushed manifest and its previously uploaded blobs into the daemon,
+// or adds it to the backend directly if the blobs were uploaded into it, tags it as name:reference (if reference is
+// a tag), and returns the digest of the manifest.
+func (r *Registry) pushManifest(ctx context.Context, name, reference, mediaType string, manifestJSON []byte) (godigest.Digest, error) {
+	dgst := godigest.FromBytes(manifestJSON)
+	refDigest, err := godigest.Parse(reference)
+	isDigest := err == nil
+	if !isDigest && strings.Contains(reference, ":") {
+		// Tags cannot contain colons, so this is a digest which is malformed or uses an unavailable algorithm
+		return "", fmt.Errorf("%w: %w", errManifestInvalid, err)
+	}
+	if isDigest {
+		dgst = refDigest.Algorithm().FromBytes(manifestJSON)
+		if refDigest != dgst {
+			return "", fmt.Errorf("%w: digest is %s but was pushed as %s", errManifestInvalid, dgst, reference)
+		}
+	}
+
+	var manifest ociimage.Manifest
+	err = json.Unmarshal(manifestJSON, &manifest)
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", errManifestInvalid, err)
+	}
+	if manifest.MediaType == "" {
+		manifest.MediaType = mediaType
+	}
+	switch manifest.MediaType {
+	case ociimage.MediaTypeImageManifest, mediaTypeDockerManifest:
+	case ociimage.MediaTypeImageIndex, mediaTypeDockerManifestList:
+		return r.pushIndex(ctx, name, reference, isDigest, dgst, manifest.MediaType, manifestJSON)
+	default:
+		return "", fmt.Errorf("%w: unsupported media type %s, only image manifests and indexes can be pushed", errManifestInvalid, manifest.MediaType)
+	}
+
+	descriptors := make([]ociimage.Descriptor, 0, len(manifest.Layers)+1)
+	descriptors = append(descriptors, manifest.Config)
+	descriptors = append(descriptors, manifest.Layers...)
+	blobs := make([]archiveBlob, 0, len(descriptors)+1)
+	dockerManifest := dockerArchiveManifest{
+		Config: archiveBlobPath(manifest.Config.Digest),
+	}
+	for _, desc := range descriptors {
+		size, err := r.ensureBlobStaged(ctx, name, desc.Digest)
+		if err != nil {
+			return "", err
+		}
+		blobPath := r.stagedBlobPath(desc.Digest)
+		blobs = append(blobs, archiveBlob{
+			Digest: desc.Digest,
+			Size:   size,
+			Open:   func() (io.ReadCloser, error) { return os.Open(blobPath) },
+		})
+	}
+	for _, layer := range manifest.Layers {
+		dockerManifest.Layers = append(dockerManifest.Layers, archiveBlobPath(layer.Digest))
+	}
+	blobs = append(blobs, archiveBlob{
+		Digest: dgst,
+		Size:   int64(len(manifestJSON)),
+		Open:   func() (io.ReadCloser, error) { return io.NopCloser(bytes.NewReader(manifestJSON)), nil },
+	})
+
+	imageRef, desc := pushedDescriptor(name, reference, isDigest, manifest.MediaType, dgst, manifestJSON)
+	if !isDigest {
+		dockerManifest.RepoTags = []string{imageRef}
+	}
+
+	if store, ok := r.Backend.(BlobStoringBackend); ok {
+		// The blobs were uploaded into the backend, so only the manifest needs to be written to it
+		err = r.stageBlob(bytes.NewReader(manifestJSON), dgst)
+		if err == nil {
+			err = store.ImagePut(ctx, desc)
+		}
+	} else {
+		err = r.loadArchive(ctx, ociimage.Index{Manifests: []ociimage.Descriptor{desc}}, []dockerArchiveManifest{dockerManifest}, blobs)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	img, err := r.Backend.ImageInspect(ctx, imageRef)
+	if err != nil && isDigest {
+		// Daemons without the containerd image store do not know images by manifest digest
+		img, err = r.Backend.ImageInspect(ctx, manifest.Config.Digest.String())
+	}
+	if err != nil {
+		return "", fmt.Errorf("inspecting loaded image: %w", err)
+	}
+	r.cacheManifest(&img, cachedManifest{
+		JSON:      json.RawMessage(manifestJSON),
+		MediaType: manifest.MediaType,
+		Digest:    dgst,
+		Manifest:  manifest,
+	})
+
+	return dgst, nil
+}
+
+// pushIndex adds a pushed image index or manifest list to a backend which stores blobs, tags it as name:reference
+// (if reference is a tag), and returns its digest.
+// Clients push the manifests of an index before the index itself, so each of them must already be known.
+// Daemons only load an index along with every manifest in it, which are already separate images, so indexes cannot
+// be pushed to other backends.
+func (r *Registry) pushIndex(ctx context.Context, name, reference string, isDigest bool, dgst godigest.Digest, mediaType string, indexJSON []byte) (godigest.Digest, error) {
+	store, ok := r.Backend.(BlobStoringBackend)
+	if !ok {
+		return "", errIndexPushUnsupported
+	}
+
+	var index ociimage.Index
+	err := json.Unmarshal(indexJSON, &index)
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", errManifestInvalid, err)
+	}
+	for _, child := range index.Manifests {
+		if _, ok := r.statStagedBlob(child.Digest); !ok {
+			return "", fmt.Errorf("%w: %s", errManifestBlobUnknown, child.Digest)
+		}
+	}
+
+	imageRef, desc := pushedDescriptor(name, reference, isDigest, mediaType, dgst, indexJSON)
+	err = r.stageBlob(bytes.NewReader(indexJSON), dgst)
+	if err == nil {
+		err = store.ImagePut(ctx, desc)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	img, err := r.Backend.ImageInspect(ctx, imageRef)
+	if err != nil {
+		return "", fmt.Errorf("inspecting loaded image: %w", err)
+	}
+	_, err = r.getAndCacheManifest(ctx, &img)
+	if err != nil {
+		return "", err
+	}
+
+	return dgst, nil
+}
+
+// pushedDescriptor returns the reference to find a pushed manifest by once it has been added to the backend, and
+// the descriptor to add it with, which tags it as name:reference if reference is a tag
+func pushedDescriptor(name, reference string, isDigest bool, mediaType string, dgst godigest.Digest, manifestJSON []byte) (string, ociimage.Descriptor) {
+	desc := ociimage.Descriptor{
+		MediaType: mediaType,
+		Digest:    dgst,
+		Size:      int64(len(manifestJSON)),
+	}
+	if isDigest {
+		return name + "@" + dgst.String(), desc
+	}
+	imageRef := name + ":" + reference
+	desc.Annotations = map[string]string{
+		annotationImageName:        imageRef,
+		ociimage.AnnotationRefName: reference,
+	}
+	return imageRef, desc
+}
+
+// ensureBlobStaged checks that a blob has been uploaded, returning its size.
+// Staged blobs are left for ExpireUploads to remove, as other manifests being pushed concurrently may share them,
+// so the blob is marked as used to keep it from expiring while the image is loaded.
+// Clients skip uploading blobs that a HEAD request reports already exist, so blobs that are not staged,
+// but which belong to an image in the same repository, are copied out of the daemon instead.
+func (r *Registry) ensureBlobStaged(ctx context.Context, name string, dgst godigest.Digest) (int64, error) {
+	size, ok := r.statStagedBlob(dgst)
+	if _, isStore := r.Backend.(BlobStoringBackend); ok && isStore {
+		// Blobs in the backend are never expired
+		return size, nil
+	}
+	if ok {
+		now := time.Now()
+		err := os.Chtimes(r.stagedBlobPath(dgst), now, now)
+		if err != nil {
+			slog.Warn("failed to mark staged blob as used", "digest", dgst, "error", err)
+		}
+		return size, nil
+	}
+	img, err := r.findImageForBlob(name, dgst.String())
+	if err != nil {
+		return 0, fmt.Errorf("%w: %s", errManifestBlobUnknown, dgst)
+	}
+	blob, _, err := r.openImageBlob(ctx, img, dgst.String())
+	if err != nil {
+		return 0, err
+	}
+	defer blob.Close()
+	err = r.stageBlob(blob, dgst)
+	if err != nil {
+		return 0, fmt.Errorf("copying blob %s from daemon: %w", dgst, err)
+	}
+	size, ok = r.statStagedBlob(dgst)
+	if !ok {
+		return 0, fmt.Errorf("%w: %s", errManifestBlobUnknown, dgst)
+	}
+	return size, nil
+}
+
+// loadArchive streams an OCI image layout tarball into the daemon
+func (r *Registry) loadArchive(ctx context.Context, index ociimage.Index, dockerManifests []dockerArchiveManifest, blobs []archiveBlob) error {
+	archiveR, archiveW := io.Pipe()
+	go func() {
+		archiveW.CloseWithError(writeOCIArchive(archiveW, index, dockerManifests, blobs))
+	}()
+	defer archiveR.Close()
+
+	return r.Backend.ImageLoad(ctx, archiveR)
+}
@@ -0,0 +1,148 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"slices"
+	"strings"
+
+	"github.com/docker/docker/errdefs"
+
+	godigest "github.com/opencontainers/go-digest"
+	ociimage "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	// annotationDockerReferenceDigest is the annotation buildx places on the descriptor of an attestation manifest
+	// to identify the manifest it is attesting to, in lieu of a subject
+	annotationDockerReferenceDigest = "vnd.docker.reference.digest"
+	// annotationDockerReferenceType is the annotation buildx places on the descriptor of an attestation manifest
+	annotationDockerReferenceType = "vnd.docker.reference.type"
+)
+
+// listReferrers returns descriptors of every manifest in the given repository whose subject is the given digest.
+// Docker does not track referrers, so they are found among the cached manifests, which include every manifest in
+// the exported tarball of each image, such as the attestations buildx stores in the index of an image. The
+// manifests of the repository are read first if they are not cached yet, so that referrers are found regardless of
+// which manifests have been fetched before.
+// If artifactType is not empty, only manifests with that artifact type are returned.
+func (r *Registry) listReferrers(ctx context.Context, name, digest, artifactType string) ([]ociimage.Descriptor, error) {
+	err := r.loadReferrers(ctx, name, digest)
+	if err != nil {
+		return nil, err
+	}
+
+	r.cacheLock.RLock()
+	defer r.cacheLock.RUnlock()
+
+	referrers := []ociimage.Descriptor{}
+	seen := make(map[godigest.Digest]struct{})
+	add := func(referrer ociimage.Descriptor) {
+		if _, ok := seen[referrer.Digest]; ok {
+			return
+		}
+		seen[referrer.Digest] = struct{}{}
+		if artifactType != "" && referrer.ArtifactType != artifactType {
+			return
+		}
+		referrers = append(referrers, referrer)
+	}
+	for _, indexed := range r.manifestDigests {
+		if !inRepo(indexed.Image, name) {
+			continue
+		}
+		manifest := &indexed.Manifest
+		if !manifest.IsIndex() {
+			if manifest.Manifest.Subject != nil && string(manifest.Manifest.Subject.Digest) == digest {
+				add(asReferrer(ociimage.Descriptor{MediaType: manifest.MediaType}, manifest, false))
+			}
+			continue
+		}
+		// buildx identifies attestations by the annotations of their descriptors in the index instead of a subject
+		for _, desc := range manifest.Index.Manifests {
+			if desc.Annotations[annotationDockerReferenceDigest] != digest || desc.Annotations[annotationDockerReferenceType] == "" {
+				continue
+			}
+			attestation, ok := r.manifestDigests[string(desc.Digest)]
+			if !ok || attestation.Manifest.IsIndex() {
+				continue
+			}
+			add(asReferrer(desc, &attestation.Manifest, true))
+		}
+	}
+	slices.SortFunc(referrers, func(a, b ociimage.Descriptor) int { return strings.Compare(string(a.Digest), string(b.Digest)) })
+	return referrers, nil
+}
+
+// loadReferrers caches the manifests which may refer to the given digest in the given repository.
+// The image of the subject is resolved first, as attestations are stored in its index, then the manifests of the
+// other images in the repository which are not cached yet are read, as referrers pushed by clients are images of
+// their own.
+func (r *Registry) loadReferrers(ctx context.Context, name, digest string) error {
+	img, ok := r.findImageByDescriptor(name, digest)
+	if !ok {
+		var err error
+		img, err = r.findImageByRepoDigest(ctx, name, digest)
+		if err != nil && !errdefs.IsNotFound(err) {
+			return err
+		}
+	}
+	if img != nil {
+		_, err := r.getAndCacheManifest(ctx, img)
+		if err != nil && !errdefs.IsNotFound(err) {
+			return err
+		}
+	}
+	return r.loadRepoManifests(ctx, name)
+}
+
+// reachableManifests returns the descriptors of every manifest in the index of the tarball, and of every manifest
+// in any nested index present in the tarball.
+func (s *savedImage) reachableManifests() []ociimage.Descriptor {
+	var descs []ociimage.Descriptor
+	toVisit := append([]ociimage.Descriptor{}, s.Index.Manifests...)
+	visited := make(map[string]struct{})
+	for len(toVisit) != 0 {
+		desc := toVisit[0]
+		toVisit = toVisit[1:]
+		if _, ok := visited[string(desc.Digest)]; ok {
+			continue
+		}
+		visited[string(desc.Digest)] = struct{}{}
+		descs = append(descs, desc)
+		if !isIndexMediaType(desc.MediaType) {
+			continue
+		}
+		var nested ociimage.Index
+		if json.Unmarshal(s.SmallBlobs[string(desc.Digest)], &nested) != nil {
+			continue
+		}
+		toVisit = append(toVisit, nested.Manifests...)
+	}
+	return descs
+}
+
+// asReferrer returns the descriptor to list a manifest with in the referrers API, given the descriptor it was
+// found by, and whether it is an attestation identified by the annotations of that descriptor
+func asReferrer(desc ociimage.Descriptor, manifest *cachedManifest, isAttestation bool) ociimage.Descriptor {
+	referrer := ociimage.Descriptor{
+		MediaType:    manifest.Manifest.MediaType,
+		Digest:       manifest.Digest,
+		Size:         int64(len(manifest.JSON)),
+		ArtifactType: manifest.Manifest.ArtifactType,
+		Annotations:  manifest.Manifest.Annotations,
+	}
+	if referrer.MediaType == "" {
+		referrer.MediaType = desc.MediaType
+	}
+	if referrer.ArtifactType == "" {
+		referrer.ArtifactType = manifest.Manifest.Config.MediaType
+	}
+	if isAttestation && referrer.Annotations == nil {
+		referrer.Annotations = map[string]string{
+			annotationDockerReferenceDigest: desc.Annotations[annotationDockerReferenceDigest],
+			annotationDockerReferenceType:   desc.Annotations[annotationDockerReferenceType],
+		}
+	}
+	return referrer
+}
@@ -5,40 +5,117 @@ import (
 	"os"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/meln5674/minimux"
 
+	"github.com/distribution/reference"
 	"github.com/docker/docker/api/types/image"
-	docker "github.com/docker/docker/client"
 )
 
 type Config struct {
-	// Docker is the client connected to the docker daemon
-	Docker *docker.Client
+	// Backend is the store of images to serve, such as a DockerBackend, or a FederatedBackend of several
+	Backend Backend
 	// Prefixes is a set of image ref prefixes that are proxied by this registry
 	Prefixes map[string]struct{}
+	// UploadDir is a directory to stage pushed blobs in until a manifest refers to them.
+	// Blobs are written into backends which store them as files, such as an OCI image layout, once their upload
+	// finishes instead. Pushing is disabled if not set.
+	UploadDir string
+	// UploadTTL is how long an upload session may go without receiving data before it is expired and the data it
+	// received is removed, and how long a staged blob is kept after a manifest last used it.
+	// Defaults to 24 hours if not positive.
+	UploadTTL time.Duration
+	// PullThrough causes requests for manifests of images not present in the daemon to pull them from
+	// their upstream registry instead of failing.
+	PullThrough bool
+	// AllowDelete allows clients to delete manifests, which untags the matching images in the daemon.
+	AllowDelete bool
+	// BlobCacheDir is a directory to keep blobs exported from the daemon in, so that they can be served without
+	// exporting their image again. Blobs are exported for every request if not set.
+	BlobCacheDir string
+	// BlobCacheSize is the total size in bytes that the blob cache is allowed to grow to before the least
+	// recently used blobs are evicted. The cache is unbounded if not positive.
+	BlobCacheSize int64
+	// MaxConcurrentExports limits the number of different images that are exported from the daemon at once.
+	// Concurrent requests for the same image share one export if they arrive before the daemon starts sending it.
+	// Unlimited if not positive.
+	MaxConcurrentExports int
+	// ExportDir is a directory to buffer exports from the daemon in while they are read, so that they can be
+	// shared by concurrent requests. Exports read by only one request are not buffered.
+	// The system temporary directory is used if not set.
+	ExportDir string
+	// HtpasswdPath is the path to an htpasswd file of bcrypt hashed passwords to require basic auth against.
+	// The file is read again when it changes, checking at most once a second, and should be loaded with
+	// LoadHtpasswd before serving requests. Authentication is disabled if not set.
+	HtpasswdPath string
 }
 
 type Registry struct {
 	Config
 	// blobIndex is a map from image layer blob IDs to a second map from image IDs to the image metadata.
 	blobIndex map[string]map[string]*image.InspectResponse
+	// diffIDs is a map from the uncompressed diffID of an image layer to the digest of that layer in its manifest
+	diffIDs map[string]string
 	// manifestCache is a map from image ID to the parsed oci image manifest descriptor
 	manifestCache map[string]cachedManifest
+	// manifestDigests is a map from manifest digest to cached manifests and the images they belong to,
+	// including the per-platform manifests of image indexes
+	manifestDigests map[string]indexedManifest
 	// indexLock must be held when using the index
 	indexLock sync.RWMutex
 	// cacheLock must be held when using the cache
 	cacheLock sync.RWMutex
+	// uploads is a map from upload session IDs to in-progress blob uploads
+	uploads map[string]*uploadSession
+	// uploadLock must be held when using uploads
+	uploadLock sync.Mutex
+	// pulls deduplicates concurrent pull-through requests for the same image
+	pulls flightGroup
+	// manifests deduplicates concurrent requests to read the manifest of the same image
+	manifests flightGroup
+	// exports shares exports of the same image between concurrent requests
+	exports exportGroup
+	// blobCache holds blobs that have been exported from the daemon, or is nil if BlobCacheDir is not set
+	blobCache *blobCache
+	// htpasswd holds the credentials to authenticate requests against, or is nil if HtpasswdPath is not set
+	htpasswd *htpasswdFile
 }
 
 func New(cfg Config) *Registry {
+	var cache *blobCache
+	if cfg.BlobCacheDir != "" {
+		cache = newBlobCache(cfg.BlobCacheDir, cfg.BlobCacheSize)
+	}
+	var htpasswd *htpasswdFile
+	if cfg.HtpasswdPath != "" {
+		htpasswd = newHtpasswdFile(cfg.HtpasswdPath)
+	}
 	return &Registry{
-		Config:        cfg,
-		blobIndex:     map[string]map[string]*image.InspectResponse{},
-		manifestCache: map[string]cachedManifest{},
+		Config:          cfg,
+		blobIndex:       map[string]map[string]*image.InspectResponse{},
+		diffIDs:         map[string]string{},
+		manifestCache:   map[string]cachedManifest{},
+		manifestDigests: map[string]indexedManifest{},
+		uploads:         map[string]*uploadSession{},
+		blobCache:       cache,
+		htpasswd:        htpasswd,
 	}
 }
 
+// checkName returns an error if a repository name from a request is not a valid image name, or does not have any
+// of the allowed prefixes
+func (r *Registry) checkName(name string) error {
+	named, err := reference.ParseNormalizedNamed(name)
+	if err != nil || !reference.IsNameOnly(named) {
+		return errNameInvalid
+	}
+	if !r.HasAllowedPrefix(name) {
+		return errNameNotAllowed
+	}
+	return nil
+}
+
 func (r *Registry) HasAllowedPrefix(name string) bool {
 	if r.Prefixes == nil {
 		return true
@@ -61,6 +138,10 @@ func (r *Registry) BuildHandler() http.Handler {
 				LiteralPath("/v2/").
 				WithMethods(http.MethodGet).
 				IsHandledByFunc(r.end_1),
+			minimux.
+				LiteralPath("/v2/_catalog").
+				WithMethods(http.MethodGet).
+				IsHandledByFunc(r.catalog),
 			minimux.
 				PathWithVars("/v2/(.+)/blobs/([^/]+)", "name", "digest").
 				WithMethods(http.MethodGet, http.MethodHead).
@@ -78,15 +159,23 @@ func (r *Registry) BuildHandler() http.Handler {
 				WithMethods(http.MethodPatch).
 				IsHandledByFunc(r.end_5),
 			minimux.
-				PathWithVars("/v2/(.+)/blobs/uploads/([^/]+)", "name").
+				PathWithVars("/v2/(.+)/blobs/uploads/([^/]+)", "name", "reference").
 				WithMethods(http.MethodPut).
 				IsHandledByFunc(r.end_6),
+			minimux.
+				PathWithVars("/v2/(.+)/blobs/uploads/([^/]+)", "name", "reference").
+				WithMethods(http.MethodGet).
+				IsHandledByFunc(r.end_13),
+			minimux.
+				PathWithVars("/v2/(.+)/blobs/uploads/([^/]+)", "name", "reference").
+				WithMethods(http.MethodDelete).
+				IsHandledByFunc(r.cancelUpload),
 			minimux.
 				PathWithVars("/v2/(.+)/manifests/([^/]+)", "name", "reference").
 				WithMethods(http.MethodPut).
 				IsHandledByFunc(r.end_7),
 			minimux.
-				PathWithVars("/v2/(.+)/tags", "name").
+				PathWithVars("/v2/(.+)/tags/list", "name").
 				WithMethods(http.MethodGet).
 				IsHandledByFunc(r.end_8a_8b),
 			minimux.
@@ -96,15 +185,21 @@ func (r *Registry) BuildHandler() http.Handler {
 			minimux.
 				PathWithVars("/v2/(.+)/blobs/([^/]+)", "name", "digest").
 				WithMethods(http.MethodDelete).
-				IsHandledByFunc(r.end_12a_12b),
+				IsHandledByFunc(r.end_10),
 			minimux.
-				PathWithVars("/v2/(.+)/blobs/uploads/([^/]+)", "name", "reference").
-				WithMethods(http.MethodDelete).
-				IsHandledByFunc(r.end_13),
+				PathWithVars("/v2/(.+)/referrers/([^/]+)", "name", "digest").
+				WithMethods(http.MethodGet).
+				IsHandledByFunc(r.end_12a_12b),
 		},
 	}
-	// TODO: Do we need this?
-	// mux.HandleFunc("GET /v2/{name}/referrers/{digest}", r.end_12a_12b)
+
+	if r.htpasswd != nil {
+		mux.PreProcess = minimux.PreProcessorChain(mux.PreProcess, r.authenticate)
+		mux.DefaultHandler = requireAuth(mux.DefaultHandler)
+		for i := range mux.Routes {
+			mux.Routes[i].Handler = requireAuth(mux.Routes[i].Handler)
+		}
+	}
 
 	return &mux
 }
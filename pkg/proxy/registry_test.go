@@ -0,0 +1,670 @@
+package proxy_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/errdefs"
+
+	"github.com/meln5674/oci-reg-docker/pkg/proxy"
+	ocidist "github.com/opencontainers/distribution-spec/specs-go/v1"
+	godigest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go"
+	ociimage "github.com/opencontainers/image-spec/specs-go/v1"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// testImage is an image built from scratch to push to and pull from a registry
+type testImage struct {
+	Layer        []byte
+	Config       []byte
+	Manifest     []byte
+	LayerDigest  godigest.Digest
+	ConfigDigest godigest.Digest
+	Digest       godigest.Digest
+}
+
+func newTestImage(content string) testImage {
+	var img testImage
+	// Layers are not inspected by the registry, so they do not need to be valid tarballs
+	img.Layer = []byte(content)
+	img.LayerDigest = godigest.FromBytes(img.Layer)
+	var err error
+	img.Config, err = json.Marshal(ociimage.Image{
+		Platform: ociimage.Platform{Architecture: "amd64", OS: "linux"},
+		RootFS:   ociimage.RootFS{Type: "layers", DiffIDs: []godigest.Digest{img.LayerDigest}},
+	})
+	Expect(err).ToNot(HaveOccurred())
+	img.ConfigDigest = godigest.FromBytes(img.Config)
+	img.Manifest, err = json.Marshal(ociimage.Manifest{
+		Versioned: ocispec.Versioned{SchemaVersion: 2},
+		MediaType: ociimage.MediaTypeImageManifest,
+		Config:    ociimage.Descriptor{MediaType: ociimage.MediaTypeImageConfig, Digest: img.ConfigDigest, Size: int64(len(img.Config))},
+		Layers:    []ociimage.Descriptor{{MediaType: ociimage.MediaTypeImageLayer, Digest: img.LayerDigest, Size: int64(len(img.Layer))}},
+	})
+	Expect(err).ToNot(HaveOccurred())
+	img.Digest = godigest.FromBytes(img.Manifest)
+	return img
+}
+
+// newCompressedTestImage returns a test image whose layer is stored compressed, so that its digest differs from
+// its diffID, as with images in the containerd image store
+func newCompressedTestImage(content string) testImage {
+	img := newTestImage(content)
+	img.Config = mustMarshal(ociimage.Image{
+		Platform: ociimage.Platform{Architecture: "amd64", OS: "linux"},
+		RootFS:   ociimage.RootFS{Type: "layers", DiffIDs: []godigest.Digest{godigest.FromString("uncompressed " + content)}},
+	})
+	img.ConfigDigest = godigest.FromBytes(img.Config)
+	img.Manifest = mustMarshal(ociimage.Manifest{
+		Versioned: ocispec.Versioned{SchemaVersion: 2},
+		MediaType: ociimage.MediaTypeImageManifest,
+		Config:    ociimage.Descriptor{MediaType: ociimage.MediaTypeImageConfig, Digest: img.ConfigDigest, Size: int64(len(img.Config))},
+		Layers:    []ociimage.Descriptor{{MediaType: ociimage.MediaTypeImageLayerGzip, Digest: img.LayerDigest, Size: int64(len(img.Layer))}},
+	})
+	img.Digest = godigest.FromBytes(img.Manifest)
+	return img
+}
+
+// registryClient makes requests to a registry under test
+type registryClient struct {
+	srv *httptest.Server
+}
+
+func (c registryClient) do(ctx context.Context, method, path string, body []byte, headers ...string) *http.Response {
+	req, err := http.NewRequestWithContext(ctx, method, c.srv.URL+path, bytes.NewReader(body))
+	Expect(err).ToNot(HaveOccurred())
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	resp, err := c.srv.Client().Do(req)
+	Expect(err).ToNot(HaveOccurred())
+	DeferCleanup(resp.Body.Close)
+	return resp
+}
+
+func (c registryClient) push(ctx context.Context, name, reference string, img testImage) {
+	for _, blob := range [][]byte{img.Layer, img.Config} {
+		resp := c.do(ctx, http.MethodPost, "/v2/"+name+"/blobs/uploads/?digest="+godigest.FromBytes(blob).String(), blob)
+		Expect(resp.StatusCode).To(Equal(http.StatusCreated))
+	}
+	resp := c.do(ctx, http.MethodPut, "/v2/"+name+"/manifests/"+reference, img.Manifest, "Content-Type", ociimage.MediaTypeImageManifest)
+	Expect(resp.StatusCode).To(Equal(http.StatusCreated), string(readBody(resp)))
+	Expect(resp.Header.Get("Docker-Content-Digest")).To(Equal(img.Digest.String()))
+}
+
+func readBody(resp *http.Response) []byte {
+	body, err := io.ReadAll(resp.Body)
+	Expect(err).ToNot(HaveOccurred())
+	return body
+}
+
+func expectErrorCode(resp *http.Response, status int, code string) {
+	Expect(resp.StatusCode).To(Equal(status))
+	var errResp ocidist.ErrorResponse
+	Expect(json.NewDecoder(resp.Body).Decode(&errResp)).To(Succeed())
+	Expect(errResp.Errors).To(HaveLen(1))
+	Expect(errResp.Errors[0].Code).To(Equal(code))
+}
+
+// startRegistry serves a registry with the given backend until the end of the current spec
+func startRegistry(ctx context.Context, backend proxy.Backend) registryClient {
+	reg := proxy.New(proxy.Config{
+		Backend:     backend,
+		UploadDir:   filepath.Join(GinkgoT().TempDir(), "uploads"),
+		AllowDelete: true,
+	})
+	Expect(reg.BuildIndex(ctx)).To(Succeed())
+	srv := httptest.NewServer(reg.BuildHandler())
+	DeferCleanup(srv.Close)
+	return registryClient{srv: srv}
+}
+
+// itServesPushedImages describes the behavior expected of a registry using any backend which accepts pushes
+func itServesPushedImages(newBackend func() proxy.Backend) {
+	var client registryClient
+
+	BeforeEach(func(ctx context.Context) {
+		client = startRegistry(ctx, newBackend())
+	})
+
+	It("should report API support", func(ctx context.Context) {
+		resp := client.do(ctx, http.MethodGet, "/v2/", nil)
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+	})
+
+	It("should report unknown blobs", func(ctx context.Context) {
+		resp := client.do(ctx, http.MethodGet, "/v2/test/app/blobs/"+godigest.FromString("missing").String(), nil)
+		expectErrorCode(resp, http.StatusNotFound, "BLOB_UNKNOWN")
+	})
+
+	It("should report unknown manifests", func(ctx context.Context) {
+		resp := client.do(ctx, http.MethodGet, "/v2/test/app/manifests/missing", nil)
+		expectErrorCode(resp, http.StatusNotFound, "MANIFEST_UNKNOWN")
+	})
+
+	It("should accept manifests sharing uploaded blobs", func(ctx context.Context) {
+		img := newTestImage("shared content")
+		for _, name := range []string{"test/first", "test/second"} {
+			for _, blob := range [][]byte{img.Layer, img.Config} {
+				resp := client.do(ctx, http.MethodPost, "/v2/"+name+"/blobs/uploads/?digest="+godigest.FromBytes(blob).String(), blob)
+				Expect(resp.StatusCode).To(Equal(http.StatusCreated))
+			}
+		}
+		for _, name := range []string{"test/first", "test/second"} {
+			resp := client.do(ctx, http.MethodPut, "/v2/"+name+"/manifests/v1", img.Manifest, "Content-Type", ociimage.MediaTypeImageManifest)
+			Expect(resp.StatusCode).To(Equal(http.StatusCreated), string(readBody(resp)))
+		}
+	})
+
+	When("an image has been pushed", func() {
+		var img testImage
+		BeforeEach(func(ctx context.Context) {
+			img = newTestImage("layer content")
+			client.push(ctx, "test/app", "v1", img)
+		})
+
+		It("should serve the manifest by tag", func(ctx context.Context) {
+			resp := client.do(ctx, http.MethodGet, "/v2/test/app/manifests/v1", nil)
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			Expect(resp.Header.Get("Content-Type")).To(Equal(ociimage.MediaTypeImageManifest))
+			Expect(resp.Header.Get("Docker-Content-Digest")).To(Equal(img.Digest.String()))
+			Expect(resp.Header.Get("ETag")).To(Equal(`"` + img.Digest.String() + `"`))
+			Expect(readBody(resp)).To(Equal(img.Manifest))
+		})
+
+		It("should serve the manifest by digest", func(ctx context.Context) {
+			resp := client.do(ctx, http.MethodGet, "/v2/test/app/manifests/"+img.Digest.String(), nil)
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			Expect(readBody(resp)).To(Equal(img.Manifest))
+		})
+
+		It("should answer HEAD for the manifest without a body", func(ctx context.Context) {
+			resp := client.do(ctx, http.MethodHead, "/v2/test/app/manifests/v1", nil)
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			Expect(resp.ContentLength).To(Equal(int64(len(img.Manifest))))
+			Expect(resp.Header.Get("Docker-Content-Digest")).To(Equal(img.Digest.String()))
+			Expect(readBody(resp)).To(BeEmpty())
+		})
+
+		It("should honor If-None-Match for the manifest", func(ctx context.Context) {
+			resp := client.do(ctx, http.MethodGet, "/v2/test/app/manifests/v1", nil, "If-None-Match", `"`+img.Digest.String()+`"`)
+			Expect(resp.StatusCode).To(Equal(http.StatusNotModified))
+		})
+
+		It("should serve the blobs", func(ctx context.Context) {
+			resp := client.do(ctx, http.MethodGet, "/v2/test/app/blobs/"+img.LayerDigest.String(), nil)
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			Expect(resp.Header.Get("Docker-Content-Digest")).To(Equal(img.LayerDigest.String()))
+			Expect(readBody(resp)).To(Equal(img.Layer))
+
+			resp = client.do(ctx, http.MethodGet, "/v2/test/app/blobs/"+img.ConfigDigest.String(), nil)
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			Expect(readBody(resp)).To(Equal(img.Config))
+		})
+
+		It("should answer HEAD for a blob without a body", func(ctx context.Context) {
+			resp := client.do(ctx, http.MethodHead, "/v2/test/app/blobs/"+img.LayerDigest.String(), nil)
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			Expect(resp.ContentLength).To(Equal(int64(len(img.Layer))))
+			Expect(readBody(resp)).To(BeEmpty())
+		})
+
+		It("should serve a range of a blob", func(ctx context.Context) {
+			resp := client.do(ctx, http.MethodGet, "/v2/test/app/blobs/"+img.LayerDigest.String(), nil, "Range", "bytes=6-12")
+			Expect(resp.StatusCode).To(Equal(http.StatusPartialContent))
+			Expect(resp.Header.Get("Content-Range")).To(Equal("bytes 6-12/13"))
+			Expect(readBody(resp)).To(Equal(img.Layer[6:13]))
+		})
+
+		It("should reject an unsatisfiable range of a blob", func(ctx context.Context) {
+			resp := client.do(ctx, http.MethodGet, "/v2/test/app/blobs/"+img.LayerDigest.String(), nil, "Range", "bytes=100-")
+			Expect(resp.StatusCode).To(Equal(http.StatusRequestedRangeNotSatisfiable))
+		})
+
+		It("should not serve the blobs in other repositories", func(ctx context.Context) {
+			resp := client.do(ctx, http.MethodGet, "/v2/test/other/blobs/"+img.LayerDigest.String(), nil)
+			expectErrorCode(resp, http.StatusNotFound, "BLOB_UNKNOWN")
+		})
+
+		It("should list the tag", func(ctx context.Context) {
+			resp := client.do(ctx, http.MethodGet, "/v2/test/app/tags/list", nil)
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			var tags ocidist.TagList
+			Expect(json.NewDecoder(resp.Body).Decode(&tags)).To(Succeed())
+			Expect(tags.Tags).To(ConsistOf("v1"))
+		})
+
+		It("should list the repository", func(ctx context.Context) {
+			resp := client.do(ctx, http.MethodGet, "/v2/_catalog", nil)
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			var catalog ocidist.RepositoryList
+			Expect(json.NewDecoder(resp.Body).Decode(&catalog)).To(Succeed())
+			Expect(catalog.Repositories).To(ConsistOf("docker.io/test/app"))
+		})
+
+		It("should list the referrers of the manifest", func(ctx context.Context) {
+			sig := newTestImage("signature layer")
+			sig.Manifest = mustMarshal(ociimage.Manifest{
+				Versioned:    ocispec.Versioned{SchemaVersion: 2},
+				MediaType:    ociimage.MediaTypeImageManifest,
+				ArtifactType: "application/vnd.example.signature",
+				Config:       ociimage.Descriptor{MediaType: ociimage.MediaTypeImageConfig, Digest: sig.ConfigDigest, Size: int64(len(sig.Config))},
+				Layers:       []ociimage.Descriptor{{MediaType: ociimage.MediaTypeImageLayer, Digest: sig.LayerDigest, Size: int64(len(sig.Layer))}},
+				Subject:      &ociimage.Descriptor{MediaType: ociimage.MediaTypeImageManifest, Digest: img.Digest, Size: int64(len(img.Manifest))},
+			})
+			sig.Digest = godigest.FromBytes(sig.Manifest)
+			client.push(ctx, "test/app", "sig", sig)
+
+			resp := client.do(ctx, http.MethodGet, "/v2/test/app/referrers/"+img.Digest.String(), nil)
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			var referrers ociimage.Index
+			Expect(json.NewDecoder(resp.Body).Decode(&referrers)).To(Succeed())
+			Expect(referrers.Manifests).To(HaveLen(1))
+			Expect(referrers.Manifests[0].Digest).To(Equal(sig.Digest))
+			Expect(referrers.Manifests[0].ArtifactType).To(Equal("application/vnd.example.signature"))
+
+			resp = client.do(ctx, http.MethodGet, "/v2/test/app/referrers/"+img.Digest.String()+"?artifactType=application/vnd.example.sbom", nil)
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			Expect(resp.Header.Get("OCI-Filters-Applied")).To(Equal("artifactType"))
+			referrers = ociimage.Index{}
+			Expect(json.NewDecoder(resp.Body).Decode(&referrers)).To(Succeed())
+			Expect(referrers.Manifests).To(BeEmpty())
+		})
+
+		It("should delete the manifest", func(ctx context.Context) {
+			resp := client.do(ctx, http.MethodDelete, "/v2/test/app/manifests/v1", nil)
+			Expect(resp.StatusCode).To(Equal(http.StatusAccepted))
+
+			resp = client.do(ctx, http.MethodGet, "/v2/test/app/manifests/v1", nil)
+			expectErrorCode(resp, http.StatusNotFound, "MANIFEST_UNKNOWN")
+		})
+	})
+}
+
+var _ = Describe("MemoryBackend", func() {
+	itServesPushedImages(func() proxy.Backend {
+		return proxy.NewMemoryBackend()
+	})
+})
+
+// countingBackend counts the images exported from a backend
+type countingBackend struct {
+	*proxy.MemoryBackend
+	saves atomic.Int32
+}
+
+func (c *countingBackend) ImageSave(ctx context.Context, imgID string) (io.ReadCloser, error) {
+	c.saves.Add(1)
+	return c.MemoryBackend.ImageSave(ctx, imgID)
+}
+
+// brokenBackend is a backend which fails to inspect images with an error revealing its internals
+type brokenBackend struct {
+	*proxy.MemoryBackend
+}
+
+func (brokenBackend) ImageInspect(context.Context, string) (image.InspectResponse, error) {
+	return image.InspectResponse{}, errors.New("open /var/lib/docker/image/overlay2/repositories.json: permission denied")
+}
+
+// rejectingBackend is a backend which rejects every export as invalid
+type rejectingBackend struct {
+	proxy.Backend
+}
+
+func (rejectingBackend) ImageSave(context.Context, string) (io.ReadCloser, error) {
+	return nil, errdefs.InvalidParameter(errors.New("invalid reference format"))
+}
+
+// digestBlindBackend is a backend which cannot find images by digest, as with a daemon asked for a digest in a
+// repository it did not pull the image from
+type digestBlindBackend struct {
+	proxy.Backend
+}
+
+func (d digestBlindBackend) ImageInspect(ctx context.Context, ref string) (image.InspectResponse, error) {
+	if strings.Contains(ref, "@") {
+		return image.InspectResponse{}, errdefs.NotFound(fmt.Errorf("no such image: %s", ref))
+	}
+	return d.Backend.ImageInspect(ctx, ref)
+}
+
+// classicStoreBackend is a backend which knows neither the manifests of its images nor the digests they were pushed
+// by, as with a docker daemon using the classic image store
+type classicStoreBackend struct {
+	proxy.Backend
+}
+
+func (c classicStoreBackend) ImageList(ctx context.Context) ([]image.Summary, error) {
+	imgSums, err := c.Backend.ImageList(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for ix := range imgSums {
+		imgSums[ix].RepoDigests = nil
+	}
+	return imgSums, nil
+}
+
+func (c classicStoreBackend) ImageInspect(ctx context.Context, ref string) (image.InspectResponse, error) {
+	if strings.Contains(ref, "@") {
+		return image.InspectResponse{}, errdefs.NotFound(fmt.Errorf("no such image: %s", ref))
+	}
+	img, err := c.Backend.ImageInspect(ctx, ref)
+	if err != nil {
+		return image.InspectResponse{}, err
+	}
+	img.Descriptor = nil
+	img.RepoDigests = nil
+	return img, nil
+}
+
+var _ = Describe("Registry", func() {
+	When("the backend fails", func() {
+		It("should not reveal the error to the client", func(ctx context.Context) {
+			client := startRegistry(ctx, brokenBackend{proxy.NewMemoryBackend()})
+			resp := client.do(ctx, http.MethodGet, "/v2/test/app/manifests/v1", nil)
+			Expect(resp.StatusCode).To(Equal(http.StatusInternalServerError))
+			var errResp ocidist.ErrorResponse
+			Expect(json.NewDecoder(resp.Body).Decode(&errResp)).To(Succeed())
+			Expect(errResp.Errors).To(HaveLen(1))
+			Expect(errResp.Errors[0].Code).To(Equal("UNKNOWN"))
+			Expect(errResp.Errors[0].Detail).To(BeEmpty())
+		})
+	})
+
+	When("the backend rejects a request as invalid", func() {
+		It("should report an invalid manifest on manifest routes, and an unsupported request otherwise", func(ctx context.Context) {
+			backend := proxy.NewMemoryBackend()
+			img := newTestImage("rejected layer")
+			startRegistry(ctx, backend).push(ctx, "test/app", "v1", img)
+
+			client := startRegistry(ctx, rejectingBackend{exportOnlyBackend{backend}})
+			resp := client.do(ctx, http.MethodGet, "/v2/test/app/manifests/v1", nil)
+			expectErrorCode(resp, http.StatusBadRequest, "MANIFEST_INVALID")
+			resp = client.do(ctx, http.MethodGet, "/v2/test/app/blobs/"+img.LayerDigest.String(), nil)
+			expectErrorCode(resp, http.StatusBadRequest, "UNSUPPORTED")
+		})
+	})
+
+	When("a repository name is invalid", func() {
+		It("should reject it", func(ctx context.Context) {
+			client := startRegistry(ctx, proxy.NewMemoryBackend())
+			resp := client.do(ctx, http.MethodGet, "/v2/Test/App/manifests/v1", nil)
+			expectErrorCode(resp, http.StatusBadRequest, "NAME_INVALID")
+		})
+	})
+
+	When("the backend can read blobs directly", func() {
+		It("should serve manifests and blobs without exporting their image", func(ctx context.Context) {
+			backend := &countingBackend{MemoryBackend: proxy.NewMemoryBackend()}
+			img := newTestImage("direct layer")
+			startRegistry(ctx, backend).push(ctx, "test/app", "v1", img)
+
+			// A fresh registry has nothing cached from the push
+			client := startRegistry(ctx, backend)
+			resp := client.do(ctx, http.MethodGet, "/v2/test/app/blobs/"+img.LayerDigest.String(), nil, "Range", "bytes=2-")
+			Expect(resp.StatusCode).To(Equal(http.StatusPartialContent))
+			Expect(readBody(resp)).To(Equal(img.Layer[2:]))
+			resp = client.do(ctx, http.MethodGet, "/v2/test/app/manifests/v1", nil)
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			Expect(readBody(resp)).To(Equal(img.Manifest))
+
+			Expect(backend.saves.Load()).To(BeZero())
+		})
+	})
+
+	When("the blob cache cannot be written", func() {
+		It("should still serve images exported from the backend", func(ctx context.Context) {
+			backend := exportOnlyBackend{proxy.NewMemoryBackend()}
+			img := newTestImage("uncacheable layer")
+			startRegistry(ctx, backend).push(ctx, "test/app", "v1", img)
+
+			// The cache directory cannot be created where a file already is
+			cacheDir := filepath.Join(GinkgoT().TempDir(), "cache")
+			Expect(os.WriteFile(cacheDir, nil, 0o600)).To(Succeed())
+			reg := proxy.New(proxy.Config{Backend: backend, BlobCacheDir: cacheDir})
+			Expect(reg.BuildIndex(ctx)).To(Succeed())
+			srv := httptest.NewServer(reg.BuildHandler())
+			DeferCleanup(srv.Close)
+			client := registryClient{srv: srv}
+
+			resp := client.do(ctx, http.MethodGet, "/v2/test/app/manifests/v1", nil)
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			Expect(readBody(resp)).To(Equal(img.Manifest))
+			resp = client.do(ctx, http.MethodGet, "/v2/test/app/blobs/"+img.LayerDigest.String(), nil)
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			Expect(readBody(resp)).To(Equal(img.Layer))
+		})
+	})
+
+	When("the index is built", func() {
+		It("should not export any image", func(ctx context.Context) {
+			backend := &countingBackend{MemoryBackend: proxy.NewMemoryBackend()}
+			img := newTestImage("indexed layer")
+			startRegistry(ctx, backend).push(ctx, "test/app", "v1", img)
+			backend.saves.Store(0)
+
+			client := startRegistry(ctx, exportOnlyBackend{backend})
+			Expect(backend.saves.Load()).To(BeZero())
+
+			// Uncompressed layers are indexed by their diffID
+			resp := client.do(ctx, http.MethodGet, "/v2/test/app/blobs/"+img.LayerDigest.String(), nil)
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			Expect(readBody(resp)).To(Equal(img.Layer))
+		})
+
+		It("should index compressed layers by digest if the backend can read manifests directly", func(ctx context.Context) {
+			backend := &countingBackend{MemoryBackend: proxy.NewMemoryBackend()}
+			img := newCompressedTestImage("compressed layer")
+			startRegistry(ctx, backend).push(ctx, "test/app", "v1", img)
+
+			client := startRegistry(ctx, backend)
+			resp := client.do(ctx, http.MethodGet, "/v2/test/app/blobs/"+img.LayerDigest.String(), nil)
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			Expect(readBody(resp)).To(Equal(img.Layer))
+			Expect(backend.saves.Load()).To(BeZero())
+		})
+	})
+
+	When("the daemon cannot find a manifest by digest", func() {
+		It("should find it from the index without exporting other images", func(ctx context.Context) {
+			backend := &countingBackend{MemoryBackend: proxy.NewMemoryBackend()}
+			img := newTestImage("found layer")
+			other := newTestImage("other layer")
+			pushClient := startRegistry(ctx, backend)
+			pushClient.push(ctx, "test/app", "v1", img)
+			pushClient.push(ctx, "test/app", "v2", other)
+			backend.saves.Store(0)
+
+			client := startRegistry(ctx, digestBlindBackend{exportOnlyBackend{backend}})
+			resp := client.do(ctx, http.MethodGet, "/v2/test/app/manifests/"+img.Digest.String(), nil)
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			Expect(readBody(resp)).To(Equal(img.Manifest))
+			Expect(backend.saves.Load()).To(BeNumerically("==", 1))
+		})
+
+		It("should read the manifests of the repository at most once to find a missing one", func(ctx context.Context) {
+			backend := &countingBackend{MemoryBackend: proxy.NewMemoryBackend()}
+			pushClient := startRegistry(ctx, backend)
+			pushClient.push(ctx, "test/app", "v1", newTestImage("found layer"))
+			pushClient.push(ctx, "test/app", "v2", newTestImage("other layer"))
+			pushClient.push(ctx, "test/other", "v1", newTestImage("unrelated layer"))
+			backend.saves.Store(0)
+
+			client := startRegistry(ctx, digestBlindBackend{exportOnlyBackend{backend}})
+			for range 2 {
+				resp := client.do(ctx, http.MethodGet, "/v2/test/app/manifests/"+godigest.FromString("missing").String(), nil)
+				expectErrorCode(resp, http.StatusNotFound, "MANIFEST_UNKNOWN")
+				Expect(backend.saves.Load()).To(BeNumerically("==", 2))
+			}
+		})
+
+		It("should find it after a restart without it having been fetched by tag", func(ctx context.Context) {
+			backend := proxy.NewMemoryBackend()
+			img := newTestImage("restarted layer")
+			startRegistry(ctx, backend).push(ctx, "test/app", "v1", img)
+
+			client := startRegistry(ctx, classicStoreBackend{exportOnlyBackend{backend}})
+			resp := client.do(ctx, http.MethodGet, "/v2/test/app/manifests/"+img.Digest.String(), nil)
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			Expect(resp.Header.Get("Docker-Content-Digest")).To(Equal(img.Digest.String()))
+			Expect(readBody(resp)).To(Equal(img.Manifest))
+		})
+	})
+
+	When("an image index is pushed to a daemon", func() {
+		It("should reject it as unsupported", func(ctx context.Context) {
+			client := startRegistry(ctx, proxy.NewMemoryBackend())
+			img := newTestImage("platform layer")
+			client.push(ctx, "test/app", img.Digest.String(), img)
+			indexJSON := mustMarshal(ociimage.Index{
+				Versioned: ocispec.Versioned{SchemaVersion: 2},
+				MediaType: ociimage.MediaTypeImageIndex,
+				Manifests: []ociimage.Descriptor{{MediaType: ociimage.MediaTypeImageManifest, Digest: img.Digest, Size: int64(len(img.Manifest))}},
+			})
+
+			resp := client.do(ctx, http.MethodPut, "/v2/test/app/manifests/v1", indexJSON, "Content-Type", ociimage.MediaTypeImageIndex)
+			expectErrorCode(resp, http.StatusBadRequest, "UNSUPPORTED")
+		})
+	})
+
+	When("a manifest is pushed by a digest using another algorithm", func() {
+		It("should push it by that digest", func(ctx context.Context) {
+			client := startRegistry(ctx, proxy.NewMemoryBackend())
+			img := newTestImage("sha512 layer")
+			for _, blob := range [][]byte{img.Layer, img.Config} {
+				resp := client.do(ctx, http.MethodPost, "/v2/test/app/blobs/uploads/?digest="+godigest.FromBytes(blob).String(), blob)
+				Expect(resp.StatusCode).To(Equal(http.StatusCreated))
+			}
+			dgst := godigest.SHA512.FromBytes(img.Manifest)
+
+			resp := client.do(ctx, http.MethodPut, "/v2/test/app/manifests/"+dgst.String(), img.Manifest, "Content-Type", ociimage.MediaTypeImageManifest)
+			Expect(resp.StatusCode).To(Equal(http.StatusCreated), string(readBody(resp)))
+			Expect(resp.Header.Get("Docker-Content-Digest")).To(Equal(dgst.String()))
+
+			resp = client.do(ctx, http.MethodPut, "/v2/test/app/manifests/"+godigest.SHA512.FromString("other").String(), img.Manifest, "Content-Type", ociimage.MediaTypeImageManifest)
+			expectErrorCode(resp, http.StatusBadRequest, "MANIFEST_INVALID")
+		})
+	})
+
+	When("referrers are listed before any manifest has been read", func() {
+		It("should list them", func(ctx context.Context) {
+			backend := proxy.NewMemoryBackend()
+			img := newTestImage("subject layer")
+			sig := newTestImage("cold signature layer")
+			sig.Manifest = mustMarshal(ociimage.Manifest{
+				Versioned:    ocispec.Versioned{SchemaVersion: 2},
+				MediaType:    ociimage.MediaTypeImageManifest,
+				ArtifactType: "application/vnd.example.signature",
+				Config:       ociimage.Descriptor{MediaType: ociimage.MediaTypeImageConfig, Digest: sig.ConfigDigest, Size: int64(len(sig.Config))},
+				Layers:       []ociimage.Descriptor{{MediaType: ociimage.MediaTypeImageLayer, Digest: sig.LayerDigest, Size: int64(len(sig.Layer))}},
+				Subject:      &ociimage.Descriptor{MediaType: ociimage.MediaTypeImageManifest, Digest: img.Digest, Size: int64(len(img.Manifest))},
+			})
+			sig.Digest = godigest.FromBytes(sig.Manifest)
+			pushClient := startRegistry(ctx, backend)
+			pushClient.push(ctx, "test/app", "v1", img)
+			pushClient.push(ctx, "test/app", "sig", sig)
+
+			client := startRegistry(ctx, classicStoreBackend{exportOnlyBackend{backend}})
+			resp := client.do(ctx, http.MethodGet, "/v2/test/app/referrers/"+img.Digest.String(), nil)
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			var referrers ociimage.Index
+			Expect(json.NewDecoder(resp.Body).Decode(&referrers)).To(Succeed())
+			Expect(referrers.Manifests).To(HaveLen(1))
+			Expect(referrers.Manifests[0].Digest).To(Equal(sig.Digest))
+		})
+	})
+
+	When("a blob is checked for before its image has been exported", func() {
+		It("should answer without exporting the image", func(ctx context.Context) {
+			backend := &countingBackend{MemoryBackend: proxy.NewMemoryBackend()}
+			img := newTestImage("checked layer")
+			startRegistry(ctx, backend).push(ctx, "test/app", "v1", img)
+
+			client := startRegistry(ctx, exportOnlyBackend{backend})
+			resp := client.do(ctx, http.MethodHead, "/v2/test/app/blobs/"+img.LayerDigest.String(), nil)
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			Expect(resp.Header.Get("Docker-Content-Digest")).To(Equal(img.LayerDigest.String()))
+			// The size cannot be known without exporting the image
+			Expect(resp.ContentLength).To(Equal(int64(-1)))
+
+			client = startRegistry(ctx, backend)
+			resp = client.do(ctx, http.MethodHead, "/v2/test/app/blobs/"+img.LayerDigest.String(), nil)
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			Expect(resp.ContentLength).To(Equal(int64(len(img.Layer))))
+
+			Expect(backend.saves.Load()).To(BeZero())
+		})
+	})
+
+	When("an export has only one reader", func() {
+		It("should stream it without spooling it", func(ctx context.Context) {
+			backend := exportOnlyBackend{proxy.NewMemoryBackend()}
+			img := newTestImage("streamed layer")
+			startRegistry(ctx, backend).push(ctx, "test/app", "v1", img)
+
+			// Spool files cannot be created in a directory which does not exist
+			exportDir := filepath.Join(GinkgoT().TempDir(), "missing")
+			reg := proxy.New(proxy.Config{Backend: backend, ExportDir: exportDir})
+			Expect(reg.BuildIndex(ctx)).To(Succeed())
+			srv := httptest.NewServer(reg.BuildHandler())
+			DeferCleanup(srv.Close)
+			client := registryClient{srv: srv}
+
+			resp := client.do(ctx, http.MethodGet, "/v2/test/app/manifests/v1", nil)
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			Expect(readBody(resp)).To(Equal(img.Manifest))
+			resp = client.do(ctx, http.MethodGet, "/v2/test/app/blobs/"+img.LayerDigest.String(), nil)
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			Expect(readBody(resp)).To(Equal(img.Layer))
+		})
+	})
+
+	When("an upload is abandoned", func() {
+		It("should expire it and remove its data", func(ctx context.Context) {
+			uploadDir := filepath.Join(GinkgoT().TempDir(), "uploads")
+			reg := proxy.New(proxy.Config{
+				Backend:   proxy.NewMemoryBackend(),
+				UploadDir: uploadDir,
+				UploadTTL: 100 * time.Millisecond,
+			})
+			Expect(reg.BuildIndex(ctx)).To(Succeed())
+			srv := httptest.NewServer(reg.BuildHandler())
+			DeferCleanup(srv.Close)
+			client := registryClient{srv: srv}
+
+			resp := client.do(ctx, http.MethodPost, "/v2/test/app/blobs/uploads/", nil)
+			Expect(resp.StatusCode).To(Equal(http.StatusAccepted))
+			location := resp.Header.Get("Location")
+			resp = client.do(ctx, http.MethodPatch, location, []byte("partial"))
+			Expect(resp.StatusCode).To(Equal(http.StatusAccepted))
+			Expect(os.ReadDir(filepath.Join(uploadDir, "uploads"))).To(HaveLen(1))
+
+			watchCtx, cancel := context.WithCancel(ctx)
+			DeferCleanup(cancel)
+			go reg.ExpireUploads(watchCtx)
+
+			Eventually(func(g Gomega) {
+				g.Expect(os.ReadDir(filepath.Join(uploadDir, "uploads"))).To(BeEmpty())
+			}).Should(Succeed())
+			resp = client.do(ctx, http.MethodGet, location, nil)
+			expectErrorCode(resp, http.StatusNotFound, "BLOB_UPLOAD_UNKNOWN")
+		})
+	})
+})
@@ -0,0 +1,198 @@
+package proxy
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/errdefs"
+
+	godigest "github.com/opencontainers/go-digest"
+	ociimage "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// errTarballsReadOnly is returned when attempting to change the images of a TarballBackend
+var errTarballsReadOnly = errdefs.NotImplemented(fmt.Errorf("images served from tarballs cannot be changed"))
+
+// tarballBlob is the location of a blob within a tarball
+type tarballBlob struct {
+	// Path is the path of the tarball
+	Path string
+	// Offset is where the content of the blob starts within the tarball
+	Offset int64
+	// Size is the size of the blob
+	Size int64
+}
+
+// TarballBackend serves images from a directory of tarballs produced by docker save, in either the OCI image
+// layout format or the legacy format of daemons older than Docker 25, without a daemon.
+// The tarballs are indexed once when the backend is created, after which blobs are read directly from them.
+// Images are tagged by the annotations of their index and by the manifest.json of their tarball, and where more
+// than one tarball has the same tag, the last by path wins.
+// Images of the legacy format have no manifest, so one is built from manifest.json, the same as when a daemon
+// exports them, and the image is identified by the digest of that manifest.
+type TarballBackend struct {
+	images *imageStore
+	// blobs is a map from digest to location of every blob of every image.
+	// It is not modified after the backend is created.
+	blobs map[godigest.Digest]tarballBlob
+	// builtManifests is a map from digest to content of the manifests built for images of the legacy format.
+	// It is not modified after the backend is created.
+	builtManifests map[godigest.Digest][]byte
+}
+
+var _ BlobBackend = &TarballBackend{}
+
+// NewTarballBackend indexes every .tar file in dir and its subdirectories, and returns a backend serving them.
+// Tarballs which cannot be read are skipped.
+func NewTarballBackend(ctx context.Context, dir string) (*TarballBackend, error) {
+	t := &TarballBackend{
+		blobs:          make(map[godigest.Digest]tarballBlob),
+		builtManifests: make(map[godigest.Digest][]byte),
+	}
+	t.images = newImageStore(t)
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !strings.HasSuffix(d.Name(), ".tar") {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		err = t.addTarball(ctx, path)
+		if err != nil {
+			slog.Warn("skipping tarball", "path", path, "error", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("indexing tarballs in %s: %w", dir, err)
+	}
+	return t, nil
+}
+
+// addTarball indexes the blobs of a tarball, then adds its images
+func (t *TarballBackend) addTarball(ctx context.Context, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	// Large blobs are skipped over rather than read, so the position of the file after reading each header is
+	// the start of its content
+	offsets := make(map[string]tarballBlob)
+	saved, err := readSavedImage(f, nil, func(h *tar.Header) {
+		offset, err := f.Seek(0, io.SeekCurrent)
+		if err == nil && h.Typeflag == tar.TypeReg {
+			offsets[h.Name] = tarballBlob{Path: path, Offset: offset, Size: h.Size}
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	for name, blob := range offsets {
+		var dgst godigest.Digest
+		if encoded, ok := strings.CutPrefix(name, ociimage.ImageBlobsDir+"/"); ok {
+			dgst = godigest.Digest(strings.Replace(encoded, "/", ":", 1))
+		} else if desc, ok := saved.LegacyFiles[name]; ok {
+			dgst = desc.Digest
+		}
+		if dgst.Validate() != nil {
+			continue
+		}
+		if _, ok := t.blobs[dgst]; !ok {
+			t.blobs[dgst] = blob
+		}
+	}
+
+	if len(saved.Index.Manifests) != 0 {
+		images, err := t.images.archiveImages(ctx, saved.Index, saved.DockerManifests)
+		if err != nil {
+			return err
+		}
+		for _, img := range images {
+			err = t.images.addImage(img.Descriptor, img.Tags)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if len(saved.DockerManifests) == 0 {
+		return fmt.Errorf("tarball has neither %s nor %s", ociimage.ImageIndexFile, dockerArchiveManifestFile)
+	}
+	for _, dockerManifest := range saved.DockerManifests {
+		configDesc, _, ok := saved.legacyFile(dockerManifest.Config)
+		if !ok {
+			return fmt.Errorf("tarball did not contain config %s", dockerManifest.Config)
+		}
+		manifest, err := saved.legacyManifest(string(configDesc.Digest))
+		if err != nil {
+			return err
+		}
+		t.builtManifests[manifest.Digest] = manifest.JSON
+		desc := ociimage.Descriptor{
+			MediaType: manifest.MediaType,
+			Digest:    manifest.Digest,
+			Size:      int64(len(manifest.JSON)),
+		}
+		err = t.images.addImage(desc, dockerManifest.RepoTags)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *TarballBackend) openBlob(dgst godigest.Digest) (io.ReadCloser, int64, error) {
+	if manifestJSON, ok := t.builtManifests[dgst]; ok {
+		return &sectionReadCloser{SectionReader: io.NewSectionReader(bytes.NewReader(manifestJSON), 0, int64(len(manifestJSON)))}, int64(len(manifestJSON)), nil
+	}
+	blob, ok := t.blobs[dgst]
+	if !ok {
+		return nil, 0, errdefs.NotFound(fmt.Errorf("no such blob: %s", dgst))
+	}
+	f, err := os.Open(blob.Path)
+	if err != nil {
+		return nil, 0, err
+	}
+	return &sectionReadCloser{SectionReader: io.NewSectionReader(f, blob.Offset, blob.Size), closer: f}, blob.Size, nil
+}
+
+func (t *TarballBackend) BlobOpen(_ context.Context, dgst godigest.Digest) (io.ReadCloser, int64, error) {
+	return t.openBlob(dgst)
+}
+
+func (t *TarballBackend) ImageList(_ context.Context) ([]image.Summary, error) {
+	return t.images.list(), nil
+}
+
+func (t *TarballBackend) ImageInspect(_ context.Context, ref string) (image.InspectResponse, error) {
+	return t.images.inspect(ref)
+}
+
+func (t *TarballBackend) ImageSave(_ context.Context, imgID string) (io.ReadCloser, error) {
+	return t.images.save(imgID)
+}
+
+// ImageLoad is not supported, as the tarballs are only indexed once
+func (t *TarballBackend) ImageLoad(_ context.Context, _ io.Reader) error {
+	return errTarballsReadOnly
+}
+
+// ImageRemove is not supported, as the tarballs are only indexed once
+func (t *TarballBackend) ImageRemove(_ context.Context, _ string) error {
+	return errTarballsReadOnly
+}
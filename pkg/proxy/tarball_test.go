@@ -0,0 +1,141 @@
+package proxy_test
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/meln5674/oci-reg-docker/pkg/proxy"
+	godigest "github.com/opencontainers/go-digest"
+	ociimage "github.com/opencontainers/image-spec/specs-go/v1"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// tarballEntry is a file to write into a tarball
+type tarballEntry struct {
+	Name    string
+	Content []byte
+}
+
+// writeTarball writes a tarball containing the given files
+func writeTarball(path string, entries ...tarballEntry) {
+	Expect(os.MkdirAll(filepath.Dir(path), 0o755)).To(Succeed())
+	f, err := os.Create(path)
+	Expect(err).ToNot(HaveOccurred())
+	defer f.Close()
+	tw := tar.NewWriter(f)
+	for _, entry := range entries {
+		Expect(tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     entry.Name,
+			Size:     int64(len(entry.Content)),
+			Mode:     0o644,
+		})).To(Succeed())
+		_, err := tw.Write(entry.Content)
+		Expect(err).ToNot(HaveOccurred())
+	}
+	Expect(tw.Close()).To(Succeed())
+}
+
+func mustMarshal(v any) []byte {
+	content, err := json.Marshal(v)
+	Expect(err).ToNot(HaveOccurred())
+	return content
+}
+
+func blobEntry(content []byte) tarballEntry {
+	dgst := godigest.FromBytes(content)
+	return tarballEntry{Name: "blobs/" + dgst.Algorithm().String() + "/" + dgst.Encoded(), Content: content}
+}
+
+var _ = Describe("TarballBackend", func() {
+	var dir string
+	var ociImg testImage
+	var legacyImg testImage
+	var client registryClient
+
+	BeforeEach(func(ctx context.Context) {
+		dir = GinkgoT().TempDir()
+
+		ociImg = newTestImage("oci layer")
+		writeTarball(filepath.Join(dir, "oci.tar"),
+			tarballEntry{Name: ociimage.ImageLayoutFile, Content: mustMarshal(ociimage.ImageLayout{Version: ociimage.ImageLayoutVersion})},
+			tarballEntry{Name: ociimage.ImageIndexFile, Content: mustMarshal(ociimage.Index{
+				MediaType: ociimage.MediaTypeImageIndex,
+				Manifests: []ociimage.Descriptor{{
+					MediaType: ociimage.MediaTypeImageManifest,
+					Digest:    ociImg.Digest,
+					Size:      int64(len(ociImg.Manifest)),
+					Annotations: map[string]string{
+						"io.containerd.image.name": "docker.io/test/oci:v1",
+						ociimage.AnnotationRefName: "v1",
+					},
+				}},
+			})},
+			blobEntry(ociImg.Layer),
+			blobEntry(ociImg.Config),
+			blobEntry(ociImg.Manifest),
+		)
+
+		legacyImg = newTestImage("legacy layer")
+		writeTarball(filepath.Join(dir, "nested", "legacy.tar"),
+			tarballEntry{Name: "manifest.json", Content: mustMarshal([]map[string]any{{
+				"Config":   legacyImg.ConfigDigest.Encoded() + ".json",
+				"RepoTags": []string{"test/legacy:v1"},
+				"Layers":   []string{"0123/layer.tar"},
+			}})},
+			tarballEntry{Name: legacyImg.ConfigDigest.Encoded() + ".json", Content: legacyImg.Config},
+			tarballEntry{Name: "0123/layer.tar", Content: legacyImg.Layer},
+		)
+
+		backend, err := proxy.NewTarballBackend(ctx, dir)
+		Expect(err).ToNot(HaveOccurred())
+		client = startRegistry(ctx, backend)
+	})
+
+	It("should serve images from OCI image layout tarballs", func(ctx context.Context) {
+		resp := client.do(ctx, http.MethodGet, "/v2/test/oci/manifests/v1", nil)
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		Expect(readBody(resp)).To(Equal(ociImg.Manifest))
+
+		resp = client.do(ctx, http.MethodGet, "/v2/test/oci/blobs/"+ociImg.LayerDigest.String(), nil, "Range", "bytes=4-")
+		Expect(resp.StatusCode).To(Equal(http.StatusPartialContent))
+		Expect(readBody(resp)).To(Equal(ociImg.Layer[4:]))
+	})
+
+	It("should serve images from legacy tarballs", func(ctx context.Context) {
+		resp := client.do(ctx, http.MethodGet, "/v2/test/legacy/manifests/v1", nil)
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		var manifest ociimage.Manifest
+		Expect(json.NewDecoder(resp.Body).Decode(&manifest)).To(Succeed())
+		Expect(manifest.Config.Digest).To(Equal(legacyImg.ConfigDigest))
+		Expect(manifest.Layers).To(HaveLen(1))
+		Expect(manifest.Layers[0].Digest).To(Equal(legacyImg.LayerDigest))
+
+		resp = client.do(ctx, http.MethodGet, "/v2/test/legacy/blobs/"+legacyImg.LayerDigest.String(), nil)
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		Expect(readBody(resp)).To(Equal(legacyImg.Layer))
+
+		resp = client.do(ctx, http.MethodGet, "/v2/test/legacy/blobs/"+legacyImg.ConfigDigest.String(), nil)
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		Expect(readBody(resp)).To(Equal(legacyImg.Config))
+	})
+
+	It("should list the repositories of every tarball", func(ctx context.Context) {
+		resp := client.do(ctx, http.MethodGet, "/v2/_catalog", nil)
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		var catalog struct{ Repositories []string }
+		Expect(json.NewDecoder(resp.Body).Decode(&catalog)).To(Succeed())
+		Expect(catalog.Repositories).To(ConsistOf("docker.io/test/oci", "docker.io/test/legacy"))
+	})
+
+	It("should refuse to delete images", func(ctx context.Context) {
+		resp := client.do(ctx, http.MethodDelete, "/v2/test/oci/manifests/v1", nil)
+		expectErrorCode(resp, http.StatusMethodNotAllowed, "UNSUPPORTED")
+	})
+})
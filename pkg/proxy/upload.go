@@ -0,0 +1,384 @@
+package proxy
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	godigest "github.com/opencontainers/go-digest"
+)
+
+const (
+	// defaultUploadTTL is how long an upload session may go without receiving data before it is expired, if
+	// UploadTTL is not set
+	defaultUploadTTL = 24 * time.Hour
+	// maxUploadSweepInterval is the longest to wait between checks for expired upload sessions
+	maxUploadSweepInterval = 10 * time.Minute
+)
+
+// uploadSession is an in-progress blob upload.
+// Data is appended to a file in the upload directory until the client finishes the session with
+// the expected digest, at which point it is verified and moved into the staged blob directory, or into the backend
+// if it stores blobs as files.
+type uploadSession struct {
+	// ID is the opaque ID handed to the client in the Location header
+	ID string
+	// Name is the repository the upload was started for
+	Name string
+	// path is the file the uploaded data is appended to
+	path string
+	// offset is the number of bytes received so far
+	offset int64
+	// updated is when the session was started or last received data
+	updated time.Time
+	// ended is set once the session has been finished, cancelled, or expired, after which it must not be used
+	ended bool
+	// lock must be held when using the session
+	lock sync.Mutex
+}
+
+// Location is the URL path the client uses to continue this session
+func (u *uploadSession) Location() string {
+	return "/v2/" + u.Name + "/blobs/uploads/" + u.ID
+}
+
+// Range is the value of the Range header reporting how much data has been received
+func (u *uploadSession) Range() string {
+	if u.offset == 0 {
+		return "0-0"
+	}
+	return fmt.Sprintf("0-%d", u.offset-1)
+}
+
+// append writes a chunk to the end of the session and advances the offset
+func (u *uploadSession) append(chunk io.Reader) error {
+	f, err := os.OpenFile(u.path, os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("opening upload file: %w", err)
+	}
+	defer f.Close()
+	n, err := io.Copy(f, chunk)
+	u.offset += n
+	u.updated = time.Now()
+	if err != nil {
+		return fmt.Errorf("writing upload chunk: %w", err)
+	}
+	return nil
+}
+
+// PushEnabled returns true if clients are allowed to upload blobs and manifests
+func (r *Registry) PushEnabled() bool {
+	return r.UploadDir != ""
+}
+
+func (r *Registry) uploadsDir() string {
+	return filepath.Join(r.UploadDir, "uploads")
+}
+
+// stagedBlobPath returns the path that a completed blob upload with the given digest is stored at, which is in the
+// backend itself if it stores blobs as files
+func (r *Registry) stagedBlobPath(dgst godigest.Digest) string {
+	blobsDir := filepath.Join(r.UploadDir, "blobs")
+	if store, ok := r.Backend.(BlobStoringBackend); ok {
+		blobsDir = store.BlobDir()
+	}
+	return filepath.Join(blobsDir, dgst.Algorithm().String(), dgst.Encoded())
+}
+
+// statStagedBlob returns the size of a staged blob, or false if it has not been uploaded
+func (r *Registry) statStagedBlob(dgst godigest.Digest) (int64, bool) {
+	if !r.PushEnabled() {
+		return 0, false
+	}
+	info, err := os.Stat(r.stagedBlobPath(dgst))
+	if err != nil {
+		return 0, false
+	}
+	return info.Size(), true
+}
+
+func (r *Registry) startUpload(name string) (*uploadSession, error) {
+	idBytes := make([]byte, 16)
+	_, err := rand.Read(idBytes)
+	if err != nil {
+		return nil, fmt.Errorf("generating upload ID: %w", err)
+	}
+	upload := &uploadSession{
+		ID:      hex.EncodeToString(idBytes),
+		Name:    name,
+		updated: time.Now(),
+	}
+	upload.path = filepath.Join(r.uploadsDir(), upload.ID)
+	err = os.MkdirAll(r.uploadsDir(), 0o700)
+	if err != nil {
+		return nil, fmt.Errorf("creating upload directory: %w", err)
+	}
+	f, err := os.OpenFile(upload.path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("creating upload file: %w", err)
+	}
+	f.Close()
+
+	r.uploadLock.Lock()
+	defer r.uploadLock.Unlock()
+	r.uploads[upload.ID] = upload
+	return upload, nil
+}
+
+// lockUpload returns the upload session with the given ID with its lock held, or false if there is no session
+// with that ID for the given repository
+func (r *Registry) lockUpload(name, id string) (*uploadSession, bool) {
+	r.uploadLock.Lock()
+	upload, ok := r.uploads[id]
+	r.uploadLock.Unlock()
+	if !ok || upload.Name != name {
+		return nil, false
+	}
+	upload.lock.Lock()
+	// The session may have ended while waiting for another request using it
+	if upload.ended {
+		upload.lock.Unlock()
+		return nil, false
+	}
+	return upload, true
+}
+
+// removeUpload forgets an upload session and deletes any data it had received.
+// The lock of the session must be held.
+func (r *Registry) removeUpload(upload *uploadSession) error {
+	r.uploadLock.Lock()
+	delete(r.uploads, upload.ID)
+	r.uploadLock.Unlock()
+	upload.ended = true
+	err := os.Remove(upload.path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("removing upload file: %w", err)
+	}
+	return nil
+}
+
+// errDigestMismatch is returned when the data uploaded does not match the digest the client claimed
+var errDigestMismatch = &registryError{Status: http.StatusBadRequest, Code: codeDigestInvalid, Message: "uploaded content does not match digest"}
+
+// finishUpload verifies that the data in an upload session matches the expected digest, and if so,
+// moves it to the staged blob directory and ends the session.
+func (r *Registry) finishUpload(upload *uploadSession, expected godigest.Digest) error {
+	f, err := os.Open(upload.path)
+	if err != nil {
+		return fmt.Errorf("opening upload file: %w", err)
+	}
+	verifier := expected.Verifier()
+	_, err = io.Copy(verifier, f)
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("reading upload file: %w", err)
+	}
+	if !verifier.Verified() {
+		return errDigestMismatch
+	}
+	blobPath := r.stagedBlobPath(expected)
+	dirMode, fileMode := os.FileMode(0o700), os.FileMode(0o600)
+	if _, ok := r.Backend.(BlobStoringBackend); ok {
+		// Blobs in the backend are shared with other tools, and never change
+		dirMode, fileMode = 0o755, 0o444
+	}
+	err = os.MkdirAll(filepath.Dir(blobPath), dirMode)
+	if err != nil {
+		return fmt.Errorf("creating blob directory: %w", err)
+	}
+	err = os.Chmod(upload.path, fileMode)
+	if err != nil {
+		return fmt.Errorf("staging blob: %w", err)
+	}
+	err = moveFile(upload.path, blobPath)
+	if err != nil {
+		return fmt.Errorf("staging blob: %w", err)
+	}
+	upload.ended = true
+	r.uploadLock.Lock()
+	defer r.uploadLock.Unlock()
+	delete(r.uploads, upload.ID)
+	return nil
+}
+
+// moveFile moves a file, copying it if it cannot be renamed, such as when the destination is on another filesystem.
+// The destination only ever appears once it is complete.
+func moveFile(src, dst string) error {
+	err := os.Rename(src, dst)
+	if err == nil {
+		return nil
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := os.CreateTemp(filepath.Dir(dst), ".tmp-"+filepath.Base(dst)+"-")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	closeErr := out.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(out.Name(), info.Mode())
+	}
+	if err == nil {
+		err = os.Rename(out.Name(), dst)
+	}
+	if err != nil {
+		os.Remove(out.Name())
+		return err
+	}
+	return os.Remove(src)
+}
+
+// stageBlob writes a blob uploaded in a single request directly to the staged blob directory,
+// verifying it against the expected digest.
+func (r *Registry) stageBlob(body io.Reader, expected godigest.Digest) error {
+	upload, err := r.startUpload("")
+	if err != nil {
+		return err
+	}
+	upload.lock.Lock()
+	defer upload.lock.Unlock()
+	err = upload.append(body)
+	if err == nil {
+		err = r.finishUpload(upload, expected)
+	}
+	if err != nil {
+		r.removeUpload(upload)
+		return err
+	}
+	return nil
+}
+
+// uploadTTL returns how long an upload session may go without receiving data before it is expired
+func (r *Registry) uploadTTL() time.Duration {
+	if r.UploadTTL <= 0 {
+		return defaultUploadTTL
+	}
+	return r.UploadTTL
+}
+
+// ExpireUploads removes upload sessions which have not received data for UploadTTL, along with the data they
+// received, as clients which abandon an upload never cancel it.
+// Staged blobs which no pushed manifest has used for as long are removed as well, as are files left in UploadDir
+// from before the registry was restarted.
+// This blocks until ctx is cancelled, and so should be called in a separate goroutine.
+// Returns immediately if pushing is disabled.
+func (r *Registry) ExpireUploads(ctx context.Context) error {
+	if !r.PushEnabled() {
+		return nil
+	}
+	ttl := r.uploadTTL()
+	interval := min(ttl/2, maxUploadSweepInterval)
+	for {
+		r.expireUploads(time.Now().Add(-ttl))
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+}
+
+// expireUploads removes the upload sessions, files in the upload directory, and staged blobs last updated
+// before cutoff. Sessions which are in use are skipped.
+func (r *Registry) expireUploads(cutoff time.Time) {
+	r.uploadLock.Lock()
+	defer r.uploadLock.Unlock()
+	for id, upload := range r.uploads {
+		if !upload.lock.TryLock() {
+			continue
+		}
+		if upload.updated.Before(cutoff) {
+			slog.Info("expiring abandoned upload", "id", id, "name", upload.Name, "received", upload.offset)
+			delete(r.uploads, id)
+			upload.ended = true
+			err := os.Remove(upload.path)
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				slog.Warn("failed to remove upload file", "path", upload.path, "error", err)
+			}
+		}
+		upload.lock.Unlock()
+	}
+
+	entries, err := os.ReadDir(r.uploadsDir())
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			slog.Warn("failed to list upload directory", "path", r.uploadsDir(), "error", err)
+		}
+		return
+	}
+	for _, entry := range entries {
+		if _, ok := r.uploads[entry.Name()]; ok {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || !info.ModTime().Before(cutoff) {
+			continue
+		}
+		path := filepath.Join(r.uploadsDir(), entry.Name())
+		slog.Info("removing upload file left by a previous run", "path", path)
+		err = os.Remove(path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			slog.Warn("failed to remove upload file", "path", path, "error", err)
+		}
+	}
+
+	blobsDir := filepath.Join(r.UploadDir, "blobs")
+	err = filepath.WalkDir(blobsDir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil || !info.ModTime().Before(cutoff) {
+			return nil
+		}
+		slog.Info("removing unused staged blob", "path", path)
+		err = os.Remove(path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			slog.Warn("failed to remove staged blob", "path", path, "error", err)
+		}
+		return nil
+	})
+	if err != nil {
+		slog.Warn("failed to list staged blobs", "path", blobsDir, "error", err)
+	}
+}
+
+// parseContentRange parses the Content-Range header of a chunked upload.
+// Unlike the standard HTTP header, the distribution spec does not include the "bytes" unit or a total length.
+func parseContentRange(contentRange string) (start, end int64, err error) {
+	contentRange = strings.TrimPrefix(contentRange, "bytes ")
+	contentRange, _, _ = strings.Cut(contentRange, "/")
+	_, err = fmt.Sscanf(contentRange, "%d-%d", &start, &end)
+	if err != nil {
+		return 0, 0, fmt.Errorf("%w: invalid Content-Range %q: %w", errUploadInvalid, contentRange, err)
+	}
+	return start, end, nil
+}